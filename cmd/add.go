@@ -1,20 +1,16 @@
 package main
 
 import (
-	"fmt"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/hanwen/go-fuse/v2/fuse"
-	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
-	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
-	"github.com/hanwen/go-fuse/v2/unionfs"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/chiyutianyi/git-fuse-worktree/pkg/fs"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
 )
 
 type addCmd struct {
@@ -22,10 +18,25 @@ type addCmd struct {
 		debug    bool
 		logLevel string
 		gitDir   string
+		daemon   bool
+		metrics  string
 
-		lazy    bool
-		disk    bool
-		tempDir string
+		upperDir  string
+		ephemeral bool
+
+		lazy        bool
+		disk        bool
+		tempDir     string
+		cacheSize   uint64
+		objectStore string
+
+		prefetch        string
+		prefetchWorkers int
+		autosnapshot    time.Duration
+		recordAccess    string
+
+		log      logFlags
+		watchdog fs.WatchdogOptions
 
 		portable        bool
 		entryTtl        float64
@@ -44,72 +55,130 @@ func (cmd *addCmd) getLogLevel() (logLevel log.Level) {
 	return logLevel
 }
 
-func (cmd *addCmd) Run(_ *cobra.Command, args []string) {
+func (cmd *addCmd) mountArgs(gitDir, name, revision string) *MountArgs {
+	return &MountArgs{
+		GitDir:   gitDir,
+		Name:     name,
+		Revision: revision,
+		Debug:    cmd.o.debug,
+
+		UpperDir:  cmd.o.upperDir,
+		Ephemeral: cmd.o.ephemeral,
+
+		Lazy:        cmd.o.lazy,
+		Disk:        cmd.o.disk,
+		TempDir:     cmd.o.tempDir,
+		CacheSize:   cmd.o.cacheSize,
+		ObjectStore: cmd.o.objectStore,
+
+		Prefetch:        cmd.o.prefetch,
+		PrefetchWorkers: cmd.o.prefetchWorkers,
+		Autosnapshot:    cmd.o.autosnapshot,
+		RecordAccess:    cmd.o.recordAccess,
+
+		LogFormat:  cmd.o.log.format,
+		LogFile:    cmd.o.log.file,
+		LogMaxSize: cmd.o.log.maxSize,
+		LogBackups: cmd.o.log.backups,
+		SlowOp:     cmd.o.log.slowOp,
+
+		Watchdog: cmd.o.watchdog,
+
+		Portable:        cmd.o.portable,
+		EntryTtl:        cmd.o.entryTtl,
+		NegativeTtl:     cmd.o.negativeTtl,
+		DeletionDirname: cmd.o.deletionDirname,
+	}
+}
+
+// register records the worktree in the registry of the user, for restore
+// to mount it again after a reboot.
+func (cmd *addCmd) register(args *MountArgs) {
+	e := RegistryEntry{
+		Repo:       args.GitDir,
+		Name:       args.Name,
+		Mountpoint: getMountpoint(args.GitDir, args.Name),
+		Revision:   args.Revision,
+		Daemon:     cmd.o.daemon,
+		Added:      time.Now(),
+		Args:       args,
+	}
+	if cfg, err := worktrees.LoadConfig(getWorktree(args.GitDir, args.Name)); err == nil {
+		e.Upper, e.Ephemeral = cfg.Upper, cfg.Ephemeral
+	}
+	if err := registerWorktree(e); err != nil {
+		log.Warnf("register %s: %v", args.Name, err)
+	}
+}
+
+func (cmd *addCmd) Run(c *cobra.Command, args []string) {
 	log.SetLevel(cmd.getLogLevel())
+	setLogFormat(cmd.o.log.format)
 	if len(args) < 2 {
 		log.Fatalf("usage: %s add <worktree> <revision>", os.Args[0])
 	}
 
-	revision := args[1]
-
 	gitDir := getGitDir(cmd.o.gitDir)
-
-	mp := getMountpoint(gitDir, args[0])
-	upper := fmt.Sprintf("%s/%s-upper", gitDir, args[0])
-	worktree := getWorktree(gitDir, args[0])
-
-	doCheckAndUnmount(mp)
-
-	tempDir, err := ioutil.TempDir("", cmd.o.tempDir)
-	if err != nil {
-		log.Fatalf("TempDir: %v", err)
+	mountArgs := cmd.mountArgs(gitDir, args[0], args[1])
+	if mountArgs.Prefetch != "" && !filepath.IsAbs(mountArgs.Prefetch) {
+		mountArgs.Prefetch = filepath.Join(os.Getenv("PWD"), mountArgs.Prefetch)
 	}
-
-	opts := &fs.GitFSOptions{
-		Lazy:    cmd.o.lazy,
-		Disk:    cmd.o.disk,
-		TempDir: tempDir,
+	if mountArgs.RecordAccess != "" && !filepath.IsAbs(mountArgs.RecordAccess) {
+		mountArgs.RecordAccess = filepath.Join(os.Getenv("PWD"), mountArgs.RecordAccess)
 	}
-
-	ufsOptions := unionfs.UnionFsOptions{
-		DeletionCacheTTL: time.Duration(cmd.o.delcacheTtl * float64(time.Second)),
-		BranchCacheTTL:   time.Duration(cmd.o.branchcacheTtl * float64(time.Second)),
-		DeletionDirName:  cmd.o.deletionDirname,
+	if mountArgs.LogFile != "" && mountArgs.LogFile != "-" && !filepath.IsAbs(mountArgs.LogFile) {
+		mountArgs.LogFile = filepath.Join(os.Getenv("PWD"), mountArgs.LogFile)
 	}
-
-	fses := make([]pathfs.FileSystem, 0)
-	fses = append(fses, pathfs.NewLoopbackFileSystem(upper))
-
-	root, err := fs.NewTreeFSRoot(cmd.o.gitDir, revision, worktree, opts)
-	if err != nil {
-		log.Fatalf("NewTreeFSRoot: %v", err)
+	if mountArgs.UpperDir != "" && !filepath.IsAbs(mountArgs.UpperDir) {
+		mountArgs.UpperDir = filepath.Join(os.Getenv("PWD"), mountArgs.UpperDir)
 	}
-
-	fses = append(fses, root)
-	ufs, err := unionfs.NewUnionFs(fses, ufsOptions)
-	if err != nil {
-		log.Fatalf("NewUnionFs: %v", err)
+	if mountArgs.UpperDir != "" && mountArgs.Ephemeral {
+		log.Fatalf("--upper-dir and --ephemeral are exclusive")
+	}
+	if err := fs.CheckWatchdogPolicy(mountArgs.Watchdog.Policy); err != nil {
+		log.Fatalf("%v", err)
 	}
 
-	nodeFs := pathfs.NewPathNodeFs(ufs, &pathfs.PathNodeFsOptions{ClientInodes: true})
-	mOpts := nodefs.Options{
-		EntryTimeout:    time.Duration(cmd.o.entryTtl * float64(time.Second)),
-		AttrTimeout:     time.Duration(cmd.o.entryTtl * float64(time.Second)),
-		NegativeTimeout: time.Duration(cmd.o.negativeTtl * float64(time.Second)),
-		PortableInodes:  cmd.o.portable,
-		Owner: &fuse.Owner{
-			Uid: uint32(os.Getuid()),
-			Gid: uint32(os.Getgid()),
-		},
-		Debug: cmd.o.debug,
+	if cmd.o.daemon {
+		if cmd.o.metrics != "" {
+			log.Warnf("--metrics is ignored with --daemon, the daemon serves the metrics of its worktrees")
+		}
+		// The daemon reads the objects of every worktree it serves the
+		// same way. Unless asked for, it is whatever the daemon does.
+		if !c.Flags().Changed("object-store") {
+			mountArgs.ObjectStore = ""
+		}
+		if !c.Flags().Changed("cache-size") {
+			mountArgs.CacheSize = 0
+		}
+		client, err := dialDaemon(gitDir, &daemonOptions{
+			logLevel:    cmd.o.logLevel,
+			objectStore: mountArgs.ObjectStore,
+			cacheSize:   mountArgs.CacheSize,
+		})
+		if err != nil {
+			log.Fatalf("connect to daemon: %v", err)
+		}
+		defer client.Close()
+		if err := client.Call("Daemon.Mount", mountArgs, &struct{}{}); err != nil {
+			log.Fatalf("mount %s: %v", args[0], err)
+		}
+		cmd.register(mountArgs)
+		return
 	}
 
-	mountState, _, err := nodefs.MountRoot(mp, nodeFs.Root(), &mOpts)
+	defer startMetrics(cmd.o.metrics)()
+	repo, err := fs.OpenRepository(gitDir, mountArgs.ObjectStore, mountArgs.CacheSize<<20)
 	if err != nil {
-		log.Fatal("Mount fail:", err)
+		log.Fatalf("OpenRepository: %v", err)
 	}
-
-	mountState.Serve()
+	defer repo.Close()
+	m, err := mountWorktree(repo, mountArgs)
+	if err != nil {
+		log.Fatalf("add %s: %v", args[0], err)
+	}
+	cmd.register(mountArgs)
+	m.serve()
 }
 
 func init() {
@@ -125,16 +194,34 @@ func init() {
 	flags := cmd.Flags()
 	flags.BoolVarP(&add.o.debug, "debug", "d", false, "debug")
 	flags.StringVarP(&add.o.logLevel, "log-level", "", "info", "log level")
+	bindLogging(flags, &add.o.log)
+	bindWatchdog(flags, &add.o.watchdog)
 	bindGitDir(flags, &add.o.gitDir)
 
+	flags.BoolVarP(&add.o.daemon, "daemon", "", false, "serve the worktree from the repository daemon, starting it if needed")
+	bindMetrics(flags, &add.o.metrics)
+
+	flags.StringVarP(&add.o.upperDir, "upper-dir", "", "", "keep the changes to the worktree in this dir instead of <git-dir>/<worktree>-upper")
+	flags.BoolVarP(&add.o.ephemeral, "ephemeral", "", false, "keep the changes in a private dir that is deleted on unmount")
+
 	flags.BoolVarP(&add.o.lazy, "lazy", "", true, "only read contents for reads")
 	flags.BoolVarP(&add.o.disk, "disk", "", false, "don't use intermediate files")
 	flags.StringVarP(&add.o.tempDir, "tempdir", "", "gitfs", "tempdir name")
+	flags.Uint64VarP(&add.o.cacheSize, "cache-size", "", fs.DefaultCacheSize>>20, "blob content cache size in MiB")
+	bindObjectStore(flags, &add.o.objectStore)
+	flags.StringVarP(&add.o.prefetch, "prefetch", "", "", "prefetch the paths listed in this file after mounting")
+	flags.IntVarP(&add.o.prefetchWorkers, "prefetch-workers", "", fs.DefaultPrefetchWorkers, "number of blobs prefetched in parallel")
+
+	flags.StringVarP(&add.o.recordAccess, "record-access", "", "", "record the paths looked up and opened in this file, for analyze")
+	flags.DurationVarP(&add.o.autosnapshot, "autosnapshot", "", 0, "snapshot the worktree at this interval while it is mounted")
 
 	flags.BoolVarP(&add.o.portable, "portable", "", false, "use 32 bit inodes")
 	flags.Float64VarP(&add.o.entryTtl, "entry-ttl", "", 1.0, "fuse entry cache TTL.")
 	flags.Float64VarP(&add.o.negativeTtl, "negative-ttl", "", 1.0, "fuse negative entry cache TTL.")
 	flags.Float64VarP(&add.o.delcacheTtl, "delcache-cache-ttl", "", 5.0, "Deletion cache TTL in seconds.")
 	flags.Float64VarP(&add.o.branchcacheTtl, "branchcache-ttl", "", 5.0, "Branch cache TTL in seconds.")
-	flags.StringVarP(&add.o.deletionDirname, "deletion-dirname", "", "GOUNIONFS_DELETIONS", "Directory name to use for deletions.")
+	flags.MarkDeprecated("delcache-cache-ttl", "deletions are tracked exactly, there is no cache to expire")
+	flags.MarkDeprecated("branchcache-ttl", "the upper dir is looked up directly, there is no cache to expire")
+	flags.StringVarP(&add.o.deletionDirname, "deletion-dirname", "", "", "Directory name the deletions of an old upper dir are in.")
+	flags.MarkDeprecated("deletion-dirname", "deletions are whiteouts now, it only names the dir to migrate them from")
 }
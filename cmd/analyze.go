@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/fs"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+type analyzeCmd struct {
+	o struct {
+		gitDir   string
+		revision string
+
+		sparse   bool
+		minCount int
+		depth    int
+	}
+}
+
+// inTree returns a filter keeping the files of the tree of the revision,
+// or nil if no revision was given.
+func (cmd *analyzeCmd) inTree() func(name string) bool {
+	if cmd.o.revision == "" {
+		return nil
+	}
+	gitDir := getGitDir(cmd.o.gitDir)
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		log.Fatalf("open %s: %v", gitDir, err)
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(cmd.o.revision))
+	if err != nil {
+		log.Fatalf("resolve %s: %v", cmd.o.revision, err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		log.Fatalf("resolve %s: %v", cmd.o.revision, err)
+	}
+	tree := worktrees.NewTreeBuilder(repo.Storer, commit.TreeHash)
+	return func(name string) bool {
+		mode, _, ok, err := tree.Entry(name)
+		if err != nil {
+			log.Fatalf("read tree of %s: %v", cmd.o.revision, err)
+		}
+		return ok && mode != filemode.Dir && mode != filemode.Submodule
+	}
+}
+
+func (cmd *analyzeCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s analyze <recording>...", os.Args[0])
+	}
+
+	var recordings [][]fs.Access
+	for _, file := range args {
+		accesses, err := fs.LoadAccesses(file)
+		if err != nil {
+			log.Fatalf("read %s: %v", file, err)
+		}
+		recordings = append(recordings, accesses)
+	}
+	inTree := cmd.inTree()
+
+	// Only files make it into either profile, the dirs they are in come
+	// along. The .git file points at the admin dir of the worktree.
+	var files []fs.Access
+	for _, a := range fs.MergeAccesses(recordings...) {
+		if a.Dir || a.Path == ".git" || a.Count < cmd.o.minCount {
+			continue
+		}
+		if inTree != nil && !inTree(a.Path) {
+			continue
+		}
+		files = append(files, a)
+	}
+
+	if cmd.o.sparse {
+		fs.NewConeSparse(fs.ConeDirs(files, cmd.o.depth)).WriteTo(os.Stdout)
+		return
+	}
+	// Files only looked up do not need their contents.
+	var opened []string
+	for _, a := range files {
+		if a.Opened {
+			opened = append(opened, a.Path)
+		}
+	}
+	fmt.Printf("# %d files opened in %d recordings, in the order of their first access\n", len(opened), len(recordings))
+	for _, name := range opened {
+		fmt.Println(fs.EscapePath(name))
+	}
+}
+
+func init() {
+	analyze := &analyzeCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "analyze",
+		Short: "Turn access recordings into a prefetch list or a sparse-checkout cone",
+		Run:   analyze.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &analyze.o.gitDir)
+	flags.StringVarP(&analyze.o.revision, "revision", "r", "", "only keep the files in the tree of this revision")
+	flags.BoolVarP(&analyze.o.sparse, "sparse", "", false, "print a sparse-checkout file instead of a prefetch list")
+	flags.IntVarP(&analyze.o.minCount, "min-count", "", 1, "only keep the paths accessed at least this many times")
+	flags.IntVarP(&analyze.o.depth, "depth", "", 0, "cut the dirs of the sparse-checkout cone down to this many levels")
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	gogit "github.com/go-git/go-git/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+type applyCmd struct {
+	o struct {
+		gitDir string
+	}
+}
+
+func (cmd *applyCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) != 2 {
+		log.Fatalf("usage: %s apply <worktree> <patch>", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	cfg := loadWorktreeConfig(gitDir, args[0])
+
+	var r io.Reader = os.Stdin
+	if args[1] != "-" {
+		f, err := os.Open(args[1])
+		if err != nil {
+			log.Fatalf("open %s: %v", args[1], err)
+		}
+		defer f.Close()
+		r = f
+	}
+	patches, err := worktrees.ParsePatch(r)
+	if err != nil {
+		log.Fatalf("read %s: %v", args[1], err)
+	}
+
+	// A mounted worktree applies them in its mount, where nothing else is
+	// written to the upper layer meanwhile.
+	if client, err := dialControl(getWorktree(gitDir, args[0])); err == nil {
+		defer client.Close()
+		var reply ApplyReply
+		if err := client.Call("Worktree.Apply", &ApplyArgs{Patches: patches}, &reply); err != nil {
+			log.Fatalf("apply %s: %v", args[1], err)
+		}
+		fmt.Printf("applied %d files\n", len(reply.Paths))
+		return
+	}
+
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		log.Fatalf("open %s: %v", gitDir, err)
+	}
+	paths, err := cfg.Apply(repo, patches)
+	if err != nil {
+		log.Fatalf("apply %s: %v", args[1], err)
+	}
+	fmt.Printf("applied %d files\n", len(paths))
+}
+
+func init() {
+	apply := &applyCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "apply",
+		Short: "Apply the unified diff <patch>, or - for stdin, to the upper layer of <worktree>",
+		Run:   apply.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &apply.o.gitDir)
+}
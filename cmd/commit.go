@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+type commitCmd struct {
+	o struct {
+		gitDir string
+
+		message string
+		branch  string
+		force   bool
+		rebase  bool
+	}
+}
+
+func (cmd *commitCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s commit <worktree> -m <message>", os.Args[0])
+	}
+	if cmd.o.message == "" {
+		log.Fatalf("empty commit message")
+	}
+	message := cmd.o.message
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	worktree := getWorktree(gitDir, args[0])
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		log.Fatalf("open %s: %v", gitDir, err)
+	}
+	opts := worktrees.CommitOptions{
+		Message: message,
+		Branch:  cmd.o.branch,
+		Force:   cmd.o.force,
+	}
+	if opts.Author, err = worktrees.Signature(repo, "AUTHOR"); err != nil {
+		log.Fatalf("commit: %v", err)
+	}
+	if opts.Committer, err = worktrees.Signature(repo, "COMMITTER"); err != nil {
+		log.Fatalf("commit: %v", err)
+	}
+
+	// A mounted worktree commits in its mount, where nothing written
+	// meanwhile can be missed or dropped.
+	if client, err := dialControl(worktree); err == nil {
+		defer client.Close()
+		var reply CommitReply
+		err = client.Call("Worktree.Commit", &CommitArgs{
+			Message:   opts.Message,
+			Branch:    opts.Branch,
+			Force:     opts.Force,
+			Author:    opts.Author,
+			Committer: opts.Committer,
+			Rebase:    cmd.o.rebase,
+		}, &reply)
+		if err != nil {
+			log.Fatalf("commit: %v", err)
+		}
+		fmt.Println(reply.Commit)
+		return
+	}
+
+	cfg := loadWorktreeConfig(gitDir, args[0])
+	commit, err := worktrees.Commit(repo, cfg, opts)
+	if err != nil {
+		log.Fatalf("commit: %v", err)
+	}
+	fmt.Println(commit)
+
+	if !cmd.o.rebase {
+		return
+	}
+	// The upper layer is now part of the commit, so the worktree moves
+	// onto it with an empty upper layer.
+	if err := cfg.Layer().Clear(); err != nil {
+		log.Fatalf("clear upper dir: %v", err)
+	}
+	cfg.Commit = commit.String()
+	if err := cfg.Save(worktree); err != nil {
+		log.Fatalf("save worktree config: %v", err)
+	}
+}
+
+func init() {
+	commit := &commitCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "commit",
+		Short: "Record the changes in the upper layer of <worktree> as a commit on its base",
+		Run:   commit.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &commit.o.gitDir)
+	flags.StringVarP(&commit.o.message, "message", "m", "", "commit message")
+	flags.StringVarP(&commit.o.branch, "branch", "b", "", "move this branch to the new commit")
+	flags.BoolVarP(&commit.o.force, "force", "f", false, "move the branch even if it is not at the base commit")
+	flags.BoolVarP(&commit.o.rebase, "rebase", "", false, "move the worktree onto the new commit and empty its upper layer")
+}
@@ -0,0 +1,850 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"path"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/fs"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/version"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+// controlServer answers requests sent to a running mount over the unix
+// socket in its worktree admin dir.
+type controlServer struct {
+	ctx        context.Context
+	gitDir     string
+	name       string
+	mountpoint string
+	worktree   string
+	started    time.Time
+	root       fs.GitFS
+	// overlay is stacked on top of root, nil if root is served alone.
+	overlay *fs.OverlayFS
+	nodeFs  *pathfs.PathNodeFs
+
+	sock     string
+	listener net.Listener
+
+	mu      sync.Mutex
+	jobs    map[int]*prefetchJob
+	lastJob int
+}
+
+// maxFinishedJobs is how many finished prefetch jobs are kept for their
+// status to be asked for, in case nobody asks.
+const maxFinishedJobs = 16
+
+type prefetchJob struct {
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	progress fs.PrefetchProgress
+	done     bool
+	err      error
+}
+
+func (j *prefetchJob) status() PrefetchStatusReply {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	reply := PrefetchStatusReply{Progress: j.progress, Done: j.done}
+	if j.err != nil {
+		reply.Error = j.err.Error()
+	}
+	return reply
+}
+
+func startControl(ctx context.Context, gitDir, name, mountpoint, worktree string, root fs.GitFS, overlay *fs.OverlayFS, nodeFs *pathfs.PathNodeFs) (*controlServer, error) {
+	if err := os.MkdirAll(worktree, 0755); err != nil {
+		return nil, err
+	}
+	sock := getControlSocket(worktree)
+	// A socket left behind by a server that died has nobody listening.
+	if conn, err := net.Dial("unix", sock); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("%s is in use by another mount", sock)
+	}
+	os.Remove(sock)
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+	s := &controlServer{
+		ctx:        ctx,
+		gitDir:     gitDir,
+		name:       name,
+		mountpoint: mountpoint,
+		worktree:   worktree,
+		started:    time.Now(),
+		root:       root,
+		overlay:    overlay,
+		nodeFs:     nodeFs,
+		sock:       sock,
+		listener:   l,
+		jobs:       map[int]*prefetchJob{},
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("Worktree", &controlService{s}); err != nil {
+		l.Close()
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+	return s, nil
+}
+
+func (s *controlServer) Close() error {
+	err := s.listener.Close()
+	os.Remove(s.sock)
+	return err
+}
+
+// prefetch starts loading paths in the background. The run is canceled
+// when the mount goes away.
+func (s *controlServer) prefetch(paths []string, workers int) (int, *prefetchJob) {
+	ctx, cancel := context.WithCancel(s.ctx)
+	job := &prefetchJob{cancel: cancel}
+
+	s.mu.Lock()
+	s.lastJob++
+	id := s.lastJob
+	s.jobs[id] = job
+	s.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		progress, err := s.root.Prefetch(ctx, paths, fs.PrefetchOptions{
+			Workers: workers,
+			Progress: func(p fs.PrefetchProgress) {
+				job.mu.Lock()
+				job.progress = p
+				job.mu.Unlock()
+			},
+		})
+		job.mu.Lock()
+		job.progress, job.done, job.err = progress, true, err
+		job.mu.Unlock()
+		s.pruneJobs()
+		log.Infof("prefetch %d: %d/%d blobs, %d failed, %d bytes, err: %v",
+			id, progress.Done, progress.Total, progress.Failed, progress.Bytes, err)
+	}()
+	return id, job
+}
+
+// invalidate drops what the kernel remembers about paths.
+func (s *controlServer) invalidate(paths []string) {
+	for _, p := range paths {
+		dir, name := path.Split(p)
+		s.nodeFs.EntryNotify(path.Clean("/" + dir)[1:], name)
+		s.nodeFs.Notify(p)
+	}
+}
+
+// reset drops the upper layer changes to paths, or all of them if hard
+// is set, and returns the number of paths reset.
+func (s *controlServer) reset(paths []string, hard bool) (int, error) {
+	if s.overlay == nil {
+		return 0, fmt.Errorf("%s has no upper layer", s.worktree)
+	}
+	reset, err := s.overlay.Reset(paths, hard)
+	// Whatever was removed before a failure is gone, so it is
+	// invalidated either way.
+	s.invalidate(reset)
+	return len(reset), err
+}
+
+// clearLayer drops every change in layer, and returns the paths it had.
+func clearLayer(layer *upper.Layer) ([]string, error) {
+	reset, err := layer.Reset([]string{"."})
+	if err == nil {
+		err = layer.Clear()
+	}
+	return reset, err
+}
+
+// setRevision moves the mount to the tree of revision, dropping the
+// changes in the upper layer if clearUpper is set. Without it the upper
+// layer must be empty, its changes are not merged onto the new tree: that
+// is what rebase is for. With record set, the commit is saved in the
+// worktree config if there is one. Changes through the mount wait until
+// the mount has moved.
+func (s *controlServer) setRevision(revision string, clearUpper, record bool) (plumbing.Hash, error) {
+	var (
+		commit plumbing.Hash
+		moved  []string
+	)
+	move := func(layer *upper.Layer) ([]string, error) {
+		var reset []string
+		if layer != nil && clearUpper {
+			var err error
+			if reset, err = clearLayer(layer); err != nil {
+				return reset, err
+			}
+		} else if layer != nil {
+			empty, err := layer.Empty()
+			if err != nil {
+				return nil, err
+			}
+			if !empty {
+				return nil, fmt.Errorf("%s has changes in its upper layer, clear or rebase them", s.worktree)
+			}
+		}
+		var err error
+		if moved, err = s.root.SetRevision(revision); err != nil {
+			return reset, err
+		}
+		commit = s.root.Commit()
+		if !record {
+			return reset, nil
+		}
+		cfg, err := worktrees.LoadConfig(s.worktree)
+		if os.IsNotExist(err) {
+			return reset, nil
+		} else if err != nil {
+			return reset, err
+		}
+		// Like a rebase, the revision the worktree was added with stays.
+		cfg.Commit = commit.String()
+		return reset, cfg.Save(s.worktree)
+	}
+
+	var (
+		reset []string
+		err   error
+	)
+	if s.overlay == nil {
+		reset, err = move(nil)
+	} else {
+		reset, err = s.overlay.Update("reset", move)
+	}
+	s.invalidate(append(reset, moved...))
+	return commit, err
+}
+
+// commit records the changes in the upper layer as a commit on the base
+// of the worktree. With rebase set the mount then moves onto the commit
+// with an empty upper layer. Changes through the mount wait meanwhile, so
+// none is dropped without being part of the commit.
+func (s *controlServer) commit(opts worktrees.CommitOptions, rebase bool) (plumbing.Hash, error) {
+	repo, cfg, err := s.open()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	var (
+		commit plumbing.Hash
+		moved  []string
+	)
+	reset, err := s.overlay.Update("reset", func(layer *upper.Layer) ([]string, error) {
+		var err error
+		if commit, err = worktrees.Commit(repo, cfg, opts); err != nil || !rebase {
+			return nil, err
+		}
+		reset, err := clearLayer(layer)
+		if err != nil {
+			return reset, err
+		}
+		if moved, err = s.root.SetRevision(commit.String()); err != nil {
+			return reset, err
+		}
+		cfg.Commit = commit.String()
+		return reset, cfg.Save(s.worktree)
+	})
+	s.invalidate(append(reset, moved...))
+	return commit, err
+}
+
+// open returns the repository and config of a worktree with an upper
+// layer, for changing the layer from the mount.
+func (s *controlServer) open() (*gogit.Repository, *worktrees.Config, error) {
+	if s.overlay == nil {
+		return nil, nil, fmt.Errorf("%s has no upper layer", s.worktree)
+	}
+	cfg, err := worktrees.LoadConfig(s.worktree)
+	if err != nil {
+		return nil, nil, err
+	}
+	repo, err := gogit.PlainOpen(s.gitDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	return repo, cfg, nil
+}
+
+// rebase merges the changes in the upper layer onto commit and moves the
+// mount there, with the changes through the mount held off meanwhile.
+// label names the side of commit in conflicts.
+func (s *controlServer) rebase(commit plumbing.Hash, label string) ([]string, []worktrees.Conflict, error) {
+	repo, cfg, err := s.open()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var (
+		conflicts []worktrees.Conflict
+		moved     []string
+	)
+	paths, err := s.overlay.Update("rebase", func(*upper.Layer) ([]string, error) {
+		paths, c, err := worktrees.Rebase(repo, cfg, commit, label)
+		if conflicts = c; err != nil {
+			return paths, err
+		}
+		if moved, err = s.root.SetRevision(commit.String()); err != nil {
+			return paths, err
+		}
+		cfg.Commit = commit.String()
+		return paths, cfg.Save(s.worktree)
+	})
+	s.invalidate(append(paths, moved...))
+	return paths, conflicts, err
+}
+
+// apply applies patches to the upper layer, with the changes through the
+// mount held off meanwhile.
+func (s *controlServer) apply(patches []*worktrees.FilePatch) ([]string, error) {
+	repo, cfg, err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := s.overlay.Update("apply", func(*upper.Layer) ([]string, error) {
+		return cfg.Apply(repo, patches)
+	})
+	s.invalidate(paths)
+	return paths, err
+}
+
+// snapshot records the merged tree of the worktree under its snapshot ref,
+// with the changes through the mount held off while the upper layer is
+// read.
+func (s *controlServer) snapshot(message string) (plumbing.Hash, bool, error) {
+	repo, cfg, err := s.open()
+	if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	var (
+		id      plumbing.Hash
+		created bool
+	)
+	_, err = s.overlay.Update("snapshot", func(*upper.Layer) ([]string, error) {
+		var err error
+		id, created, err = worktrees.Snapshot(repo, cfg, message)
+		return nil, err
+	})
+	return id, created, err
+}
+
+// restoreSnapshot rebuilds the upper layer from the snapshot whose ID
+// starts with id and moves the mount onto its base, with the changes
+// through the mount held off meanwhile.
+func (s *controlServer) restoreSnapshot(id string) (worktrees.SnapshotInfo, []string, error) {
+	repo, cfg, err := s.open()
+	if err != nil {
+		return worktrees.SnapshotInfo{}, nil, err
+	}
+	snapshot, err := worktrees.FindSnapshot(repo, cfg.Name, id)
+	if err != nil {
+		return snapshot, nil, err
+	}
+
+	var (
+		restored []string
+		moved    []string
+	)
+	reset, err := s.overlay.Update("restore", func(layer *upper.Layer) ([]string, error) {
+		reset, err := clearLayer(layer)
+		if err != nil {
+			return reset, err
+		}
+		if moved, err = s.root.SetRevision(snapshot.Base.String()); err != nil {
+			return reset, err
+		}
+		cfg.Commit = snapshot.Base.String()
+		if err := cfg.Save(s.worktree); err != nil {
+			return reset, err
+		}
+		restored, err = worktrees.RestoreSnapshot(repo, cfg, snapshot)
+		return append(reset, restored...), err
+	})
+	s.invalidate(append(reset, moved...))
+	return snapshot, restored, err
+}
+
+// autosnapshot takes a snapshot of the worktree every interval until the
+// mount goes away. Snapshots without changes are skipped.
+func (s *controlServer) autosnapshot(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		id, created, err := s.snapshot("autosnapshot")
+		if err != nil {
+			log.Errorf("autosnapshot %s: %v", s.name, err)
+		} else if created {
+			log.Infof("autosnapshot %s: %s", s.name, id)
+		}
+	}
+}
+
+func (s *controlServer) reloadSparse() (int, error) {
+	sparse, err := fs.LoadSparse(getSparseFile(s.worktree))
+	if err != nil {
+		return 0, err
+	}
+	changed := s.root.SetSparse(sparse)
+	s.invalidate(changed)
+	return len(changed), nil
+}
+
+// pruneJobs drops the oldest finished jobs beyond maxFinishedJobs.
+func (s *controlServer) pruneJobs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var finished []int
+	for id, job := range s.jobs {
+		if job.status().Done {
+			finished = append(finished, id)
+		}
+	}
+	if len(finished) <= maxFinishedJobs {
+		return
+	}
+	sort.Ints(finished)
+	for _, id := range finished[:len(finished)-maxFinishedJobs] {
+		delete(s.jobs, id)
+	}
+}
+
+// dropJob forgets the job id once it is done and that was reported.
+func (s *controlServer) dropJob(id int) {
+	s.mu.Lock()
+	delete(s.jobs, id)
+	s.mu.Unlock()
+}
+
+func (s *controlServer) job(id int) (*prefetchJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("no prefetch job %d", id)
+	}
+	return job, nil
+}
+
+// controlService holds the methods exported over the control socket.
+type controlService struct {
+	s *controlServer
+}
+
+type PrefetchArgs struct {
+	Paths   []string
+	Workers int
+}
+
+type PrefetchReply struct {
+	ID int
+}
+
+type JobArgs struct {
+	ID int
+}
+
+type PrefetchStatusReply struct {
+	Progress fs.PrefetchProgress
+	Done     bool
+	Error    string
+}
+
+func (c *controlService) Prefetch(args *PrefetchArgs, reply *PrefetchReply) error {
+	reply.ID, _ = c.s.prefetch(args.Paths, args.Workers)
+	return nil
+}
+
+// PrefetchStatus reports how far a prefetch job got. A job that is done
+// is reported so only once.
+func (c *controlService) PrefetchStatus(args *JobArgs, reply *PrefetchStatusReply) error {
+	job, err := c.s.job(args.ID)
+	if err != nil {
+		return err
+	}
+	if *reply = job.status(); reply.Done {
+		c.s.dropJob(args.ID)
+	}
+	return nil
+}
+
+func (c *controlService) PrefetchCancel(args *JobArgs, reply *PrefetchStatusReply) error {
+	job, err := c.s.job(args.ID)
+	if err != nil {
+		return err
+	}
+	job.cancel()
+	if *reply = job.status(); reply.Done {
+		c.s.dropJob(args.ID)
+	}
+	return nil
+}
+
+type ReloadSparseReply struct {
+	Changed int
+}
+
+func (c *controlService) ReloadSparse(_ *struct{}, reply *ReloadSparseReply) (err error) {
+	reply.Changed, err = c.s.reloadSparse()
+	return err
+}
+
+type ResetArgs struct {
+	Paths []string
+	Hard  bool
+}
+
+type ResetReply struct {
+	Reset int
+}
+
+func (c *controlService) Reset(args *ResetArgs, reply *ResetReply) (err error) {
+	reply.Reset, err = c.s.reset(args.Paths, args.Hard)
+	return err
+}
+
+type SetRevisionArgs struct {
+	Revision   string
+	ClearUpper bool
+}
+
+func (c *controlService) SetRevision(args *SetRevisionArgs, _ *struct{}) error {
+	_, err := c.s.setRevision(args.Revision, args.ClearUpper, false)
+	return err
+}
+
+type CommitArgs struct {
+	Message string
+	Branch  string
+	Force   bool
+	// Author and Committer are the identity of the caller, which the
+	// mount does not share.
+	Author    *object.Signature
+	Committer *object.Signature
+	// Rebase moves the mount onto the new commit with an empty upper
+	// layer.
+	Rebase bool
+}
+
+type CommitReply struct {
+	Commit string
+}
+
+// Commit records the changes in the upper layer as a commit, without any
+// change through the mount getting in between.
+func (c *controlService) Commit(args *CommitArgs, reply *CommitReply) error {
+	commit, err := c.s.commit(worktrees.CommitOptions{
+		Message:   args.Message,
+		Branch:    args.Branch,
+		Force:     args.Force,
+		Author:    args.Author,
+		Committer: args.Committer,
+	}, args.Rebase)
+	if err != nil {
+		return err
+	}
+	reply.Commit = commit.String()
+	return nil
+}
+
+type RebaseArgs struct {
+	Commit string
+	// Label names the side of Commit in conflicts.
+	Label string
+}
+
+type RebaseReply struct {
+	Paths     []string
+	Conflicts []worktrees.Conflict
+}
+
+// Rebase merges the changes in the upper layer onto a commit and moves the
+// mount there, without any change through the mount getting in between.
+func (c *controlService) Rebase(args *RebaseArgs, reply *RebaseReply) (err error) {
+	reply.Paths, reply.Conflicts, err = c.s.rebase(plumbing.NewHash(args.Commit), args.Label)
+	return err
+}
+
+type ApplyArgs struct {
+	Patches []*worktrees.FilePatch
+}
+
+type ApplyReply struct {
+	Paths []string
+}
+
+// Apply applies patches to the upper layer, without any change through
+// the mount getting in between.
+func (c *controlService) Apply(args *ApplyArgs, reply *ApplyReply) (err error) {
+	reply.Paths, err = c.s.apply(args.Patches)
+	return err
+}
+
+type SnapshotArgs struct {
+	Message string
+}
+
+type SnapshotReply struct {
+	ID      string
+	Created bool
+}
+
+// Snapshot records the merged tree of the worktree, without any change
+// through the mount getting in between.
+func (c *controlService) Snapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+	id, created, err := c.s.snapshot(args.Message)
+	if err != nil {
+		return err
+	}
+	reply.ID, reply.Created = id.String(), created
+	return nil
+}
+
+type RestoreSnapshotArgs struct {
+	ID string
+}
+
+type RestoreSnapshotReply struct {
+	ID    string
+	Paths []string
+}
+
+// RestoreSnapshot rebuilds the upper layer from a snapshot and moves the
+// mount onto its base, without any change through the mount getting in
+// between.
+func (c *controlService) RestoreSnapshot(args *RestoreSnapshotArgs, reply *RestoreSnapshotReply) error {
+	snapshot, paths, err := c.s.restoreSnapshot(args.ID)
+	reply.ID, reply.Paths = snapshot.ID.String(), paths
+	return err
+}
+
+type ReloadArgs struct {
+	Paths []string
+}
+
+// Reload rereads the upper layer after it was changed from outside the
+// mount, and invalidates the changed paths.
+func (c *controlService) Reload(args *ReloadArgs, _ *struct{}) error {
+	if c.s.overlay == nil {
+		return fmt.Errorf("%s has no upper layer", c.s.worktree)
+	}
+	err := c.s.overlay.Reload()
+	c.s.invalidate(args.Paths)
+	return err
+}
+
+type JournalArgs struct {
+	Since uint64
+}
+
+type JournalReply struct {
+	Entries []fs.JournalEntry
+	Next    uint64
+}
+
+func (c *controlService) Journal(args *JournalArgs, reply *JournalReply) error {
+	if c.s.overlay == nil {
+		return fmt.Errorf("%s has no upper layer", c.s.worktree)
+	}
+	reply.Entries, reply.Next = c.s.overlay.Journal().Since(args.Since)
+	return nil
+}
+
+type StatusReply struct {
+	Name       string
+	Mountpoint string
+	Worktree   string
+	Commit     string
+	Upper      string
+	Pid        int
+	Started    time.Time
+	Version    string
+	LogLevel   string
+	Prefetches int
+}
+
+func (c *controlService) Status(_ *struct{}, reply *StatusReply) error {
+	s := c.s
+	*reply = StatusReply{
+		Name:       s.name,
+		Mountpoint: s.mountpoint,
+		Worktree:   s.worktree,
+		Commit:     s.root.Commit().String(),
+		Pid:        os.Getpid(),
+		Started:    s.started,
+		Version:    version.Version(),
+		LogLevel:   log.GetLevel().String(),
+	}
+	if s.overlay != nil {
+		reply.Upper = s.overlay.Layer().Dir
+	}
+	s.mu.Lock()
+	for _, job := range s.jobs {
+		if !job.status().Done {
+			reply.Prefetches++
+		}
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+type StatsReply struct {
+	fs.Stats
+	Cache fs.CacheStats `json:"cache"`
+}
+
+func (c *controlService) Stats(_ *struct{}, reply *StatsReply) (err error) {
+	reply.Stats = fs.WorktreeStats(c.s.name)
+	reply.Cache, err = c.s.root.CacheStats()
+	return err
+}
+
+type DropCachesArgs struct {
+	// Kernel also drops what the kernel caches about the tree.
+	Kernel bool
+}
+
+type DropCachesReply struct {
+	Dropped     fs.CacheStats
+	Invalidated int
+}
+
+// DropCaches empties the blob caches. The memory cache is shared by every
+// worktree of the process.
+func (c *controlService) DropCaches(args *DropCachesArgs, reply *DropCachesReply) (err error) {
+	reply.Dropped, err = c.s.root.DropCaches()
+	if args.Kernel {
+		paths := c.s.root.LoadedPaths()
+		c.s.invalidate(paths)
+		reply.Invalidated = len(paths)
+	}
+	return err
+}
+
+type SetLogLevelArgs struct {
+	Level string
+}
+
+type SetLogLevelReply struct {
+	Previous string
+}
+
+// SetLogLevel changes the log level of the process, which every worktree
+// it serves shares.
+func (c *controlService) SetLogLevel(args *SetLogLevelArgs, reply *SetLogLevelReply) error {
+	level, err := log.ParseLevel(args.Level)
+	if err != nil {
+		return err
+	}
+	reply.Previous = log.GetLevel().String()
+	logging.SetLevel(level)
+	log.Infof("log level set to %s", level)
+	return nil
+}
+
+type ProfileArgs struct {
+	// Name is a runtime/pprof profile, or cpu.
+	Name string
+	// Seconds is how long a cpu profile runs, 30 if not set.
+	Seconds int
+	// Debug selects the text formats of runtime/pprof.
+	Debug int
+}
+
+type ProfileReply struct {
+	Data []byte
+}
+
+func (c *controlService) Profile(args *ProfileArgs, reply *ProfileReply) error {
+	var b bytes.Buffer
+	if args.Name == "cpu" {
+		seconds := args.Seconds
+		if seconds <= 0 {
+			seconds = 30
+		}
+		if err := pprof.StartCPUProfile(&b); err != nil {
+			return err
+		}
+		select {
+		case <-time.After(time.Duration(seconds) * time.Second):
+		case <-c.s.ctx.Done():
+		}
+		pprof.StopCPUProfile()
+		reply.Data = b.Bytes()
+		return nil
+	}
+	p := pprof.Lookup(args.Name)
+	if p == nil {
+		return fmt.Errorf("no profile %q", args.Name)
+	}
+	if err := p.WriteTo(&b, args.Debug); err != nil {
+		return err
+	}
+	reply.Data = b.Bytes()
+	return nil
+}
+
+// Goroutines dumps the stacks of every goroutine of the process.
+func (c *controlService) Goroutines(_ *struct{}, reply *ProfileReply) error {
+	return c.Profile(&ProfileArgs{Name: "goroutine", Debug: 2}, reply)
+}
+
+type CheckoutArgs struct {
+	Revision   string
+	ClearUpper bool
+}
+
+type CheckoutReply struct {
+	Commit string
+}
+
+// Checkout switches the mount to revision and records the new base commit
+// of the worktree. Unlike SetRevision, it is meant to be called on its
+// own. Changes in the upper layer are dropped with ClearUpper, and refused
+// without it.
+func (c *controlService) Checkout(args *CheckoutArgs, reply *CheckoutReply) error {
+	commit, err := c.s.setRevision(args.Revision, args.ClearUpper, true)
+	if err == nil {
+		reply.Commit = commit.String()
+	}
+	return err
+}
+
+func dialControl(worktree string) (*rpc.Client, error) {
+	return jsonrpc.Dial("unix", getControlSocket(worktree))
+}
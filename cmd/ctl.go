@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type ctlCmd struct {
+	o struct {
+		gitDir string
+
+		output string
+	}
+}
+
+// methodName turns a method given as drop-caches into DropCaches.
+func methodName(s string) string {
+	var b strings.Builder
+	for _, part := range strings.Split(s, "-") {
+		if part != "" {
+			b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+		}
+	}
+	return b.String()
+}
+
+// ctlArgs makes the arguments of a method out of key=value pairs. Values
+// that are valid JSON are taken as such, anything else as a string.
+func ctlArgs(pairs []string) map[string]json.RawMessage {
+	args := map[string]json.RawMessage{}
+	for _, pair := range pairs {
+		i := strings.IndexByte(pair, '=')
+		if i < 0 {
+			log.Fatalf("argument %q is not key=value", pair)
+		}
+		value := json.RawMessage(pair[i+1:])
+		if !json.Valid(value) {
+			value, _ = json.Marshal(pair[i+1:])
+		}
+		args[pair[:i]] = value
+	}
+	return args
+}
+
+func (cmd *ctlCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) < 2 {
+		log.Fatalf("usage: %s ctl <worktree> <method> [<key>=<value>...]", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	client, err := dialControl(getWorktree(gitDir, args[0]))
+	if err != nil {
+		log.Fatalf("connect to %s: %v", args[0], err)
+	}
+	defer client.Close()
+
+	method := methodName(args[1])
+	var reply json.RawMessage
+	if err := client.Call("Worktree."+method, ctlArgs(args[2:]), &reply); err != nil {
+		log.Fatalf("%s: %v", args[1], err)
+	}
+
+	out := []byte(reply)
+	switch method {
+	case "Profile", "Goroutines":
+		var profile ProfileReply
+		if err := json.Unmarshal(reply, &profile); err != nil {
+			log.Fatalf("%s: %v", args[1], err)
+		}
+		out = profile.Data
+	default:
+		var b bytes.Buffer
+		if err := json.Indent(&b, reply, "", "  "); err == nil {
+			b.WriteByte('\n')
+			out = b.Bytes()
+		}
+	}
+	if cmd.o.output != "" {
+		if err := ioutil.WriteFile(cmd.o.output, out, 0644); err != nil {
+			log.Fatalf("write %s: %v", cmd.o.output, err)
+		}
+		return
+	}
+	os.Stdout.Write(out)
+}
+
+func init() {
+	ctl := &ctlCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "ctl",
+		Short: "Call <method> on the control socket of a mounted <worktree>",
+		Long: `Call <method> on the control socket of a mounted <worktree>, with the
+arguments given as key=value pairs, and print the reply. Methods include:
+
+  status                              what is mounted and by which process
+  stats                               operation counts and cache usage
+  drop-caches [kernel=true]           empty the blob caches
+  set-log-level level=<level>         change the log level of the process
+  goroutines                          dump the stacks of every goroutine
+  profile name=<profile> [seconds=N]  write a pprof profile, cpu or heap...
+  checkout revision=<rev> [clearUpper=true]
+                                      switch the worktree to another revision,
+                                      refused over upper layer changes unless
+                                      they are cleared`,
+		Run: ctl.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &ctl.o.gitDir)
+	flags.StringVarP(&ctl.o.output, "output", "o", "", "write the reply to this file")
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/fs"
+)
+
+type daemonCmd struct {
+	o struct {
+		logLevel  string
+		logFormat string
+		gitDir    string
+		metrics   string
+
+		supervise         bool
+		superviseInterval time.Duration
+
+		cacheSize   uint64
+		objectStore string
+	}
+}
+
+// daemon serves every worktree of one repository from a single process,
+// sharing the repository objects and the blob content cache.
+type daemon struct {
+	gitDir string
+	repo   *fs.Repository
+	// objectStore and cacheSize, in MiB, are what repo was opened with.
+	objectStore string
+	cacheSize   uint64
+
+	mu     sync.Mutex
+	mounts map[string]*mountedWorktree
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// check fails if args ask for an object store or cache size other than
+// the ones of the repository the daemon serves every worktree from. Zero
+// values ask for nothing.
+func (d *daemon) check(args *MountArgs) error {
+	if args.ObjectStore != "" && storeName(args.ObjectStore) != d.objectStore {
+		return fmt.Errorf("daemon reads objects with %s, not %s", d.objectStore, args.ObjectStore)
+	}
+	if args.CacheSize != 0 && args.CacheSize != d.cacheSize {
+		return fmt.Errorf("daemon has a cache of %d MiB, not %d MiB", d.cacheSize, args.CacheSize)
+	}
+	return nil
+}
+
+// storeName returns the object store backend named by name, the default
+// one if empty.
+func storeName(name string) string {
+	if name == "" {
+		return fs.StoreGoGit
+	}
+	return name
+}
+
+func (d *daemon) mount(args *MountArgs) error {
+	if filepath.Clean(args.GitDir) != d.gitDir {
+		return fmt.Errorf("daemon serves %s, not %s", d.gitDir, args.GitDir)
+	}
+	if err := d.check(args); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.mounts[args.Name]; ok {
+		return fmt.Errorf("%s is already mounted", args.Name)
+	}
+	m, err := mountWorktree(d.repo, args)
+	if err != nil {
+		return err
+	}
+	d.mounts[args.Name] = m
+	go m.serve()
+	go func() {
+		<-m.done
+		log.Infof("%s unmounted", m.name)
+		d.mu.Lock()
+		if d.mounts[m.name] == m {
+			delete(d.mounts, m.name)
+		}
+		d.mu.Unlock()
+	}()
+	if err := m.server.WaitMount(); err != nil {
+		return err
+	}
+	log.Infof("%s mounted at %s", m.name, m.mountpoint)
+	return nil
+}
+
+func (d *daemon) unmount(name string) error {
+	d.mu.Lock()
+	m, ok := d.mounts[name]
+	d.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%s is not mounted by the daemon", name)
+	}
+	return m.unmount()
+}
+
+func (d *daemon) unmountAll() {
+	d.mu.Lock()
+	var names []string
+	for name := range d.mounts {
+		names = append(names, name)
+	}
+	d.mu.Unlock()
+	for _, name := range names {
+		if err := d.unmount(name); err != nil {
+			log.Errorf("unmount %s: %v", name, err)
+		}
+	}
+}
+
+// daemonService holds the methods exported over the daemon socket.
+type daemonService struct {
+	d *daemon
+}
+
+type UnmountArgs struct {
+	Name string
+}
+
+type MountInfo struct {
+	Name       string
+	Mountpoint string
+	Revision   string
+}
+
+type ListReply struct {
+	Worktrees []MountInfo
+}
+
+func (s *daemonService) Mount(args *MountArgs, _ *struct{}) error {
+	return s.d.mount(args)
+}
+
+func (s *daemonService) Unmount(args *UnmountArgs, _ *struct{}) error {
+	return s.d.unmount(args.Name)
+}
+
+func (s *daemonService) List(_ *struct{}, reply *ListReply) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+	for _, m := range s.d.mounts {
+		reply.Worktrees = append(reply.Worktrees, MountInfo{
+			Name:       m.name,
+			Mountpoint: m.mountpoint,
+			Revision:   m.revision,
+		})
+	}
+	sort.Slice(reply.Worktrees, func(i, j int) bool { return reply.Worktrees[i].Name < reply.Worktrees[j].Name })
+	return nil
+}
+
+func (s *daemonService) Stop(_ *struct{}, _ *struct{}) error {
+	s.d.stopOnce.Do(func() { close(s.d.stop) })
+	return nil
+}
+
+func getDaemonSocket(gitDir string) string {
+	return filepath.Join(gitDir, "worktrees", "daemon.sock")
+}
+
+// daemonOptions are what a daemon is started with. Zero values leave the
+// defaults of the daemon.
+type daemonOptions struct {
+	logLevel    string
+	objectStore string
+	cacheSize   uint64
+}
+
+func (o *daemonOptions) args(gitDir string) []string {
+	args := []string{"daemon", "-C", gitDir}
+	if o.logLevel != "" {
+		args = append(args, "--log-level", o.logLevel)
+	}
+	if o.objectStore != "" {
+		args = append(args, "--object-store", o.objectStore)
+	}
+	if o.cacheSize != 0 {
+		args = append(args, "--cache-size", strconv.FormatUint(o.cacheSize, 10))
+	}
+	return args
+}
+
+// dialDaemon connects to the daemon of the repository at gitDir. If start
+// is set and no daemon is running, one is started in the background with
+// it.
+func dialDaemon(gitDir string, start *daemonOptions) (*rpc.Client, error) {
+	sock := getDaemonSocket(gitDir)
+	client, err := jsonrpc.Dial("unix", sock)
+	if err == nil || start == nil {
+		return client, err
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(sock), 0755); err != nil {
+		return nil, err
+	}
+	logFile, err := os.OpenFile(filepath.Join(gitDir, "worktrees", "daemon.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	c := exec.Command(exe, start.args(gitDir)...)
+	c.Stdout, c.Stderr = logFile, logFile
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := c.Start(); err != nil {
+		return nil, err
+	}
+	c.Process.Release()
+
+	for i := 0; i < 50; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if client, err = jsonrpc.Dial("unix", sock); err == nil {
+			return client, nil
+		}
+	}
+	return nil, err
+}
+
+func (cmd *daemonCmd) Run(_ *cobra.Command, args []string) {
+	logLevel, err := log.ParseLevel(cmd.o.logLevel)
+	if err != nil {
+		logLevel = log.InfoLevel
+	}
+	log.SetLevel(logLevel)
+	setLogFormat(cmd.o.logFormat)
+
+	gitDir := filepath.Clean(getGitDir(cmd.o.gitDir))
+	if cmd.o.cacheSize == 0 {
+		cmd.o.cacheSize = fs.DefaultCacheSize >> 20
+	}
+	repo, err := fs.OpenRepository(gitDir, cmd.o.objectStore, cmd.o.cacheSize<<20)
+	if err != nil {
+		log.Fatalf("OpenRepository: %v", err)
+	}
+	defer repo.Close()
+	d := &daemon{
+		gitDir:      gitDir,
+		repo:        repo,
+		objectStore: storeName(cmd.o.objectStore),
+		cacheSize:   cmd.o.cacheSize,
+		mounts:      map[string]*mountedWorktree{},
+		stop:        make(chan struct{}),
+	}
+
+	sock := getDaemonSocket(gitDir)
+	if conn, err := net.Dial("unix", sock); err == nil {
+		conn.Close()
+		log.Fatalf("a daemon is already listening on %s", sock)
+	}
+	os.Remove(sock)
+	if err := os.MkdirAll(filepath.Dir(sock), 0755); err != nil {
+		log.Fatalf("create %s: %v", filepath.Dir(sock), err)
+	}
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		log.Fatalf("listen %s: %v", sock, err)
+	}
+	defer os.Remove(sock)
+	defer l.Close()
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("Daemon", &daemonService{d}); err != nil {
+		log.Fatalf("register: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+	log.Infof("daemon for %s listening on %s", gitDir, sock)
+	defer startMetrics(cmd.o.metrics)()
+
+	if cmd.o.supervise {
+		s, closeLog, err := newSupervisor(d)
+		if err != nil {
+			log.Fatalf("supervise: %v", err)
+		}
+		defer closeLog()
+		go s.run(cmd.o.superviseInterval)
+		log.Infof("supervising the worktrees of %s, events in %s", gitDir, getSuperviseLog(gitDir))
+	}
+
+	signal.Ignore(syscall.SIGPIPE)
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	select {
+	case <-signalChan:
+	case <-d.stop:
+	}
+	d.stopOnce.Do(func() { close(d.stop) })
+	d.unmountAll()
+}
+
+func (cmd *daemonCmd) List(_ *cobra.Command, args []string) {
+	client, err := dialDaemon(getGitDir(cmd.o.gitDir), nil)
+	if err != nil {
+		log.Fatalf("connect to daemon: %v", err)
+	}
+	defer client.Close()
+	var reply ListReply
+	if err := client.Call("Daemon.List", &struct{}{}, &reply); err != nil {
+		log.Fatalf("list: %v", err)
+	}
+	for _, wt := range reply.Worktrees {
+		fmt.Printf("%s\t%s\t%s\n", wt.Name, wt.Mountpoint, wt.Revision)
+	}
+}
+
+func (cmd *daemonCmd) Stop(_ *cobra.Command, args []string) {
+	client, err := dialDaemon(getGitDir(cmd.o.gitDir), nil)
+	if err != nil {
+		log.Fatalf("connect to daemon: %v", err)
+	}
+	defer client.Close()
+	if err := client.Call("Daemon.Stop", &struct{}{}, &struct{}{}); err != nil {
+		log.Fatalf("stop: %v", err)
+	}
+}
+
+func init() {
+	d := &daemonCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "daemon",
+		Short: "Serve every worktree of a repository from one process",
+		Run:   d.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.PersistentFlags()
+	bindGitDir(flags, &d.o.gitDir)
+	cmd.Flags().StringVarP(&d.o.logLevel, "log-level", "", "info", "log level")
+	bindLogFormat(cmd.Flags(), &d.o.logFormat)
+	bindObjectStore(cmd.Flags(), &d.o.objectStore)
+	bindMetrics(cmd.Flags(), &d.o.metrics)
+	cmd.Flags().BoolVarP(&d.o.supervise, "supervise", "", false, "mount again the worktrees of the repository whose server died")
+	cmd.Flags().DurationVarP(&d.o.superviseInterval, "supervise-interval", "", 5*time.Second, "how often to check the worktrees with --supervise")
+	cmd.Flags().Uint64VarP(&d.o.cacheSize, "cache-size", "", fs.DefaultCacheSize>>20, "blob content cache size in MiB, shared by all worktrees")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the worktrees served by the daemon",
+		Run:   d.List,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "stop",
+		Short: "Unmount every worktree and stop the daemon",
+		Run:   d.Stop,
+	})
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"os"
+
+	gogit "github.com/go-git/go-git/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type diffCmd struct {
+	o struct {
+		gitDir string
+	}
+}
+
+func (cmd *diffCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: %s diff <worktree>", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	cfg := loadWorktreeConfig(gitDir, args[0])
+
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		log.Fatalf("open %s: %v", gitDir, err)
+	}
+	w := bufio.NewWriter(os.Stdout)
+	if err := cfg.Diff(context.Background(), repo, w); err != nil {
+		log.Fatalf("diff %s: %v", args[0], err)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalf("diff %s: %v", args[0], err)
+	}
+}
+
+func init() {
+	diff := &diffCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Print the changes in the upper layer of <worktree> as a git diff against its base commit",
+		Run:   diff.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &diff.o.gitDir)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/oci"
+)
+
+type exportOCICmd struct {
+	o struct {
+		gitDir string
+
+		ref  string
+		time int64
+		os   string
+		arch string
+	}
+}
+
+func (cmd *exportOCICmd) Run(_ *cobra.Command, args []string) {
+	if len(args) != 2 {
+		log.Fatalf("usage: %s export-oci <worktree> <dir>", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	cfg := loadWorktreeConfig(gitDir, args[0])
+
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		log.Fatalf("open %s: %v", gitDir, err)
+	}
+	layout, err := oci.OpenLayout(args[1])
+	if err != nil {
+		log.Fatalf("open %s: %v", args[1], err)
+	}
+
+	opts := oci.Options{Ref: cmd.o.ref, OS: cmd.o.os, Architecture: cmd.o.arch}
+	if opts.Ref == "" {
+		opts.Ref = args[0]
+	}
+	// SOURCE_DATE_EPOCH is what reproducible builds set to pin timestamps.
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" && cmd.o.time == 0 {
+		if cmd.o.time, err = strconv.ParseInt(epoch, 10, 64); err != nil {
+			log.Fatalf("SOURCE_DATE_EPOCH: %v", err)
+		}
+	}
+	if cmd.o.time != 0 {
+		opts.Time = time.Unix(cmd.o.time, 0)
+	}
+
+	desc, err := oci.Export(repo, cfg, layout, opts)
+	if err != nil {
+		log.Fatalf("export %s: %v", args[0], err)
+	}
+	fmt.Printf("%s %s\n", opts.Ref, desc.Digest)
+}
+
+func init() {
+	export := &exportOCICmd{}
+
+	cmd := &cobra.Command{
+		Use:   "export-oci",
+		Short: "Write the tree and upper layer changes of <worktree> as an image to the OCI layout <dir>",
+		Run:   export.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &export.o.gitDir)
+	flags.StringVarP(&export.o.ref, "ref", "", "", "name of the image in the layout, the worktree name if empty")
+	flags.Int64VarP(&export.o.time, "timestamp", "", 0, "unix time of the files and the image, the base commit time if 0 and SOURCE_DATE_EPOCH is unset")
+	flags.StringVarP(&export.o.os, "os", "", "", "os of the image, the current one if empty")
+	flags.StringVarP(&export.o.arch, "arch", "", "", "architecture of the image, the current one if empty")
+}
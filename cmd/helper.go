@@ -4,9 +4,17 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"syscall"
+	"time"
 
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/fs"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/mountinfo"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
 )
 
 func getMountpoint(gitdir, worktree string) string {
@@ -17,10 +25,43 @@ func getWorktree(gitdir, worktree string) string {
 	return fmt.Sprintf("%s/worktrees/%s", gitdir, worktree)
 }
 
+func getUpperDir(gitdir, worktree string) string {
+	return fmt.Sprintf("%s/%s-upper", gitdir, worktree)
+}
+
+// fuseMountOptions returns the options of the mount of the worktree name,
+// which is recognized in the mount table by its source and subtype. Root
+// mounts directly, so fusermount is only needed by other users.
+func fuseMountOptions(gitDir, name string, debug bool) *fuse.MountOptions {
+	return &fuse.MountOptions{
+		FsName:           mountinfo.FsName(gitDir, name),
+		Name:             mountinfo.Subtype,
+		Debug:            debug,
+		DirectMount:      os.Geteuid() == 0,
+		DirectMountFlags: syscall.MS_NOSUID | syscall.MS_NODEV,
+	}
+}
+
+// mount mounts root at mp like nodefs.Mount, with the reads interrupted by
+// the kernel handed down to the files read through interrupts.
+func mount(mp string, root nodefs.Node, interrupts *fs.Interrupts, mountOpts *fuse.MountOptions, nodeOpts *nodefs.Options) (*fuse.Server, error) {
+	conn := nodefs.NewFileSystemConnector(root, nodeOpts)
+	return fuse.NewServer(interrupts.Wrap(conn.RawFS()), mp, mountOpts)
+}
+
 func bindGitDir(flags *pflag.FlagSet, gitdir *string) {
 	flags.StringVarP(gitdir, "git-dir", "C", "", "git dir")
 }
 
+func bindObjectStore(flags *pflag.FlagSet, backend *string) {
+	flags.StringVarP(backend, "object-store", "", fs.StoreGoGit, fmt.Sprintf("object store backend, %s or %s", fs.StoreGoGit, fs.StoreCatFile))
+}
+
+func bindWatchdog(flags *pflag.FlagSet, opts *fs.WatchdogOptions) {
+	flags.DurationVarP(&opts.Threshold, "watchdog", "", 30*time.Second, "report the operations running longer than this with a goroutine dump, 0 to disable")
+	flags.StringVarP(&opts.Policy, "watchdog-policy", "", fs.WatchdogLog, fmt.Sprintf("what happens to hung operations: %s only reports them, %s and %s fail them, at the cost of a goroutine per operation", fs.WatchdogLog, fs.WatchdogEIO, fs.WatchdogEINTR))
+}
+
 func getGitDir(gitDir string) string {
 	if gitDir != "" && !filepath.IsAbs(gitDir) {
 		gitDir = filepath.Join(os.Getenv("PWD"), gitDir)
@@ -30,3 +71,40 @@ func getGitDir(gitDir string) string {
 	}
 	return gitDir
 }
+
+func getControlSocket(worktree string) string {
+	return filepath.Join(worktree, "control.sock")
+}
+
+// getMountArgsFile returns where the args of a mounted worktree are kept
+// until it is unmounted.
+func getMountArgsFile(worktree string) string {
+	return filepath.Join(worktree, "mount.json")
+}
+
+// getLogFile returns the default log file of the operations on a
+// worktree.
+func getLogFile(worktree string) string {
+	return filepath.Join(worktree, "fs.log")
+}
+
+func getSparseFile(worktree string) string {
+	return filepath.Join(worktree, "info", "sparse-checkout")
+}
+
+func loadWorktreeConfig(gitDir, name string) *worktrees.Config {
+	cfg, err := worktrees.LoadConfig(getWorktree(gitDir, name))
+	if err != nil {
+		log.Fatalf("worktree %s: %v", name, err)
+	}
+	return cfg
+}
+
+func readPathList(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return fs.ReadPathList(f)
+}
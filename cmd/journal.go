@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/fs"
+)
+
+type journalCmd struct {
+	o struct {
+		gitDir string
+
+		since  uint64
+		follow bool
+		json   bool
+	}
+}
+
+func (cmd *journalCmd) print(e fs.JournalEntry) {
+	if cmd.o.json {
+		data, _ := json.Marshal(e)
+		fmt.Println(string(data))
+		return
+	}
+	fmt.Printf("%d %s %s %s", e.Seq, e.Time.Format(time.RFC3339Nano), e.Op, e.Path)
+	if e.NewPath != "" {
+		fmt.Printf(" -> %s", e.NewPath)
+	}
+	fmt.Println()
+}
+
+func (cmd *journalCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s journal <worktree>", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	client, err := dialControl(getWorktree(gitDir, args[0]))
+	if err != nil {
+		log.Fatalf("connect to %s: %v", args[0], err)
+	}
+	defer client.Close()
+
+	since := cmd.o.since
+	for {
+		var reply JournalReply
+		if err := client.Call("Worktree.Journal", &JournalArgs{Since: since}, &reply); err != nil {
+			log.Fatalf("journal: %v", err)
+		}
+		if len(reply.Entries) > 0 && reply.Entries[0].Seq > since && since > 0 {
+			log.Warnf("journal entries %d to %d were dropped", since, reply.Entries[0].Seq-1)
+		}
+		for _, e := range reply.Entries {
+			cmd.print(e)
+		}
+		since = reply.Next
+		if !cmd.o.follow {
+			return
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+func init() {
+	journal := &journalCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "journal",
+		Short: "Show the changes made through a mounted <worktree>",
+		Run:   journal.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &journal.o.gitDir)
+	flags.Uint64VarP(&journal.o.since, "since", "", 0, "show the changes from this sequence number on")
+	flags.BoolVarP(&journal.o.follow, "follow", "f", false, "keep printing changes as they are made")
+	flags.BoolVarP(&journal.o.json, "json", "", false, "print every change as a JSON object")
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/mountinfo"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+type listCmd struct {
+	o struct {
+		gitDir string
+		json   bool
+	}
+}
+
+// listEntry is a worktree as printed by list --json.
+type listEntry struct {
+	worktrees.Config
+	Mounted bool `json:"mounted"`
+	// Stale is set for a mount whose server is gone.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// listWorktrees returns the worktrees with a config in the admin dir of
+// gitDir.
+func listWorktrees(gitDir string) ([]*worktrees.Config, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(gitDir, "worktrees"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []*worktrees.Config
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		cfg, err := worktrees.LoadConfig(getWorktree(gitDir, fi.Name()))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("worktree %s: %v", fi.Name(), err)
+		}
+		cfgs = append(cfgs, cfg)
+	}
+	return cfgs, nil
+}
+
+func (cmd *listCmd) Run(_ *cobra.Command, args []string) {
+	gitDir := getGitDir(cmd.o.gitDir)
+	cfgs, err := listWorktrees(gitDir)
+	if err != nil {
+		log.Fatalf("list: %v", err)
+	}
+
+	entries := make([]listEntry, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		e := listEntry{Config: *cfg}
+		if client, err := dialControl(getWorktree(gitDir, cfg.Name)); err == nil {
+			client.Close()
+			e.Mounted = true
+		} else if mp := getMountpoint(gitDir, cfg.Name); mountinfo.Stale(mp) {
+			// Only a stale mount of the worktree itself counts.
+			m, err := worktreeMount(mp, gitDir, cfg.Name)
+			e.Stale = err == nil && m != nil
+		}
+		entries = append(entries, e)
+	}
+
+	if cmd.o.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			log.Fatalf("encode: %v", err)
+		}
+		return
+	}
+	for _, e := range entries {
+		state := "unmounted"
+		switch {
+		case e.Mounted:
+			state = "mounted"
+		case e.Stale:
+			state = "stale"
+		}
+		upper := e.Upper
+		if e.Ephemeral {
+			upper += " (ephemeral)"
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n", e.Name, e.Commit[:7], e.Revision, state, upper)
+	}
+}
+
+func init() {
+	list := &listCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "List the worktrees of the repository and where their upper dirs are",
+		Run:   list.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &list.o.gitDir)
+	flags.BoolVarP(&list.o.json, "json", "", false, "give the output as JSON")
+}
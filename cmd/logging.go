@@ -0,0 +1,54 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
+)
+
+// logFlags say where the operations on a worktree are logged.
+type logFlags struct {
+	format  string
+	file    string
+	maxSize int64
+	backups int
+	slowOp  time.Duration
+}
+
+func bindLogFormat(flags *pflag.FlagSet, format *string) {
+	flags.StringVarP(format, "log-format", "", logging.FormatText, "format of the log lines, text or json")
+}
+
+func bindLogging(flags *pflag.FlagSet, l *logFlags) {
+	bindLogFormat(flags, &l.format)
+	flags.StringVarP(&l.file, "log-file", "", "", "log the operations on the worktree to this file instead of <git-dir>/worktrees/<worktree>/fs.log, - to log them with the process")
+	flags.Int64VarP(&l.maxSize, "log-max-size", "", logging.DefaultMaxSize>>20, "rotate the log file of the worktree past this many MiB")
+	flags.IntVarP(&l.backups, "log-backups", "", 3, "number of rotated log files kept")
+	flags.DurationVarP(&l.slowOp, "slow-op", "", time.Second, "log the operations slower than this as warnings, 0 to disable")
+}
+
+func setLogFormat(format string) {
+	if err := logging.SetFormat(format); err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+// openWorktreeLog opens the log of the worktree mounted with args.
+func openWorktreeLog(worktree string, args *MountArgs) (*logging.Logger, error) {
+	file := args.LogFile
+	switch file {
+	case "":
+		file = getLogFile(worktree)
+	case "-":
+		file = ""
+	}
+	return logging.Open(args.Name, logging.Options{
+		Format:  args.LogFormat,
+		File:    file,
+		MaxSize: args.LogMaxSize << 20,
+		Backups: args.LogBackups,
+	})
+}
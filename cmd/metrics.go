@@ -0,0 +1,27 @@
+package main
+
+import (
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/metrics"
+)
+
+func bindMetrics(flags *pflag.FlagSet, addr *string) {
+	flags.StringVarP(addr, "metrics", "", "", "serve Prometheus metrics at /metrics on this unix socket or localhost address")
+}
+
+// startMetrics serves the metrics of this process on addr, if set. The
+// returned func stops serving them.
+func startMetrics(addr string) func() {
+	if addr == "" {
+		return func() {}
+	}
+	l, err := metrics.Listen(addr)
+	if err != nil {
+		log.Fatalf("metrics: %v", err)
+	}
+	go metrics.Serve(l)
+	log.Infof("serving metrics on %s", l.Addr())
+	return func() { l.Close() }
+}
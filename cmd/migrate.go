@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+// migrateUpper turns the unionfs deletion markers of an upper dir written
+// by an older version into whiteouts, and records that in its config.
+func migrateUpper(cfg *worktrees.Config, worktree string) error {
+	layer := cfg.Layer()
+	if !layer.NeedsMigration(cfg.DeletionDirName) {
+		return nil
+	}
+	n, err := layer.Migrate(cfg.DeletionDirName)
+	if err != nil {
+		return err
+	}
+	log.Infof("migrated %d deletions of %s to whiteouts", n, cfg.Upper)
+	cfg.DeletionDirName = ""
+	return cfg.Save(worktree)
+}
+
+type migrateUpperCmd struct {
+	o struct {
+		gitDir string
+	}
+}
+
+func (cmd *migrateUpperCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: %s migrate-upper <worktree>", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	worktree := getWorktree(gitDir, args[0])
+	if client, err := dialControl(worktree); err == nil {
+		client.Close()
+		log.Fatalf("%s is mounted, it is migrated when mounting", args[0])
+	}
+
+	cfg := loadWorktreeConfig(gitDir, args[0])
+	if !cfg.Layer().NeedsMigration(cfg.DeletionDirName) {
+		fmt.Printf("%s needs no migration\n", cfg.Upper)
+		return
+	}
+	if err := migrateUpper(cfg, worktree); err != nil {
+		log.Fatalf("migrate %s: %v", cfg.Upper, err)
+	}
+	fmt.Printf("migrated %s\n", cfg.Upper)
+}
+
+func init() {
+	migrate := &migrateUpperCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "migrate-upper",
+		Short: "Convert the unionfs deletion markers in the upper dir of <worktree> to overlayfs whiteouts",
+		Run:   migrate.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &migrate.o.gitDir)
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -20,14 +21,23 @@ import (
 
 type gitfsCmd struct {
 	o struct {
-		debug    bool
-		logLevel string
+		debug     bool
+		logLevel  string
+		logFormat string
+		slowOp    time.Duration
+		watchdog  fs.WatchdogOptions
 
-		gitDir string
+		gitDir  string
+		metrics string
 
-		lazy    bool
-		disk    bool
-		tempDir string
+		lazy        bool
+		disk        bool
+		tempDir     string
+		cacheSize   uint64
+		objectStore string
+
+		prefetch        string
+		prefetchWorkers int
 
 		portable        bool
 		entryTtl        float64
@@ -48,6 +58,10 @@ func (cmd *gitfsCmd) getLogLevel() (logLevel log.Level) {
 
 func (cmd *gitfsCmd) Run(_ *cobra.Command, args []string) {
 	log.SetLevel(cmd.getLogLevel())
+	setLogFormat(cmd.o.logFormat)
+	if err := fs.CheckWatchdogPolicy(cmd.o.watchdog.Policy); err != nil {
+		log.Fatalf("%v", err)
+	}
 	if len(args) < 2 {
 		log.Fatalf("usage: %s MOUNT", os.Args[0])
 	}
@@ -57,7 +71,9 @@ func (cmd *gitfsCmd) Run(_ *cobra.Command, args []string) {
 	mp := args[0]
 	worktree := fmt.Sprintf("%s/worktrees/%s", cmd.o.gitDir, args[0])
 
-	doCheckAndUnmount(mp)
+	if err := prepareMountpoint(mp, cmd.o.gitDir, args[0]); err != nil {
+		log.Fatalf("mountpoint: %v", err)
+	}
 
 	tempDir, err := ioutil.TempDir("", cmd.o.tempDir)
 	if err != nil {
@@ -65,9 +81,12 @@ func (cmd *gitfsCmd) Run(_ *cobra.Command, args []string) {
 	}
 
 	opts := &fs.GitFSOptions{
-		Lazy:    cmd.o.lazy,
-		Disk:    cmd.o.disk,
-		TempDir: tempDir,
+		Lazy:        cmd.o.lazy,
+		Disk:        cmd.o.disk,
+		TempDir:     tempDir,
+		CacheSize:   cmd.o.cacheSize << 20,
+		SparseFile:  getSparseFile(worktree),
+		ObjectStore: cmd.o.objectStore,
 	}
 
 	root, err := fs.NewTreeFSRoot(cmd.o.gitDir, revision, worktree, opts)
@@ -75,7 +94,14 @@ func (cmd *gitfsCmd) Run(_ *cobra.Command, args []string) {
 		log.Fatalf("NewTreeFSRoot: %v", err)
 	}
 
-	nodeFs := pathfs.NewPathNodeFs(root, &pathfs.PathNodeFsOptions{ClientInodes: true})
+	interrupts := fs.NewInterrupts()
+	nodeFs := pathfs.NewPathNodeFs(fs.NewInstrumentedFS(root, fs.InstrumentOptions{
+		Worktree:   args[0],
+		SlowOp:     cmd.o.slowOp,
+		Lower:      root,
+		Watchdog:   cmd.o.watchdog,
+		Interrupts: interrupts,
+	}), &pathfs.PathNodeFsOptions{ClientInodes: true})
 	mOpts := nodefs.Options{
 		EntryTimeout:    time.Duration(cmd.o.entryTtl * float64(time.Second)),
 		AttrTimeout:     time.Duration(cmd.o.entryTtl * float64(time.Second)),
@@ -103,11 +129,29 @@ func (cmd *gitfsCmd) Run(_ *cobra.Command, args []string) {
 		}
 	}()
 
-	mountState, _, err := nodefs.MountRoot(mp, nodeFs.Root(), &mOpts)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctl, err := startControl(ctx, cmd.o.gitDir, args[0], mp, worktree, root, nil, nodeFs)
+	if err != nil {
+		log.Fatalf("control socket: %v", err)
+	}
+	defer ctl.Close()
+
+	mountState, err := mount(mp, nodeFs.Root(), interrupts, fuseMountOptions(cmd.o.gitDir, args[0], cmd.o.debug), &mOpts)
 	if err != nil {
 		log.Fatal("Mount fail:", err)
 	}
 
+	if cmd.o.prefetch != "" {
+		paths, err := readPathList(cmd.o.prefetch)
+		if err != nil {
+			log.Errorf("read prefetch list %s: %v", cmd.o.prefetch, err)
+		} else {
+			ctl.prefetch(paths, cmd.o.prefetchWorkers)
+		}
+	}
+
+	defer startMetrics(cmd.o.metrics)()
 	mountState.Serve()
 }
 
@@ -124,16 +168,27 @@ func init() {
 	flags := cmd.Flags()
 	flags.BoolVarP(&gitfs.o.debug, "debug", "d", false, "debug")
 	flags.StringVarP(&gitfs.o.logLevel, "log-level", "", "info", "log level")
+	bindLogFormat(flags, &gitfs.o.logFormat)
+	bindWatchdog(flags, &gitfs.o.watchdog)
+	flags.DurationVarP(&gitfs.o.slowOp, "slow-op", "", time.Second, "log the operations slower than this as warnings, 0 to disable")
 	flags.StringVarP(&gitfs.o.gitDir, "git-dir", "", "", "git dir")
+	bindMetrics(flags, &gitfs.o.metrics)
 
 	flags.BoolVarP(&gitfs.o.lazy, "lazy", "", true, "only read contents for reads")
 	flags.BoolVarP(&gitfs.o.disk, "disk", "", false, "don't use intermediate files")
 	flags.StringVarP(&gitfs.o.tempDir, "tempdir", "", "gitfs", "tempdir name")
+	flags.Uint64VarP(&gitfs.o.cacheSize, "cache-size", "", fs.DefaultCacheSize>>20, "blob content cache size in MiB")
+	bindObjectStore(flags, &gitfs.o.objectStore)
+	flags.StringVarP(&gitfs.o.prefetch, "prefetch", "", "", "prefetch the paths listed in this file after mounting")
+	flags.IntVarP(&gitfs.o.prefetchWorkers, "prefetch-workers", "", fs.DefaultPrefetchWorkers, "number of blobs prefetched in parallel")
 
 	flags.BoolVarP(&gitfs.o.portable, "portable", "", false, "use 32 bit inodes")
 	flags.Float64VarP(&gitfs.o.entryTtl, "entry-ttl", "", 1.0, "fuse entry cache TTL.")
 	flags.Float64VarP(&gitfs.o.negativeTtl, "negative-ttl", "", 1.0, "fuse negative entry cache TTL.")
 	flags.Float64VarP(&gitfs.o.delcacheTtl, "delcache-cache-ttl", "", 5.0, "Deletion cache TTL in seconds.")
 	flags.Float64VarP(&gitfs.o.branchcacheTtl, "branchcache-ttl", "", 5.0, "Branch cache TTL in seconds.")
+	flags.MarkDeprecated("delcache-cache-ttl", "deletions are tracked exactly, there is no cache to expire")
+	flags.MarkDeprecated("branchcache-ttl", "the upper dir is looked up directly, there is no cache to expire")
 	flags.StringVarP(&gitfs.o.deletionDirname, "deletion-dirname", "", "GOUNIONFS_DELETIONS", "Directory name to use for deletions.")
+	flags.MarkDeprecated("deletion-dirname", "the tree is served without an upper layer")
 }
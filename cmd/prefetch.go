@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type prefetchCmd struct {
+	o struct {
+		gitDir string
+
+		profile string
+		workers int
+		detach  bool
+	}
+}
+
+func (cmd *prefetchCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s prefetch <worktree> [<pathspec>...]", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	worktree := getWorktree(gitDir, args[0])
+
+	paths := args[1:]
+	if cmd.o.profile != "" {
+		profile, err := readPathList(cmd.o.profile)
+		if err != nil {
+			log.Fatalf("read profile %s: %v", cmd.o.profile, err)
+		}
+		paths = append(paths, profile...)
+	}
+	if len(paths) == 0 {
+		log.Fatalf("nothing to prefetch")
+	}
+
+	client, err := dialControl(worktree)
+	if err != nil {
+		log.Fatalf("connect to %s: %v", args[0], err)
+	}
+	defer client.Close()
+
+	var job PrefetchReply
+	if err := client.Call("Worktree.Prefetch", &PrefetchArgs{Paths: paths, Workers: cmd.o.workers}, &job); err != nil {
+		log.Fatalf("prefetch: %v", err)
+	}
+	if cmd.o.detach {
+		fmt.Printf("prefetch job %d started\n", job.ID)
+		return
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGTERM, syscall.SIGINT)
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		method := "Worktree.PrefetchStatus"
+		select {
+		case <-signalChan:
+			method = "Worktree.PrefetchCancel"
+		case <-ticker.C:
+		}
+		var status PrefetchStatusReply
+		if err := client.Call(method, &JobArgs{ID: job.ID}, &status); err != nil {
+			log.Fatalf("prefetch status: %v", err)
+		}
+		p := status.Progress
+		fmt.Fprintf(os.Stderr, "\rprefetch: %d/%d blobs, %d failed, %d bytes", p.Done, p.Total, p.Failed, p.Bytes)
+		if method == "Worktree.PrefetchCancel" {
+			fmt.Fprintln(os.Stderr)
+			log.Fatalf("prefetch canceled")
+		}
+		if status.Done {
+			fmt.Fprintln(os.Stderr)
+			if status.Error != "" {
+				log.Fatalf("prefetch: %s", status.Error)
+			}
+			return
+		}
+	}
+}
+
+func init() {
+	prefetch := &prefetchCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "prefetch",
+		Short: "Load the blobs under <pathspec> of a mounted <worktree> into its cache",
+		Run:   prefetch.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &prefetch.o.gitDir)
+	flags.StringVarP(&prefetch.o.profile, "profile", "", "", "read paths to prefetch from a recorded access profile")
+	flags.IntVarP(&prefetch.o.workers, "workers", "j", 0, "number of blobs loaded in parallel")
+	flags.BoolVarP(&prefetch.o.detach, "detach", "", false, "return once the prefetch has started")
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+type rebaseCmd struct {
+	o struct {
+		gitDir string
+
+		json bool
+	}
+}
+
+func (cmd *rebaseCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) != 2 {
+		log.Fatalf("usage: %s rebase <worktree> <new-rev>", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	worktree := getWorktree(gitDir, args[0])
+	cfg := loadWorktreeConfig(gitDir, args[0])
+
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		log.Fatalf("open %s: %v", gitDir, err)
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(args[1]))
+	if err != nil {
+		log.Fatalf("resolve %s: %v", args[1], err)
+	}
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		log.Fatalf("resolve %s: %v", args[1], err)
+	}
+	if commit.Hash.String() == cfg.Commit {
+		fmt.Printf("%s is already based on %s\n", args[0], args[1])
+		return
+	}
+
+	var (
+		paths     []string
+		conflicts []worktrees.Conflict
+	)
+	if client, err := dialControl(worktree); err == nil {
+		// A mounted worktree rebases in its mount, where nothing is
+		// written to the upper layer meanwhile.
+		defer client.Close()
+		var reply RebaseReply
+		err = client.Call("Worktree.Rebase", &RebaseArgs{Commit: commit.Hash.String(), Label: args[1]}, &reply)
+		if err != nil {
+			log.Fatalf("rebase %s: %v", args[0], err)
+		}
+		paths, conflicts = reply.Paths, reply.Conflicts
+	} else {
+		if paths, conflicts, err = worktrees.Rebase(repo, cfg, commit.Hash, args[1]); err != nil {
+			log.Fatalf("rebase %s: %v", args[0], err)
+		}
+		cfg.Commit = commit.Hash.String()
+		if err := cfg.Save(worktree); err != nil {
+			log.Fatalf("save worktree config: %v", err)
+		}
+	}
+
+	if cmd.o.json {
+		if conflicts == nil {
+			conflicts = []worktrees.Conflict{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(conflicts); err != nil {
+			log.Fatalf("encode: %v", err)
+		}
+	} else {
+		fmt.Printf("rebased %s onto %s (%s), %d paths merged\n", args[0], args[1], commit.Hash.String()[:7], len(paths))
+		if len(conflicts) > 0 {
+			fmt.Printf("\nConflicts:\n")
+			for _, c := range conflicts {
+				fmt.Printf("\t%s: %s\n", c.Path, c.Reason)
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	rebase := &rebaseCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "rebase",
+		Short: "Merge the changes in the upper layer of <worktree> onto <new-rev> and move the worktree there",
+		Run:   rebase.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &rebase.o.gitDir)
+	flags.BoolVarP(&rebase.o.json, "json", "", false, "print the conflicts as JSON")
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// RegistryEntry is a worktree added by the user, as recorded in the
+// registry for restore to mount it again.
+type RegistryEntry struct {
+	Repo       string    `json:"repo"`
+	Name       string    `json:"name"`
+	Mountpoint string    `json:"mountpoint"`
+	Revision   string    `json:"revision"`
+	Upper      string    `json:"upper,omitempty"`
+	Ephemeral  bool      `json:"ephemeral,omitempty"`
+	Daemon     bool      `json:"daemon,omitempty"`
+	Added      time.Time `json:"added"`
+	// Args are the args the worktree was added with.
+	Args *MountArgs `json:"args"`
+}
+
+type registry struct {
+	Worktrees []RegistryEntry `json:"worktrees"`
+}
+
+// getRegistryFile returns the registry of the user, in the XDG config dir
+// which defaults to ~/.config.
+func getRegistryFile() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "git-fuse-worktree", "registry.json"), nil
+}
+
+func readRegistry(file string) (*registry, error) {
+	r := &registry{}
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r, json.Unmarshal(data, r)
+}
+
+// loadRegistry returns the registered worktrees, sorted by repository and
+// name.
+func loadRegistry() ([]RegistryEntry, error) {
+	file, err := getRegistryFile()
+	if err != nil {
+		return nil, err
+	}
+	r, err := readRegistry(file)
+	if err != nil {
+		return nil, err
+	}
+	return r.Worktrees, nil
+}
+
+// updateRegistry replaces the registered worktrees by what fn returns.
+// The registry is locked meanwhile, for concurrent adds not to lose each
+// other's entries, and replaced at once.
+func updateRegistry(fn func([]RegistryEntry) []RegistryEntry) error {
+	file, err := getRegistryFile()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(file+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	r, err := readRegistry(file)
+	if err != nil {
+		return err
+	}
+	r.Worktrees = fn(r.Worktrees)
+	sort.Slice(r.Worktrees, func(i, j int) bool {
+		a, b := r.Worktrees[i], r.Worktrees[j]
+		if a.Repo != b.Repo {
+			return a.Repo < b.Repo
+		}
+		return a.Name < b.Name
+	})
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// registerWorktree records e, replacing the entry of the same worktree.
+func registerWorktree(e RegistryEntry) error {
+	return updateRegistry(func(entries []RegistryEntry) []RegistryEntry {
+		entries = withoutWorktree(entries, e.Repo, e.Name)
+		return append(entries, e)
+	})
+}
+
+func unregisterWorktree(repo, name string) error {
+	return updateRegistry(func(entries []RegistryEntry) []RegistryEntry {
+		return withoutWorktree(entries, repo, name)
+	})
+}
+
+func withoutWorktree(entries []RegistryEntry, repo, name string) []RegistryEntry {
+	repo = filepath.Clean(repo)
+	kept := entries[:0]
+	for _, e := range entries {
+		if filepath.Clean(e.Repo) != repo || e.Name != name {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
@@ -1,10 +1,17 @@
 package main
 
 import (
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/mountinfo"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
 )
 
 type removeCmd struct {
@@ -27,20 +34,109 @@ func (cmd *removeCmd) Run(_ *cobra.Command, args []string) {
 	mp := getMountpoint(gitDir, args[0])
 	worktree := getWorktree(gitDir, args[0])
 
-	if err := doUmount(mp, cmd.o.force); err != nil {
-		if cmd.o.force {
-			log.Warnf("unmount %s error: %v", mp, err)
-		} else {
-			log.Fatalf("unmount %s error: %v", mp, err)
+	// Worktrees added before the config was recorded only have their
+	// admin dir removed.
+	cfg, err := worktrees.LoadConfig(worktree)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatalf("worktree %s: %v", args[0], err)
+	}
+	if cfg != nil && !cfg.Ephemeral && !cmd.o.force {
+		empty, err := cfg.Layer().Empty()
+		if err != nil {
+			log.Fatalf("check %s: %v", cfg.Upper, err)
+		}
+		if !empty {
+			log.Fatalf("%s has changes in %s, use --force to remove them", args[0], cfg.Upper)
+		}
+	}
+
+	m, err := worktreeMount(mp, gitDir, args[0])
+	if err != nil {
+		log.Fatalf("%s: %v, nothing removed", args[0], err)
+	}
+	// With nothing mounted there is nothing to unmount.
+	unmounted := m == nil
+	if client, err := dialDaemon(gitDir, nil); err == nil && !unmounted {
+		err = client.Call("Daemon.Unmount", &UnmountArgs{Name: args[0]}, &struct{}{})
+		client.Close()
+		if err != nil {
+			log.Debugf("daemon unmount %s: %v", args[0], err)
+		}
+		unmounted = err == nil
+	}
+	if !unmounted {
+		if err := doUmount(mp, cmd.o.force); err != nil {
+			if cmd.o.force {
+				log.Warnf("unmount %s error: %v", mp, err)
+			} else {
+				log.Fatalf("unmount %s error: %v", mp, err)
+			}
+		}
+	}
+	// A mount that is still up, or detached but still served, keeps
+	// writing to its upper dir.
+	if up, err := stillMounted(mp, gitDir, args[0], worktree); up {
+		log.Fatalf("%s: %v, nothing removed", args[0], err)
+	}
+	switch {
+	case cfg == nil:
+	case ownsUpper(gitDir, cfg):
+		if err := os.RemoveAll(cfg.Upper); err != nil {
+			if cmd.o.force {
+				log.Warnf("remove %s error: %v", cfg.Upper, err)
+			} else {
+				log.Fatalf("remove %s error: %v", cfg.Upper, err)
+			}
 		}
+	default:
+		log.Warnf("left %s in place, it was given with --upper-dir", cfg.Upper)
 	}
-	if err := os.Remove(worktree); err != nil {
+	if err := os.RemoveAll(worktree); err != nil {
 		if cmd.o.force {
 			log.Warnf("remove %s error: %v", worktree, err)
 		} else {
 			log.Fatalf("remove %s error: %v", worktree, err)
 		}
 	}
+	if err := unregisterWorktree(gitDir, args[0]); err != nil {
+		log.Warnf("unregister %s: %v", args[0], err)
+	}
+}
+
+// ownsUpper reports whether the upper dir of cfg is one the worktree got
+// without asking for it, the default or an ephemeral one, rather than a
+// dir given with --upper-dir that may hold anything else.
+func ownsUpper(gitDir string, cfg *worktrees.Config) bool {
+	upper := filepath.Clean(cfg.Upper)
+	if cfg.Ephemeral {
+		return strings.HasPrefix(filepath.Base(upper), ephemeralPrefix(cfg.Name))
+	}
+	return upper == filepath.Clean(getUpperDir(gitDir, cfg.Name))
+}
+
+// stillMounted reports whether the worktree name of gitDir is still
+// mounted at mp, or still served after being detached, and how. It waits
+// a little for a server that was just unmounted to exit.
+func stillMounted(mp, gitDir, name, worktree string) (bool, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m, err := worktreeMount(mp, gitDir, name)
+		switch {
+		case err != nil:
+			return true, err
+		case m != nil && !mountinfo.Stale(mp):
+			return true, fmt.Errorf("still mounted from %s", m.Source)
+		}
+		client, err := dialControl(worktree)
+		if err != nil {
+			return false, nil
+		}
+		client.Close()
+		if time.Now().After(deadline) {
+			return true, fmt.Errorf("still served after being detached")
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
 }
 
 func init() {
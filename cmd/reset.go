@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+type resetCmd struct {
+	o struct {
+		gitDir string
+		hard   bool
+	}
+}
+
+func (cmd *resetCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s reset <worktree> [<pathspec>...]", os.Args[0])
+	}
+	paths := args[1:]
+	if len(paths) == 0 && !cmd.o.hard {
+		log.Fatalf("nothing to reset, give a pathspec or --hard")
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	worktree := getWorktree(gitDir, args[0])
+
+	var reply ResetReply
+	if client, err := dialControl(worktree); err == nil {
+		// The mount has to forget the reset paths, so it does the work.
+		defer client.Close()
+		if err := client.Call("Worktree.Reset", &ResetArgs{Paths: paths, Hard: cmd.o.hard}, &reply); err != nil {
+			log.Fatalf("reset %s: %v", args[0], err)
+		}
+	} else {
+		layer := loadWorktreeConfig(gitDir, args[0]).Layer()
+		if cmd.o.hard {
+			paths = []string{"."}
+		}
+		reset, err := layer.Reset(paths)
+		if err == nil && cmd.o.hard {
+			err = layer.Clear()
+		}
+		if err != nil {
+			log.Fatalf("reset %s: %v", args[0], err)
+		}
+		reply.Reset = len(reset)
+	}
+	fmt.Printf("reset %d paths\n", reply.Reset)
+}
+
+func init() {
+	reset := &resetCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "reset",
+		Short: "Discard the changes to <pathspec> in the upper layer of <worktree>",
+		Run:   reset.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &reset.o.gitDir)
+	flags.BoolVarP(&reset.o.hard, "hard", "", false, "discard every change in the upper layer")
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/mountinfo"
+)
+
+type restoreCmd struct {
+	o struct {
+		logLevel string
+		gitDir   string
+		dryRun   bool
+	}
+}
+
+// match reports whether e is one of the worktrees to restore: of the
+// repository given with -C if any, and matching one of the patterns if
+// any were given.
+func (cmd *restoreCmd) match(e RegistryEntry, patterns []string) bool {
+	if cmd.o.gitDir != "" && filepath.Clean(e.Repo) != filepath.Clean(getGitDir(cmd.o.gitDir)) {
+		return false
+	}
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, e.Name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (cmd *restoreCmd) restore(e RegistryEntry) error {
+	if e.Args == nil {
+		return fmt.Errorf("no mount args recorded")
+	}
+	if _, err := os.Stat(e.Repo); err != nil {
+		return err
+	}
+	client, err := dialDaemon(e.Repo, &daemonOptions{
+		logLevel:    cmd.o.logLevel,
+		objectStore: e.Args.ObjectStore,
+		cacheSize:   e.Args.CacheSize,
+	})
+	if err != nil {
+		return fmt.Errorf("connect to daemon: %v", err)
+	}
+	defer client.Close()
+	return client.Call("Daemon.Mount", e.Args, &struct{}{})
+}
+
+func (cmd *restoreCmd) Run(_ *cobra.Command, args []string) {
+	logLevel, err := log.ParseLevel(cmd.o.logLevel)
+	if err != nil {
+		logLevel = log.InfoLevel
+	}
+	log.SetLevel(logLevel)
+
+	entries, err := loadRegistry()
+	if err != nil {
+		log.Fatalf("read registry: %v", err)
+	}
+
+	failed := 0
+	for _, e := range entries {
+		if !cmd.match(e, args) {
+			continue
+		}
+		if m, err := worktreeMount(e.Mountpoint, e.Repo, e.Name); err == nil && m != nil && !mountinfo.Stale(e.Mountpoint) {
+			log.Debugf("%s is already mounted at %s", e.Name, e.Mountpoint)
+			continue
+		}
+		if cmd.o.dryRun {
+			fmt.Printf("%s\t%s\t%s\t%s\n", e.Repo, e.Name, e.Revision, e.Mountpoint)
+			continue
+		}
+		if err := cmd.restore(e); err != nil {
+			log.Errorf("restore %s of %s: %v", e.Name, e.Repo, err)
+			failed++
+			continue
+		}
+		log.Infof("restored %s at %s", e.Name, e.Mountpoint)
+	}
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+func init() {
+	restore := &restoreCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "restore",
+		Short: "Mount again the registered worktrees, or those matching [<pattern>...]",
+		Long: `Mount again the worktrees recorded by add in the registry of the user,
+$XDG_CONFIG_HOME/git-fuse-worktree/registry.json, after a reboot for
+instance. Only the worktrees of the repository given with -C, or whose name
+matches one of the patterns, are mounted if any is given. They keep their
+commit and upper dir, and are served by the daemon of their repository.`,
+		Run: restore.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &restore.o.gitDir)
+	flags.StringVarP(&restore.o.logLevel, "log-level", "", "info", "log level")
+	flags.BoolVarP(&restore.o.dryRun, "dry-run", "n", false, "only print the worktrees that would be mounted")
+}
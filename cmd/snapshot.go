@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+type snapshotCmd struct {
+	o struct {
+		gitDir  string
+		message string
+	}
+}
+
+func (cmd *snapshotCmd) open(name string) (*gogit.Repository, *worktrees.Config) {
+	gitDir := getGitDir(cmd.o.gitDir)
+	cfg := loadWorktreeConfig(gitDir, name)
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		log.Fatalf("open %s: %v", gitDir, err)
+	}
+	return repo, cfg
+}
+
+func (cmd *snapshotCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: %s snapshot <worktree>", os.Args[0])
+	}
+
+	var (
+		id      string
+		created bool
+	)
+	worktree := getWorktree(getGitDir(cmd.o.gitDir), args[0])
+	if client, err := dialControl(worktree); err == nil {
+		// A mounted worktree is snapshotted by its mount, where nothing
+		// is written to the upper layer meanwhile.
+		defer client.Close()
+		var reply SnapshotReply
+		if err := client.Call("Worktree.Snapshot", &SnapshotArgs{Message: cmd.o.message}, &reply); err != nil {
+			log.Fatalf("snapshot %s: %v", args[0], err)
+		}
+		id, created = reply.ID, reply.Created
+	} else {
+		repo, cfg := cmd.open(args[0])
+		hash, ok, err := worktrees.Snapshot(repo, cfg, cmd.o.message)
+		if err != nil {
+			log.Fatalf("snapshot %s: %v", args[0], err)
+		}
+		id, created = hash.String(), ok
+	}
+	if !created {
+		log.Infof("no changes since the last snapshot")
+	}
+	fmt.Println(id)
+}
+
+func (cmd *snapshotCmd) List(_ *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: %s snapshot list <worktree>", os.Args[0])
+	}
+	repo, cfg := cmd.open(args[0])
+	snapshots, err := worktrees.Snapshots(repo, cfg.Name)
+	if err != nil {
+		log.Fatalf("list snapshots: %v", err)
+	}
+	for _, s := range snapshots {
+		fmt.Printf("%s %s base %s %s\n", s.ID.String()[:12], s.Time.Format(time.RFC3339), s.Base.String()[:12], s.Message)
+	}
+}
+
+// Restore rebuilds the upper layer from a snapshot, moving the worktree
+// onto the commit the snapshot was based on.
+func (cmd *snapshotCmd) Restore(_ *cobra.Command, args []string) {
+	if len(args) != 2 {
+		log.Fatalf("usage: %s snapshot restore <worktree> <id>", os.Args[0])
+	}
+
+	worktree := getWorktree(getGitDir(cmd.o.gitDir), args[0])
+	if client, err := dialControl(worktree); err == nil {
+		// A mounted worktree restores in its mount, where nothing is
+		// written to the upper layer meanwhile.
+		defer client.Close()
+		var reply RestoreSnapshotReply
+		if err := client.Call("Worktree.RestoreSnapshot", &RestoreSnapshotArgs{ID: args[1]}, &reply); err != nil {
+			log.Fatalf("restore %s: %v", args[0], err)
+		}
+		fmt.Printf("restored %s, %d paths\n", reply.ID, len(reply.Paths))
+		return
+	}
+
+	repo, cfg := cmd.open(args[0])
+	snapshot, err := worktrees.FindSnapshot(repo, cfg.Name, args[1])
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	if err := cfg.Layer().Clear(); err != nil {
+		log.Fatalf("clear upper dir: %v", err)
+	}
+	cfg.Commit = snapshot.Base.String()
+	if err := cfg.Save(worktree); err != nil {
+		log.Fatalf("save worktree config: %v", err)
+	}
+	paths, err := worktrees.RestoreSnapshot(repo, cfg, snapshot)
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	fmt.Printf("restored %s, %d paths\n", snapshot.ID, len(paths))
+}
+
+func init() {
+	snapshot := &snapshotCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "snapshot",
+		Short: "Record the merged tree of <worktree> under its snapshot ref",
+		Run:   snapshot.Run,
+	}
+	Cmd.AddCommand(cmd)
+	bindGitDir(cmd.PersistentFlags(), &snapshot.o.gitDir)
+	cmd.Flags().StringVarP(&snapshot.o.message, "message", "m", "", "snapshot message")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List the snapshots of <worktree>, newest first",
+		Run:   snapshot.List,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "restore",
+		Short: "Rebuild the upper layer of <worktree> from snapshot <id>",
+		Run:   snapshot.Restore,
+	})
+}
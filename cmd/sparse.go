@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/fs"
+)
+
+type sparseCmd struct {
+	o struct {
+		gitDir string
+
+		noCone bool
+	}
+}
+
+func (cmd *sparseCmd) load(worktree string) *fs.Sparse {
+	sparse, err := fs.LoadSparse(getSparseFile(worktree))
+	if err != nil {
+		log.Fatalf("read sparse-checkout: %v", err)
+	}
+	return sparse
+}
+
+// save writes the sparse-checkout file of worktree, removing it when
+// sparse is nil, and tells a running mount to reload it.
+func (cmd *sparseCmd) save(worktree string, sparse *fs.Sparse) {
+	file := getSparseFile(worktree)
+	if sparse == nil {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			log.Fatalf("remove %s: %v", file, err)
+		}
+	} else {
+		var b strings.Builder
+		sparse.WriteTo(&b)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			log.Fatalf("create %s: %v", filepath.Dir(file), err)
+		}
+		if err := ioutil.WriteFile(file, []byte(b.String()), 0644); err != nil {
+			log.Fatalf("write %s: %v", file, err)
+		}
+	}
+
+	client, err := dialControl(worktree)
+	if err != nil {
+		log.Debugf("worktree not mounted: %v", err)
+		return
+	}
+	defer client.Close()
+	var reply ReloadSparseReply
+	if err := client.Call("Worktree.ReloadSparse", &struct{}{}, &reply); err != nil {
+		log.Fatalf("reload sparse-checkout: %v", err)
+	}
+	log.Infof("%d paths changed visibility", reply.Changed)
+}
+
+func (cmd *sparseCmd) worktree(args []string, usage string) string {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s sparse %s", os.Args[0], usage)
+	}
+	return getWorktree(getGitDir(cmd.o.gitDir), args[0])
+}
+
+func (cmd *sparseCmd) List(_ *cobra.Command, args []string) {
+	sparse := cmd.load(cmd.worktree(args, "list <worktree>"))
+	if sparse == nil {
+		return
+	}
+	for _, p := range sparse.Patterns() {
+		fmt.Println(p)
+	}
+}
+
+func (cmd *sparseCmd) Set(_ *cobra.Command, args []string) {
+	worktree := cmd.worktree(args, "set <worktree> <pattern>...")
+	if cmd.o.noCone {
+		sparse, err := fs.ParseSparse(strings.NewReader(strings.Join(args[1:], "\n")))
+		if err != nil {
+			log.Fatalf("parse patterns: %v", err)
+		}
+		cmd.save(worktree, sparse)
+		return
+	}
+	cmd.save(worktree, fs.NewConeSparse(args[1:]))
+}
+
+func (cmd *sparseCmd) Add(_ *cobra.Command, args []string) {
+	worktree := cmd.worktree(args, "add <worktree> <pattern>...")
+	sparse := cmd.load(worktree)
+	if sparse == nil {
+		log.Fatalf("sparse checkout is not enabled, use set")
+	}
+	cmd.save(worktree, sparse.Add(args[1:]))
+}
+
+func (cmd *sparseCmd) Disable(_ *cobra.Command, args []string) {
+	cmd.save(cmd.worktree(args, "disable <worktree>"), nil)
+}
+
+func init() {
+	sparse := &sparseCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "sparse",
+		Short: "Limit the paths visible in <worktree> to a sparse-checkout",
+	}
+	Cmd.AddCommand(cmd)
+	bindGitDir(cmd.PersistentFlags(), &sparse.o.gitDir)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "Show the sparse-checkout patterns of <worktree>",
+		Run:   sparse.List,
+	})
+	set := &cobra.Command{
+		Use:   "set",
+		Short: "Replace the sparse-checkout of <worktree> with <pattern>...",
+		Run:   sparse.Set,
+	}
+	set.Flags().BoolVarP(&sparse.o.noCone, "no-cone", "", false, "take gitignore style patterns instead of directories")
+	cmd.AddCommand(set)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add",
+		Short: "Add <pattern>... to the sparse-checkout of <worktree>",
+		Run:   sparse.Add,
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "disable",
+		Short: "Show the whole tree in <worktree> again",
+		Run:   sparse.Disable,
+	})
+}
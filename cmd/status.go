@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+type statusCmd struct {
+	o struct {
+		gitDir string
+
+		porcelain bool
+		json      bool
+	}
+}
+
+// statusEntry is a change as printed by status --json.
+type statusEntry struct {
+	Path    string `json:"path"`
+	Status  string `json:"status"`
+	OldMode string `json:"old_mode,omitempty"`
+	NewMode string `json:"new_mode,omitempty"`
+	OldOid  string `json:"old_oid,omitempty"`
+	NewOid  string `json:"new_oid,omitempty"`
+}
+
+func newStatusEntry(c worktrees.Change) statusEntry {
+	e := statusEntry{Path: c.Path, Status: c.Kind}
+	if c.Kind != worktrees.Added {
+		e.OldMode, e.OldOid = c.From.Mode.String(), c.From.Hash.String()
+	}
+	if c.Kind != worktrees.Deleted {
+		e.NewMode, e.NewOid = c.To.Mode.String(), c.To.Hash.String()
+	}
+	return e
+}
+
+// porcelainCode returns the two letter code git status --porcelain uses
+// for a change in the worktree.
+func porcelainCode(c worktrees.Change) string {
+	switch c.Kind {
+	case worktrees.Added:
+		return "??"
+	case worktrees.Deleted:
+		return " D"
+	}
+	if (c.From.Mode == filemode.Symlink) != (c.To.Mode == filemode.Symlink) {
+		return " T"
+	}
+	return " M"
+}
+
+var statusLabels = map[string]string{
+	worktrees.Added:       "new file:",
+	worktrees.Modified:    "modified:",
+	worktrees.Deleted:     "deleted:",
+	worktrees.ModeChanged: "mode changed:",
+}
+
+func (cmd *statusCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) < 1 {
+		log.Fatalf("usage: %s status <worktree>", os.Args[0])
+	}
+
+	gitDir := getGitDir(cmd.o.gitDir)
+	cfg := loadWorktreeConfig(gitDir, args[0])
+
+	repo, err := gogit.PlainOpen(gitDir)
+	if err != nil {
+		log.Fatalf("open %s: %v", gitDir, err)
+	}
+	changes, err := cfg.Changes(repo, nil)
+	if err != nil {
+		log.Fatalf("status: %v", err)
+	}
+
+	switch {
+	case cmd.o.json:
+		entries := make([]statusEntry, 0, len(changes))
+		for _, c := range changes {
+			entries = append(entries, newStatusEntry(c))
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			log.Fatalf("encode: %v", err)
+		}
+	case cmd.o.porcelain:
+		for _, c := range changes {
+			fmt.Printf("%s %s\n", porcelainCode(c), c.Path)
+		}
+	default:
+		fmt.Printf("On %s (%s)\n", cfg.Revision, cfg.Commit[:7])
+		if len(changes) == 0 {
+			fmt.Println("nothing to commit, upper layer clean")
+			return
+		}
+		fmt.Println("Changes in the upper layer:")
+		for _, c := range changes {
+			fmt.Printf("\t%-14s%s\n", statusLabels[c.Kind], c.Path)
+		}
+	}
+}
+
+func init() {
+	status := &statusCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "Show the paths the upper layer of <worktree> changes from its base",
+		Run:   status.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &status.o.gitDir)
+	flags.BoolVarP(&status.o.porcelain, "porcelain", "", false, "give the output in the format of git status --porcelain")
+	flags.BoolVarP(&status.o.json, "json", "", false, "give the output as JSON")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/mountinfo"
+)
+
+const (
+	superviseMinBackoff = time.Second
+	superviseMaxBackoff = 5 * time.Minute
+)
+
+// SuperviseEvent is a line of the event log of the supervisor.
+type SuperviseEvent struct {
+	Time     time.Time `json:"time"`
+	Worktree string    `json:"worktree"`
+	// Event is one of stale, dead, recovered and failed.
+	Event   string `json:"event"`
+	Attempt int    `json:"attempt,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// supervisedWorktree is what the supervisor remembers of a worktree
+// between two checks.
+type supervisedWorktree struct {
+	// down is set once the worktree was found down, it is only recovered
+	// if it still is at the next check. This leaves the time to a clean
+	// unmount to remove the mount args.
+	down     bool
+	failures int
+	next     time.Time
+}
+
+// supervisor mounts again, served by the daemon, the worktrees whose
+// server died: those whose mount args are still in the admin dir while
+// their mountpoint is stale or no longer mounted.
+type supervisor struct {
+	d      *daemon
+	events *json.Encoder
+	state  map[string]*supervisedWorktree
+}
+
+func getSuperviseLog(gitDir string) string {
+	return filepath.Join(gitDir, "worktrees", "supervise.log")
+}
+
+func newSupervisor(d *daemon) (*supervisor, func(), error) {
+	f, err := os.OpenFile(getSuperviseLog(d.gitDir), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	s := &supervisor{
+		d:      d,
+		events: json.NewEncoder(f),
+		state:  map[string]*supervisedWorktree{},
+	}
+	return s, func() { f.Close() }, nil
+}
+
+func (s *supervisor) event(name, event string, attempt int, err error) {
+	e := SuperviseEvent{Time: time.Now(), Worktree: name, Event: event, Attempt: attempt}
+	if err != nil {
+		e.Error = err.Error()
+		log.Warnf("supervise %s: %s: %v", name, event, err)
+	} else {
+		log.Infof("supervise %s: %s", name, event)
+	}
+	if err := s.events.Encode(e); err != nil {
+		log.Errorf("write supervise event: %v", err)
+	}
+}
+
+// run checks the worktrees every interval until the daemon stops.
+func (s *supervisor) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.check()
+		select {
+		case <-ticker.C:
+		case <-s.d.stop:
+			return
+		}
+	}
+}
+
+// mountedArgs returns the names of the worktrees of the repository with
+// mount args in their admin dir.
+func (s *supervisor) mountedArgs() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.d.gitDir, "worktrees"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range infos {
+		if !fi.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(getMountArgsFile(getWorktree(s.d.gitDir, fi.Name()))); err == nil {
+			names = append(names, fi.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s *supervisor) check() {
+	names, err := s.mountedArgs()
+	if err != nil {
+		log.Errorf("supervise: %v", err)
+		return
+	}
+	seen := map[string]bool{}
+	for _, name := range names {
+		seen[name] = true
+		s.checkWorktree(name)
+	}
+	for name := range s.state {
+		if !seen[name] {
+			delete(s.state, name)
+		}
+	}
+}
+
+func (s *supervisor) checkWorktree(name string) {
+	st, ok := s.state[name]
+	if !ok {
+		st = &supervisedWorktree{}
+		s.state[name] = st
+	}
+
+	s.d.mu.Lock()
+	_, served := s.d.mounts[name]
+	s.d.mu.Unlock()
+	if served {
+		*st = supervisedWorktree{}
+		return
+	}
+
+	mp := getMountpoint(s.d.gitDir, name)
+	// Whatever else is mounted there is left alone.
+	m, err := worktreeMount(mp, s.d.gitDir, name)
+	if err != nil {
+		log.Errorf("supervise %s: %v", name, err)
+		return
+	}
+	stale := m != nil && mountinfo.Stale(mp)
+	if m != nil && !stale {
+		*st = supervisedWorktree{}
+		return
+	}
+	if !st.down {
+		st.down = true
+		if stale {
+			s.event(name, "stale", 0, nil)
+		} else {
+			s.event(name, "dead", 0, nil)
+		}
+		return
+	}
+	if time.Now().Before(st.next) {
+		return
+	}
+
+	if err := s.recover(name, mp, stale); err != nil {
+		st.failures++
+		backoff := superviseMinBackoff << uint(st.failures-1)
+		if backoff > superviseMaxBackoff || backoff <= 0 {
+			backoff = superviseMaxBackoff
+		}
+		st.next = time.Now().Add(backoff)
+		s.event(name, "failed", st.failures, err)
+		return
+	}
+	s.event(name, "recovered", st.failures+1, nil)
+	*st = supervisedWorktree{}
+}
+
+// recover mounts the worktree again with the args it was last mounted
+// with, after detaching its stale mount.
+func (s *supervisor) recover(name, mp string, stale bool) error {
+	args, err := loadMountArgs(getWorktree(s.d.gitDir, name))
+	if err != nil {
+		return fmt.Errorf("mount args: %v", err)
+	}
+	if stale {
+		if err := doUmount(mp, true); err != nil {
+			return err
+		}
+	}
+	// A worktree that had a server of its own is served with the
+	// repository of the daemon all the same.
+	if err := s.d.check(args); err != nil {
+		log.Warnf("%s: %v, serving it anyway", name, err)
+		args.ObjectStore, args.CacheSize = "", 0
+	}
+	return s.d.mount(args)
+}
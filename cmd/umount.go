@@ -2,32 +2,54 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/mountinfo"
 )
 
-func doCheckAndUnmount(mp string) {
-	fi, err := os.Stat(mp)
-	if !strings.Contains(mp, ":") && err != nil {
-		if err := os.MkdirAll(mp, 0777); err != nil {
-			if os.IsExist(err) {
-				// a broken mount point, umount it
-				if err = doUmount(mp, true); err != nil {
-					log.Fatalf("umount %s: %s", mp, err)
-				}
-			} else {
-				log.Fatalf("create %s: %s", mp, err)
-			}
-		}
-	} else if err == nil && fi.Size() == 0 {
-		// a broken mount point, umount it
-		if err = doUmount(mp, true); err != nil {
-			log.Fatalf("umount %s: %s", mp, err)
+// worktreeMount returns the mount at mp, nil if nothing is mounted there.
+// Anything but the mount of the worktree name of gitDir is an error, for
+// it to be neither unmounted nor taken for the worktree.
+func worktreeMount(mp, gitDir, name string) (*mountinfo.Mount, error) {
+	m, err := mountinfo.Lookup(mp)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	if !m.IsWorktree(gitDir, name) {
+		return m, fmt.Errorf("%s is mounted from %s, not from worktree %s", mp, m.Source, name)
+	}
+	return m, nil
+}
+
+// prepareMountpoint makes sure the worktree name of gitDir can be mounted
+// on mp: it is created if needed, and a stale mount of the worktree left
+// there by a server that died is unmounted. A live mount, or a mount of
+// anything else, is an error.
+func prepareMountpoint(mp, gitDir, name string) error {
+	m, err := worktreeMount(mp, gitDir, name)
+	switch {
+	case err != nil:
+		return err
+	case m == nil:
+		return os.MkdirAll(mp, 0777)
+	case mountinfo.Stale(mp):
+		log.Warnf("unmounting stale mount %s of %s", mp, m.Source)
+		if err := doUmount(mp, true); err != nil {
+			return fmt.Errorf("unmount stale %s: %v", mp, err)
 		}
+		return nil
+	default:
+		return fmt.Errorf("%s is already mounted from %s", mp, m.Source)
 	}
 }
 
@@ -41,11 +63,11 @@ func doUmount(mp string, force bool) error {
 			cmd = exec.Command("diskutil", "umount", mp)
 		}
 	case "linux":
-		if _, err := exec.LookPath("fusermount"); err == nil {
+		if bin, err := mountinfo.Fusermount(); err == nil {
 			if force {
-				cmd = exec.Command("fusermount", "-uz", mp)
+				cmd = exec.Command(bin, "-uz", mp)
 			} else {
-				cmd = exec.Command("fusermount", "-u", mp)
+				cmd = exec.Command(bin, "-u", mp)
 			}
 		} else {
 			if force {
@@ -57,9 +79,132 @@ func doUmount(mp string, force bool) error {
 	default:
 		return fmt.Errorf("OS %s is not supported", runtime.GOOS)
 	}
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		log.Print(string(out))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("%v: %s", err, msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// holder is a process keeping a mount busy.
+type holder struct {
+	pid     int
+	command string
+	// handle is what refers to path: cwd, root or fd <n>.
+	handle string
+	path   string
+}
+
+// mountHolders lists the processes with their working dir, root or an
+// open file below mp.
+func mountHolders(mp string) []holder {
+	below := func(p string) bool {
+		return p == mp || strings.HasPrefix(p, mp+"/")
+	}
+	procs, _ := filepath.Glob("/proc/[0-9]*")
+	var holders []holder
+	for _, proc := range procs {
+		pid, err := strconv.Atoi(filepath.Base(proc))
+		if err != nil || pid == os.Getpid() {
+			continue
+		}
+		comm, _ := ioutil.ReadFile(filepath.Join(proc, "comm"))
+		add := func(handle, p string) {
+			holders = append(holders, holder{pid: pid, command: strings.TrimSpace(string(comm)), handle: handle, path: p})
+		}
+		for _, link := range []string{"cwd", "root"} {
+			if p, err := os.Readlink(filepath.Join(proc, link)); err == nil && below(p) {
+				add(link, p)
+			}
+		}
+		fds, _ := ioutil.ReadDir(filepath.Join(proc, "fd"))
+		for _, fd := range fds {
+			if p, err := os.Readlink(filepath.Join(proc, "fd", fd.Name())); err == nil && below(p) {
+				add("fd "+fd.Name(), p)
+			}
+		}
+	}
+	return holders
+}
+
+type umountCmd struct {
+	o struct {
+		gitDir string
+
+		lazy bool
+		wait time.Duration
+	}
+}
+
+// unmount unmounts the worktree name at mp, through the daemon if it is
+// the one serving it.
+func (cmd *umountCmd) unmount(gitDir, name, mp string) error {
+	if client, err := dialDaemon(gitDir, nil); err == nil {
+		defer client.Close()
+		var reply ListReply
+		if err := client.Call("Daemon.List", &struct{}{}, &reply); err == nil {
+			for _, wt := range reply.Worktrees {
+				if wt.Name == name {
+					return client.Call("Daemon.Unmount", &UnmountArgs{Name: name}, &struct{}{})
+				}
+			}
+		}
+	}
+	return doUmount(mp, false)
+}
+
+func (cmd *umountCmd) Run(_ *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("usage: %s umount <worktree>", os.Args[0])
+	}
+	gitDir := getGitDir(cmd.o.gitDir)
+	mp := getMountpoint(gitDir, args[0])
+	if _, err := worktreeMount(mp, gitDir, args[0]); err != nil {
+		log.Fatalf("unmount %s: %v", args[0], err)
 	}
-	return err
+
+	deadline := time.Now().Add(cmd.o.wait)
+	err := cmd.unmount(gitDir, args[0], mp)
+	for err != nil && time.Now().Before(deadline) {
+		time.Sleep(200 * time.Millisecond)
+		err = cmd.unmount(gitDir, args[0], mp)
+	}
+	if err == nil {
+		return
+	}
+
+	holders := mountHolders(mp)
+	if len(holders) > 0 {
+		fmt.Fprintf(os.Stderr, "%s is busy:\n", mp)
+		for _, h := range holders {
+			fmt.Fprintf(os.Stderr, "\t%d\t%s\t%s\t%s\n", h.pid, h.command, h.handle, h.path)
+		}
+	}
+	if !cmd.o.lazy {
+		log.Fatalf("unmount %s: %v", args[0], err)
+	}
+	// The kernel detaches the mount now and lets it go once the last
+	// holder is done with it.
+	if err := doUmount(mp, true); err != nil {
+		log.Fatalf("unmount %s: %v", args[0], err)
+	}
+	log.Warnf("%s detached lazily, it goes away once it is no longer busy", args[0])
+}
+
+func init() {
+	umount := &umountCmd{}
+
+	cmd := &cobra.Command{
+		Use:   "umount",
+		Short: "Unmount <worktree>, showing what keeps it busy",
+		Run:   umount.Run,
+	}
+	Cmd.AddCommand(cmd)
+
+	flags := cmd.Flags()
+	bindGitDir(flags, &umount.o.gitDir)
+	flags.BoolVarP(&umount.o.lazy, "lazy", "l", false, "detach the mount if it is busy")
+	flags.DurationVarP(&umount.o.wait, "wait", "w", 0, "keep trying to unmount a busy worktree this long")
 }
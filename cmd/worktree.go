@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/fs"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+// accessSaveInterval is how often the access recording of a mount is
+// saved while it is mounted.
+const accessSaveInterval = 10 * time.Second
+
+// MountArgs describes a worktree to mount. It is sent as is to the
+// daemon, so every field is exported.
+type MountArgs struct {
+	GitDir   string
+	Name     string
+	Revision string
+	Debug    bool
+
+	UpperDir  string
+	Ephemeral bool
+
+	Lazy        bool
+	Disk        bool
+	TempDir     string
+	CacheSize   uint64
+	ObjectStore string
+
+	Prefetch        string
+	PrefetchWorkers int
+	Autosnapshot    time.Duration
+	RecordAccess    string
+
+	LogFormat  string
+	LogFile    string
+	LogMaxSize int64
+	LogBackups int
+	SlowOp     time.Duration
+
+	Watchdog fs.WatchdogOptions
+
+	Portable        bool
+	EntryTtl        float64
+	NegativeTtl     float64
+	DeletionDirname string
+}
+
+// mountedWorktree is a worktree served by this process.
+type mountedWorktree struct {
+	name       string
+	worktree   string
+	mountpoint string
+	revision   string
+	cfg        *worktrees.Config
+
+	server   *fuse.Server
+	ctl      *controlServer
+	log      *logging.Logger
+	recorder *fs.AccessRecorder
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// mountWorktree mounts the overlay of the upper dir on the tree of
+// args.Revision read from repo. The returned worktree is not served yet.
+func mountWorktree(repo *fs.Repository, args *MountArgs) (_ *mountedWorktree, err error) {
+	mp := getMountpoint(args.GitDir, args.Name)
+	worktree := getWorktree(args.GitDir, args.Name)
+
+	if err := prepareMountpoint(mp, args.GitDir, args.Name); err != nil {
+		return nil, err
+	}
+
+	cfg, err := worktreeConfig(repo, args, worktree)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateUpper(cfg, worktree); err != nil {
+		return nil, fmt.Errorf("migrate upper dir: %v", err)
+	}
+
+	logger, err := openWorktreeLog(worktree, args)
+	if err != nil {
+		return nil, fmt.Errorf("log: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			logger.Close()
+		}
+	}()
+
+	tempDir, err := ioutil.TempDir("", args.TempDir)
+	if err != nil {
+		return nil, fmt.Errorf("TempDir: %v", err)
+	}
+
+	opts := &fs.GitFSOptions{
+		Lazy:       args.Lazy,
+		Disk:       args.Disk,
+		TempDir:    tempDir,
+		CacheSize:  args.CacheSize << 20,
+		SparseFile: getSparseFile(worktree),
+		Log:        logger.Entry,
+	}
+
+	root, err := repo.NewTreeFS(cfg.Commit, worktree, opts)
+	if err != nil {
+		return nil, fmt.Errorf("NewTreeFS: %v", err)
+	}
+
+	ofs, err := fs.NewOverlayFS(root, cfg.Layer(), args.Name)
+	if err != nil {
+		return nil, fmt.Errorf("NewOverlayFS: %v", err)
+	}
+
+	var recorder *fs.AccessRecorder
+	if args.RecordAccess != "" {
+		if recorder, err = fs.OpenAccessRecorder(args.RecordAccess); err != nil {
+			return nil, fmt.Errorf("record access: %v", err)
+		}
+	}
+	interrupts := fs.NewInterrupts()
+	ifs := fs.NewInstrumentedFS(ofs, fs.InstrumentOptions{
+		Worktree:   args.Name,
+		Recorder:   recorder,
+		Log:        logger.Entry,
+		SlowOp:     args.SlowOp,
+		Lower:      root,
+		Watchdog:   args.Watchdog,
+		Interrupts: interrupts,
+	})
+
+	nodeFs := pathfs.NewPathNodeFs(ifs, &pathfs.PathNodeFsOptions{ClientInodes: true})
+	mOpts := nodefs.Options{
+		EntryTimeout:    time.Duration(args.EntryTtl * float64(time.Second)),
+		AttrTimeout:     time.Duration(args.EntryTtl * float64(time.Second)),
+		NegativeTimeout: time.Duration(args.NegativeTtl * float64(time.Second)),
+		PortableInodes:  args.Portable,
+		Owner: &fuse.Owner{
+			Uid: uint32(os.Getuid()),
+			Gid: uint32(os.Getgid()),
+		},
+		Debug: args.Debug,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctl, err := startControl(ctx, args.GitDir, args.Name, mp, worktree, root, ofs, nodeFs)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("control socket: %v", err)
+	}
+
+	server, err := mount(mp, nodeFs.Root(), interrupts, fuseMountOptions(args.GitDir, args.Name, args.Debug), &mOpts)
+	if err != nil {
+		ctl.Close()
+		cancel()
+		return nil, fmt.Errorf("mount: %v", err)
+	}
+
+	// The args stay in the admin dir while the worktree is mounted, for a
+	// supervisor to mount it again if its server dies.
+	if err := saveMountArgs(worktree, args); err != nil {
+		log.Warnf("save mount args of %s: %v", args.Name, err)
+	}
+
+	if args.Prefetch != "" {
+		paths, err := readPathList(args.Prefetch)
+		if err != nil {
+			log.Errorf("read prefetch list %s: %v", args.Prefetch, err)
+		} else {
+			ctl.prefetch(paths, args.PrefetchWorkers)
+		}
+	}
+
+	if args.Autosnapshot > 0 {
+		go ctl.autosnapshot(args.Autosnapshot)
+	}
+	if recorder != nil {
+		go saveAccesses(ctx, recorder)
+	}
+
+	return &mountedWorktree{
+		name:       args.Name,
+		worktree:   worktree,
+		mountpoint: mp,
+		revision:   args.Revision,
+		cfg:        cfg,
+		server:     server,
+		ctl:        ctl,
+		log:        logger,
+		recorder:   recorder,
+		cancel:     cancel,
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// worktreeConfig returns the config recorded in the admin dir, resolving
+// the base commit when the worktree is new or was added with a different
+// revision, and picking its upper dir. A remount keeps the commit and the
+// upper dir recorded before.
+func worktreeConfig(repo *fs.Repository, args *MountArgs, worktree string) (*worktrees.Config, error) {
+	cfg, err := worktrees.LoadConfig(worktree)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("worktree config: %v", err)
+	}
+	if err != nil {
+		cfg = &worktrees.Config{Name: args.Name}
+	}
+	if cfg.Revision != args.Revision || cfg.Commit == "" {
+		commit, err := repo.ResolveCommit(args.Revision)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Revision, cfg.Commit = args.Revision, commit.String()
+	}
+
+	switch {
+	case args.UpperDir != "":
+		cfg.Upper, cfg.Ephemeral = args.UpperDir, false
+	case args.Ephemeral || cfg.Ephemeral:
+		// An ephemeral upper dir left behind by a mount that died is
+		// picked up again.
+		if _, err := os.Stat(cfg.Upper); !cfg.Ephemeral || err != nil {
+			if cfg.Upper, err = ephemeralUpper(args.Name); err != nil {
+				return nil, fmt.Errorf("ephemeral upper dir: %v", err)
+			}
+		}
+		cfg.Ephemeral = true
+	case cfg.Upper == "":
+		cfg.Upper = getUpperDir(args.GitDir, args.Name)
+	}
+	if args.DeletionDirname != "" {
+		cfg.DeletionDirName = args.DeletionDirname
+	}
+
+	if err := cfg.Save(worktree); err != nil {
+		return nil, fmt.Errorf("save worktree config: %v", err)
+	}
+	return cfg, nil
+}
+
+// saveAccesses saves the access recording of a mount now and then, so
+// that a mount that dies loses little of it.
+func saveAccesses(ctx context.Context, recorder *fs.AccessRecorder) {
+	ticker := time.NewTicker(accessSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := recorder.Save(); err != nil {
+			log.Errorf("save access recording: %v", err)
+		}
+	}
+}
+
+func saveMountArgs(worktree string, args *MountArgs) error {
+	data, err := json.MarshalIndent(args, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(getMountArgsFile(worktree), append(data, '\n'), 0644)
+}
+
+func loadMountArgs(worktree string) (*MountArgs, error) {
+	data, err := ioutil.ReadFile(getMountArgsFile(worktree))
+	if err != nil {
+		return nil, err
+	}
+	args := &MountArgs{}
+	return args, json.Unmarshal(data, args)
+}
+
+// ephemeralUpper creates a private upper dir in memory backed storage if
+// there is any.
+func ephemeralUpper(name string) (string, error) {
+	dir := ""
+	if fi, err := os.Stat("/dev/shm"); err == nil && fi.IsDir() {
+		dir = "/dev/shm"
+	}
+	return ioutil.TempDir(dir, ephemeralPrefix(name))
+}
+
+// ephemeralPrefix is what the names of the ephemeral upper dirs of the
+// worktree name start with.
+func ephemeralPrefix(name string) string {
+	return "git-fuse-worktree-" + name + "-"
+}
+
+// serve handles requests until the worktree is unmounted.
+func (m *mountedWorktree) serve() {
+	defer close(m.done)
+	m.server.Serve()
+	m.cancel()
+	m.ctl.Close()
+	if err := os.Remove(getMountArgsFile(m.worktree)); err != nil && !os.IsNotExist(err) {
+		log.Errorf("remove mount args of %s: %v", m.name, err)
+	}
+	if m.recorder != nil {
+		if err := m.recorder.Save(); err != nil {
+			log.Errorf("save access recording of %s: %v", m.name, err)
+		}
+	}
+	if m.cfg.Ephemeral {
+		if err := os.RemoveAll(m.cfg.Upper); err != nil {
+			log.Errorf("remove ephemeral upper dir %s: %v", m.cfg.Upper, err)
+		}
+	}
+	m.log.Close()
+}
+
+func (m *mountedWorktree) unmount() error {
+	if err := m.server.Unmount(); err != nil {
+		return err
+	}
+	<-m.done
+	return nil
+}
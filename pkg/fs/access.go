@@ -0,0 +1,208 @@
+package fs
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Access is what an access recording keeps about a path.
+type Access struct {
+	Path string `json:"path"`
+	// First is the position of the first access to the path among those
+	// to every path of the recording, starting at 1.
+	First int  `json:"first"`
+	Count int  `json:"count"`
+	Dir   bool `json:"dir,omitempty"`
+	// Opened is set once the contents were opened, not only looked up.
+	Opened bool `json:"opened,omitempty"`
+}
+
+// AccessRecorder records the paths of a worktree the kernel looks up and
+// opens, to be saved as one JSON object per line.
+type AccessRecorder struct {
+	file string
+
+	mu    sync.Mutex
+	paths map[string]*Access
+	dirty bool
+}
+
+// OpenAccessRecorder returns a recorder saving to file. The accesses
+// already recorded there are kept, so that the recording goes on across
+// mounts.
+func OpenAccessRecorder(file string) (*AccessRecorder, error) {
+	r := &AccessRecorder{file: file, paths: map[string]*Access{}}
+	accesses, err := LoadAccesses(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for i := range accesses {
+		r.paths[accesses[i].Path] = &accesses[i]
+	}
+	return r, nil
+}
+
+func (r *AccessRecorder) record(name string, dir, opened bool) {
+	if name == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	a, ok := r.paths[name]
+	if !ok {
+		a = &Access{Path: name, First: len(r.paths) + 1}
+		r.paths[name] = a
+	}
+	a.Count++
+	a.Dir = dir
+	a.Opened = a.Opened || opened
+	r.dirty = true
+}
+
+// Accesses returns the recorded accesses in the order of their first
+// access.
+func (r *AccessRecorder) Accesses() []Access {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	accesses := make([]Access, 0, len(r.paths))
+	for _, a := range r.paths {
+		accesses = append(accesses, *a)
+	}
+	sort.Slice(accesses, func(i, j int) bool { return accesses[i].First < accesses[j].First })
+	return accesses
+}
+
+// Save writes the recording to its file if anything was recorded since
+// the last save. The file is replaced at once so that readers never see
+// a partial recording.
+func (r *AccessRecorder) Save() error {
+	r.mu.Lock()
+	dirty := r.dirty
+	r.dirty = false
+	r.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(r.file), filepath.Base(r.file)+".*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, a := range r.Accesses() {
+		if err = enc.Encode(a); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), r.file)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+	}
+	return err
+}
+
+// ReadAccesses reads a recording written by an AccessRecorder.
+func ReadAccesses(r io.Reader) ([]Access, error) {
+	var accesses []Access
+	dec := json.NewDecoder(r)
+	for {
+		var a Access
+		if err := dec.Decode(&a); err == io.EOF {
+			return accesses, nil
+		} else if err != nil {
+			return nil, err
+		}
+		accesses = append(accesses, a)
+	}
+}
+
+// LoadAccesses reads the recording in file.
+func LoadAccesses(file string) ([]Access, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadAccesses(f)
+}
+
+// MergeAccesses merges recordings of several runs. Counts add up; paths
+// come in the order of their first access in the first recording that
+// has them, the recordings taken in turn.
+func MergeAccesses(recordings ...[]Access) []Access {
+	var merged []Access
+	index := map[string]int{}
+	for _, accesses := range recordings {
+		for _, a := range accesses {
+			i, ok := index[a.Path]
+			if !ok {
+				index[a.Path] = len(merged)
+				a.First = len(merged) + 1
+				merged = append(merged, a)
+				continue
+			}
+			merged[i].Count += a.Count
+			merged[i].Opened = merged[i].Opened || a.Opened
+		}
+	}
+	return merged
+}
+
+// ConeDirs returns the smallest set of directories a cone mode sparse
+// checkout has to include for every file of accesses to be visible, with
+// dirs cut down to at most depth levels if depth is positive. Files at the
+// top level are always part of a cone.
+func ConeDirs(accesses []Access, depth int) []string {
+	dirs := map[string]bool{}
+	for _, a := range accesses {
+		if a.Dir {
+			continue
+		}
+		dir := path.Dir(a.Path)
+		if dir == "." {
+			continue
+		}
+		if depth > 0 {
+			for n := strings.Count(dir, "/") + 1; n > depth; n-- {
+				dir = path.Dir(dir)
+			}
+		}
+		dirs[dir] = true
+	}
+
+	var cone []string
+	for dir := range dirs {
+		covered := false
+		for p := path.Dir(dir); p != "."; p = path.Dir(p) {
+			if dirs[p] {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			cone = append(cone, dir)
+		}
+	}
+	sort.Strings(cone)
+	return cone
+}
@@ -1,90 +1,111 @@
 package fs
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/filemode"
-	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
 )
 
 type blobNode struct {
 	gitNode
 
-	blob *object.Blob
+	// missing is set for blobs not in the object store.
+	missing bool
 
 	size uint64
 }
 
-func (t *treeFS) newBlobNode(name string, oid plumbing.Hash, mode filemode.FileMode) (*blobNode, error) {
-	blob, err := t.repository.BlobObject(oid)
-	if err != nil {
-		if err == plumbing.ErrObjectNotFound {
-			// TODO fetch from remote
-			return &blobNode{
-				gitNode: gitNode{
-					fs:         t,
-					name:       name,
-					oid:        oid,
-					mode:       uint32(mode),
-					FileSystem: pathfs.NewDefaultFileSystem(),
-					time:       time.Now(),
-				},
-			}, nil
-		}
-		return nil, err
-	}
-
-	return &blobNode{
+func (t *treeFS) newBlobNode(parent, name string, oid plumbing.Hash, mode filemode.FileMode) (*blobNode, error) {
+	n := &blobNode{
 		gitNode: gitNode{
 			fs:         t,
 			name:       name,
+			path:       path.Join(parent, name),
 			oid:        oid,
 			mode:       uint32(mode),
 			FileSystem: pathfs.NewDefaultFileSystem(),
 			time:       time.Now(),
 		},
-		blob: blob,
-		size: uint64(blob.Size),
-	}, nil
+	}
+	size, err := t.store.BlobSize(oid)
+	if err != nil {
+		if err == plumbing.ErrObjectNotFound {
+			// TODO fetch from remote
+			n.missing = true
+			return n, nil
+		}
+		return nil, err
+	}
+	n.size = uint64(size)
+	return n, nil
+}
+
+// readContents returns the decompressed contents of the blob, going
+// through the shared content cache. It gives up once ctx is done.
+func (n *blobNode) readContents(ctx context.Context) ([]byte, error) {
+	if contents, ok := n.fs.cache.get(n.oid); ok {
+		cacheHits.With(memoryCache).Inc()
+		return contents, nil
+	}
+	cacheMisses.With(memoryCache).Inc()
+	if n.missing {
+		missingObjects.Inc()
+		return nil, plumbing.ErrObjectNotFound
+	}
+	reader, err := n.fs.store.Blob(n.oid)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	contents, err := ioutil.ReadAll(contextReader{ctx, reader})
+	if err != nil {
+		return nil, err
+	}
+	blobBytes.Add(uint64(len(contents)))
+	n.fs.cache.put(n.oid, contents)
+	return contents, nil
 }
 
 type memoryFile struct {
 	sync.Mutex
 	nodefs.File
-	blob     *object.Blob
+	load     func() ([]byte, error)
 	contents []byte
 }
 
 func (f *memoryFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
 	f.Lock()
 	if f.contents == nil {
-		reader, err := f.blob.Reader()
-		if err != nil {
-			return nil, fuse.EIO
-		}
-		contents, err := ioutil.ReadAll(reader)
+		contents, err := f.load()
 		if err != nil {
 			f.Unlock()
 			return nil, fuse.EIO
 		}
 		f.contents = contents
 	}
+	contents := f.contents
 	f.Unlock()
+	if off >= int64(len(contents)) {
+		return fuse.ReadResultData(nil), fuse.OK
+	}
 	end := off + int64(len(dest))
-	if end > int64(len(f.contents)) {
-		end = int64(len(f.contents))
+	if end > int64(len(contents)) {
+		end = int64(len(contents))
 	}
-	return fuse.ReadResultData(f.contents[off:end]), fuse.OK
+	return fuse.ReadResultData(contents[off:end]), fuse.OK
 }
 
 func (f *memoryFile) Release() {
@@ -93,35 +114,117 @@ func (f *memoryFile) Release() {
 	f.contents = nil
 }
 
-func (n *blobNode) LoadMemory() (nodefs.File, error) {
+func (n *blobNode) LoadMemory(ctx context.Context) (nodefs.File, error) {
+	contents, err := n.readContents(ctx)
+	if err != nil {
+		return nil, err
+	}
 	return &memoryFile{
 		File: nodefs.NewDefaultFile(),
-		blob: n.blob,
+		load: func() ([]byte, error) {
+			return n.readContents(context.Background())
+		},
+		contents: contents,
 	}, nil
 }
 
+// lazyBlobFile loads the blob on the first read.
 type lazyBlobFile struct {
-	mu sync.Mutex
 	nodefs.File
-	ctor func() (nodefs.File, error)
+	ctor func(ctx context.Context) (nodefs.File, error)
 	node *blobNode
+
+	mu      sync.Mutex
+	loading *blobLoad
+}
+
+// blobLoad is a load of the file of a lazyBlobFile, shared by the reads
+// waiting for it. It is canceled once all of them were interrupted.
+type blobLoad struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+
+	file nodefs.File
+	err  error
 }
 
 func (f *lazyBlobFile) SetInode(n *nodefs.Inode) {
 }
 
 func (f *lazyBlobFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	return f.ReadInterruptible(nil, dest, off)
+}
+
+func (f *lazyBlobFile) ReadInterruptible(cancel <-chan struct{}, dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	g, code := f.open(cancel)
+	if !code.Ok() {
+		return nil, code
+	}
+	return g.Read(dest, off)
+}
+
+// open returns the file of the blob, loading it first if needed. The read
+// gives up on the load with EINTR once cancel is closed, the load itself
+// goes on as long as another read waits for it.
+func (f *lazyBlobFile) open(cancel <-chan struct{}) (nodefs.File, fuse.Status) {
 	f.mu.Lock()
-	defer f.mu.Unlock()
-	if f.File == nil {
-		g, err := f.ctor()
-		if err != nil {
-			log.Printf("opening blob for %s: %v", f.node.oid, err)
-			return nil, fuse.EIO
+	if f.File != nil {
+		g := f.File
+		f.mu.Unlock()
+		return g, fuse.OK
+	}
+	l := f.loading
+	if l == nil {
+		ctx, cancelLoad := context.WithCancel(context.Background())
+		l = &blobLoad{done: make(chan struct{}), cancel: cancelLoad}
+		f.loading = l
+		go f.load(ctx, l)
+	}
+	l.waiters++
+	f.mu.Unlock()
+
+	select {
+	case <-l.done:
+	case <-cancel:
+		f.mu.Lock()
+		l.waiters--
+		if l.waiters == 0 && f.loading == l {
+			f.loading = nil
+			l.cancel()
 		}
-		f.File = g
+		f.mu.Unlock()
+		return nil, fuse.EINTR
+	}
+	if l.err != nil {
+		return nil, fuse.EIO
+	}
+	return l.file, fuse.OK
+}
+
+// load runs the load l, keeping its file unless nobody waits for it
+// anymore.
+func (f *lazyBlobFile) load(ctx context.Context, l *blobLoad) {
+	file, err := f.ctor(ctx)
+	f.mu.Lock()
+	wanted := f.loading == l
+	if wanted {
+		f.loading = nil
+		if err == nil {
+			f.File = file
+		}
+	}
+	l.file, l.err = file, err
+	f.mu.Unlock()
+	l.cancel()
+	close(l.done)
+
+	switch {
+	case !wanted && file != nil:
+		file.Release()
+	case wanted && err != nil:
+		f.node.fs.logOp("Read", f.node.path, f.node.oid).WithField(logging.FieldStatus, "EIO").Errorf("open blob: %v", err)
 	}
-	return f.File.Read(dest, off)
 }
 
 func (f *lazyBlobFile) GetAttr(out *fuse.Attr) fuse.Status {
@@ -141,29 +244,64 @@ func (f *lazyBlobFile) Flush() fuse.Status {
 func (f *lazyBlobFile) Release() {
 	f.mu.Lock()
 	defer f.mu.Unlock()
+	if f.loading != nil {
+		f.loading.cancel()
+		f.loading = nil
+	}
 	if f.File != nil {
 		f.File.Release()
 	}
 }
 
-func (n *blobNode) LoadDisk() (nodefs.File, error) {
-	p := filepath.Join(n.fs.opts.TempDir, n.oid.String())
-	if _, err := os.Lstat(p); os.IsNotExist(err) {
-		reader, err := n.blob.Reader()
-		if err != nil {
-			return nil, err
-		}
+func (n *blobNode) diskPath() string {
+	return filepath.Join(n.fs.opts.TempDir, n.oid.String())
+}
 
-		f, err := os.Create(p)
-		if err != nil {
-			return nil, err
-		}
-		_, err = io.Copy(f, reader)
-		if err != nil {
-			return nil, err
+// writeDisk extracts the blob into the temp dir unless it is already
+// there. The file is renamed into place so readers never see a partial
+// copy. It gives up once ctx is done.
+func (n *blobNode) writeDisk(ctx context.Context) error {
+	p := n.diskPath()
+	if _, err := os.Lstat(p); !os.IsNotExist(err) {
+		if err == nil {
+			cacheHits.With(diskCache).Inc()
 		}
+		return err
+	}
+	cacheMisses.With(diskCache).Inc()
+	if n.missing {
+		missingObjects.Inc()
+		return plumbing.ErrObjectNotFound
+	}
+	reader, err := n.fs.store.Blob(n.oid)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	f, err := ioutil.TempFile(n.fs.opts.TempDir, n.oid.String()+".*")
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(f, contextReader{ctx, reader})
+	blobBytes.Add(uint64(written))
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err = f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), p)
+}
+
+func (n *blobNode) LoadDisk(ctx context.Context) (nodefs.File, error) {
+	if err := n.writeDisk(ctx); err != nil {
+		return nil, err
 	}
-	f, err := os.Open(p)
+	f, err := os.Open(n.diskPath())
 	if err != nil {
 		return nil, err
 	}
@@ -182,9 +320,11 @@ func (n *blobNode) Open(name string, flags uint32, context *fuse.Context) (file
 	}
 
 	if !n.fs.opts.Lazy {
-		f, err := ctor()
+		f, err := ctor(requestContext(context))
 		if err != nil {
-			return nil, fuse.ToStatus(err)
+			code := fuse.ToStatus(err)
+			n.fs.logOp("Open", n.path, n.oid).WithField(logging.FieldStatus, statusName(code)).Errorf("open blob: %v", err)
+			return nil, code
 		}
 		return f, fuse.OK
 	}
@@ -214,6 +354,7 @@ func (t *treeFS) newMockBlobNode(name string, contents []byte) (*mockBlobNode, e
 		gitNode: gitNode{
 			fs:         t,
 			name:       name,
+			path:       name,
 			mode:       uint32(fuse.S_IFREG),
 			FileSystem: pathfs.NewDefaultFileSystem(),
 			time:       time.Now(),
@@ -233,6 +374,7 @@ func (n *mockBlobNode) Open(name string, flags uint32, context *fuse.Context) (f
 
 	return &memoryFile{
 		File:     nodefs.NewDefaultFile(),
+		load:     func() ([]byte, error) { return n.contents, nil },
 		contents: n.contents,
 	}, fuse.OK
 }
@@ -0,0 +1,132 @@
+package fs
+
+import (
+	"container/list"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+type cacheEntry struct {
+	oid      plumbing.Hash
+	contents []byte
+}
+
+// contentCache keeps decompressed blob contents in memory, evicting the
+// least recently used blobs once the total size exceeds max.
+type contentCache struct {
+	sync.Mutex
+
+	max     uint64
+	size    uint64
+	lru     *list.List
+	entries map[plumbing.Hash]*list.Element
+}
+
+func newContentCache(max uint64) *contentCache {
+	return &contentCache{
+		max:     max,
+		lru:     list.New(),
+		entries: map[plumbing.Hash]*list.Element{},
+	}
+}
+
+func (c *contentCache) get(oid plumbing.Hash) ([]byte, bool) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[oid]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*cacheEntry).contents, true
+}
+
+func (c *contentCache) has(oid plumbing.Hash) bool {
+	c.Lock()
+	defer c.Unlock()
+	_, ok := c.entries[oid]
+	return ok
+}
+
+func (c *contentCache) put(oid plumbing.Hash, contents []byte) {
+	if uint64(len(contents)) > c.max {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[oid]; ok {
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.entries[oid] = c.lru.PushFront(&cacheEntry{oid: oid, contents: contents})
+	c.size += uint64(len(contents))
+	for c.size > c.max {
+		e := c.lru.Back()
+		ent := e.Value.(*cacheEntry)
+		c.lru.Remove(e)
+		delete(c.entries, ent.oid)
+		c.size -= uint64(len(ent.contents))
+	}
+}
+
+// CacheStats describes what the blob caches hold.
+type CacheStats struct {
+	Entries int    `json:"entries"`
+	Bytes   uint64 `json:"bytes"`
+	Max     uint64 `json:"max"`
+
+	DiskEntries int    `json:"disk_entries"`
+	DiskBytes   uint64 `json:"disk_bytes"`
+}
+
+func (c *contentCache) stats() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	return CacheStats{Entries: len(c.entries), Bytes: c.size, Max: c.max}
+}
+
+// clear drops every blob, returning what was dropped.
+func (c *contentCache) clear() CacheStats {
+	c.Lock()
+	defer c.Unlock()
+	s := CacheStats{Entries: len(c.entries), Bytes: c.size, Max: c.max}
+	c.lru.Init()
+	c.entries = map[plumbing.Hash]*list.Element{}
+	c.size = 0
+	return s
+}
+
+// diskCache counts the blobs extracted into the temp dir, removing them
+// if remove is set. Extractions still in progress are left alone.
+func (t *treeFS) diskCache(remove bool) (int, uint64, error) {
+	if t.opts.TempDir == "" {
+		return 0, 0, nil
+	}
+	infos, err := ioutil.ReadDir(t.opts.TempDir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var (
+		n    int
+		size uint64
+	)
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() || strings.Contains(fi.Name(), ".") {
+			continue
+		}
+		if remove {
+			// Open files keep reading the removed copy.
+			if err := os.Remove(filepath.Join(t.opts.TempDir, fi.Name())); err != nil {
+				return n, size, err
+			}
+		}
+		n++
+		size += uint64(fi.Size())
+	}
+	return n, size, nil
+}
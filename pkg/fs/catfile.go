@@ -0,0 +1,304 @@
+package fs
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// DefaultCatFileProcs is the number of git cat-file processes of each
+// kind the cat-file object store keeps running.
+const DefaultCatFileProcs = 4
+
+// catFileProc is a long-lived "git cat-file --batch" or "--batch-check"
+// process. It answers one request at a time.
+type catFileProc struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startCatFile(gitdir, mode string) (*catFileProc, error) {
+	cmd := exec.Command("git", "-C", gitdir, "cat-file", mode)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &catFileProc{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+// header asks for an object and parses the "<oid> <type> <size>" reply.
+func (p *catFileProc) header(name string) (plumbing.Hash, string, int64, error) {
+	if _, err := io.WriteString(p.stdin, name+"\n"); err != nil {
+		return plumbing.ZeroHash, "", 0, err
+	}
+	line, err := p.stdout.ReadString('\n')
+	if err != nil {
+		return plumbing.ZeroHash, "", 0, err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 2 && fields[1] == "missing" {
+		return plumbing.ZeroHash, "", 0, plumbing.ErrObjectNotFound
+	}
+	if len(fields) != 3 {
+		return plumbing.ZeroHash, "", 0, fmt.Errorf("cat-file: unexpected reply %q", line)
+	}
+	size, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return plumbing.ZeroHash, "", 0, fmt.Errorf("cat-file: unexpected reply %q", line)
+	}
+	return plumbing.NewHash(fields[0]), fields[1], size, nil
+}
+
+func (p *catFileProc) close() {
+	p.stdin.Close()
+	p.cmd.Wait()
+}
+
+// catFilePool hands out processes of one kind, starting them on demand.
+type catFilePool struct {
+	gitdir string
+	mode   string
+	procs  chan *catFileProc
+	slots  chan struct{}
+
+	mu     sync.Mutex
+	all    map[*catFileProc]bool
+	closed bool
+}
+
+func newCatFilePool(gitdir, mode string, size int) *catFilePool {
+	return &catFilePool{
+		gitdir: gitdir,
+		mode:   mode,
+		procs:  make(chan *catFileProc, size),
+		slots:  make(chan struct{}, size),
+		all:    map[*catFileProc]bool{},
+	}
+}
+
+func (p *catFilePool) get() (*catFileProc, error) {
+	select {
+	case proc := <-p.procs:
+		return proc, nil
+	default:
+	}
+	select {
+	case proc := <-p.procs:
+		return proc, nil
+	case p.slots <- struct{}{}:
+	}
+	proc, err := startCatFile(p.gitdir, p.mode)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		proc.close()
+		return nil, fmt.Errorf("cat-file: store is closed")
+	}
+	p.all[proc] = true
+	return proc, nil
+}
+
+// put returns a process to the pool. A process that failed mid-request
+// is out of sync with its output and is stopped instead.
+func (p *catFilePool) put(proc *catFileProc, broken bool) {
+	if !broken {
+		p.procs <- proc
+		return
+	}
+	p.mu.Lock()
+	delete(p.all, proc)
+	p.mu.Unlock()
+	proc.close()
+	<-p.slots
+}
+
+func (p *catFilePool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for proc := range p.all {
+		proc.close()
+	}
+	p.all = nil
+}
+
+// catFileStore reads objects through pools of git cat-file processes,
+// which understand every repository format git itself does.
+type catFileStore struct {
+	batch *catFilePool
+	check *catFilePool
+}
+
+func newCatFileStore(gitdir string, procs int) (*catFileStore, error) {
+	s := &catFileStore{
+		batch: newCatFilePool(gitdir, "--batch", procs),
+		check: newCatFilePool(gitdir, "--batch-check", procs),
+	}
+	// Fail early on something that is not a repository: git starts
+	// anyway, and only exits once asked for an object.
+	proc, err := s.check.get()
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, err = proc.header("HEAD")
+	if err != nil && err != plumbing.ErrObjectNotFound {
+		s.check.put(proc, true)
+		return nil, fmt.Errorf("cat-file: %s is not a repository", gitdir)
+	}
+	s.check.put(proc, false)
+	return s, nil
+}
+
+func (s *catFileStore) info(name string) (plumbing.Hash, string, int64, error) {
+	proc, err := s.check.get()
+	if err != nil {
+		return plumbing.ZeroHash, "", 0, err
+	}
+	oid, typ, size, err := proc.header(name)
+	s.check.put(proc, err != nil && err != plumbing.ErrObjectNotFound)
+	return oid, typ, size, err
+}
+
+// open starts reading an object of the expected type. The returned
+// reader gives the process back to the pool once closed.
+func (s *catFileStore) open(oid plumbing.Hash, typ string) (*catFileReader, error) {
+	proc, err := s.batch.get()
+	if err != nil {
+		return nil, err
+	}
+	_, gotType, size, err := proc.header(oid.String())
+	if err != nil {
+		s.batch.put(proc, err != plumbing.ErrObjectNotFound)
+		return nil, err
+	}
+	r := &catFileReader{pool: s.batch, proc: proc, remaining: size}
+	if gotType != typ {
+		r.Close()
+		return nil, plumbing.ErrObjectNotFound
+	}
+	return r, nil
+}
+
+func (s *catFileStore) ResolveCommit(revision string) (plumbing.Hash, error) {
+	oid, _, _, err := s.info(revision + "^{commit}")
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("resolve revision: %v", err)
+	}
+	return oid, nil
+}
+
+func (s *catFileStore) ResolveTree(revision string) (plumbing.Hash, error) {
+	oid, _, _, err := s.info(revision + "^{tree}")
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("resolve revision: %v", err)
+	}
+	return oid, nil
+}
+
+func (s *catFileStore) Tree(oid plumbing.Hash) ([]object.TreeEntry, error) {
+	r, err := s.open(oid, "tree")
+	if err != nil {
+		return nil, err
+	}
+	contents, err := ioutil.ReadAll(r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	obj := &plumbing.MemoryObject{}
+	obj.SetType(plumbing.TreeObject)
+	obj.Write(contents)
+	var tree object.Tree
+	if err := tree.Decode(obj); err != nil {
+		return nil, err
+	}
+	return tree.Entries, nil
+}
+
+func (s *catFileStore) BlobSize(oid plumbing.Hash) (int64, error) {
+	_, typ, size, err := s.info(oid.String())
+	if err != nil {
+		return 0, err
+	}
+	if typ != "blob" {
+		return 0, plumbing.ErrObjectNotFound
+	}
+	return size, nil
+}
+
+func (s *catFileStore) Blob(oid plumbing.Hash) (io.ReadCloser, error) {
+	return s.open(oid, "blob")
+}
+
+func (s *catFileStore) Close() error {
+	s.batch.close()
+	s.check.close()
+	return nil
+}
+
+// catFileReader streams one object from a --batch process.
+type catFileReader struct {
+	pool      *catFilePool
+	proc      *catFileProc
+	remaining int64
+	err       error
+}
+
+func (r *catFileReader) Read(p []byte) (int, error) {
+	if r.proc == nil {
+		return 0, io.ErrClosedPipe
+	}
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.proc.stdout.Read(p)
+	r.remaining -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// Close skips what was not read, including the newline git prints after
+// every object, and hands the process back.
+func (r *catFileReader) Close() error {
+	if r.proc == nil {
+		return nil
+	}
+	proc := r.proc
+	r.proc = nil
+	if r.err == nil {
+		_, r.err = io.CopyN(ioutil.Discard, proc.stdout, r.remaining+1)
+	}
+	r.pool.put(proc, r.err != nil)
+	return nil
+}
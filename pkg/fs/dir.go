@@ -2,6 +2,7 @@ package fs
 
 import (
 	"fmt"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
@@ -9,25 +10,25 @@ import (
 	"time"
 
 	"github.com/go-git/go-git/v5/plumbing"
-	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
-	log "github.com/sirupsen/logrus"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
 )
 
 type dirNode struct {
 	sync.Mutex
 	gitNode
 
-	tree        *object.Tree
+	loaded      bool
 	children    []gitEntry
 	childrenMap map[string]gitEntry
 
 	parents []fuse.DirEntry
 }
 
-func (t *treeFS) newDirNode(gitdir, worktree, name string, oid plumbing.Hash) *dirNode {
+func (t *treeFS) newDirNode(gitdir, worktree, parent, name string, oid plumbing.Hash) *dirNode {
 	var (
 		parents     []fuse.DirEntry
 		ino         uint64
@@ -39,22 +40,22 @@ func (t *treeFS) newDirNode(gitdir, worktree, name string, oid plumbing.Hash) *d
 		st := syscall.Stat_t{}
 		err := syscall.Lstat(gitdir, &st)
 		if err != nil {
-			log.Errorf("get root %s stat: %s", gitdir, err)
+			t.log.Errorf("get root %s stat: %s", gitdir, err)
 		} else {
 			ino = st.Ino
 			mode = uint32(st.Mode)
-			parents = append(parents, fuse.DirEntry{mode, ".", ino})
+			parents = append(parents, fuse.DirEntry{Mode: mode, Name: ".", Ino: ino})
 			dir := filepath.Dir(gitdir)
 			err = syscall.Lstat(dir, &st)
 			if err != nil {
-				log.Errorf("get root %s stat: %s", dir, err)
+				t.log.Errorf("get root %s stat: %s", dir, err)
 			} else {
-				parents = append(parents, fuse.DirEntry{uint32(st.Mode), "..", st.Ino})
+				parents = append(parents, fuse.DirEntry{Mode: uint32(st.Mode), Name: "..", Ino: st.Ino})
 			}
 		}
 		gitRoot, err := t.newMockBlobNode(".git", []byte(fmt.Sprintf("gitdir: %s", worktree)))
 		if err != nil {
-			log.Errorf("newMockBlobNode .git: %s", err)
+			t.log.Errorf("newMockBlobNode .git: %s", err)
 		} else {
 			children = append(children, gitRoot)
 			childrenMap[".git"] = gitRoot
@@ -66,6 +67,7 @@ func (t *treeFS) newDirNode(gitdir, worktree, name string, oid plumbing.Hash) *d
 			fs:         t,
 			inode:      ino,
 			name:       name,
+			path:       path.Join(parent, name),
 			oid:        oid,
 			mode:       mode,
 			time:       time.Now(),
@@ -80,62 +82,129 @@ func (n *dirNode) OnMount(nodeFs *pathfs.PathNodeFs) {
 	n.fs.onMount(nodeFs)
 }
 
-// Directory handling
-func (n *dirNode) getChildren() fuse.Status {
+// getChildren returns the entries of n, reading its tree object on first
+// use. The lock is held for the whole load, so concurrent first lookups
+// wait for a single read of the tree. Once loaded, the returned slice and
+// map are never modified again and may be used without the lock.
+func (n *dirNode) getChildren() ([]gitEntry, map[string]gitEntry, fuse.Status) {
 	n.Lock()
 	defer n.Unlock()
-	if n.tree == nil {
-		tree, err := n.fs.repository.TreeObject(n.oid)
-		if err != nil {
-			return fuse.ENOENT
-		}
-		n.tree = tree
-		var chNode gitEntry
-		for _, entry := range n.tree.Entries {
-			isdir := entry.Mode&syscall.S_IFDIR != 0
-			if isdir {
-				chNode = n.fs.newDirNode("", "", entry.Name, entry.Hash)
-			} else if entry.Mode&^07777 == syscall.S_IFLNK {
-				chNode = n.fs.newLinkNode(entry.Name, entry.Hash)
-			} else if entry.Mode&^07777 == syscall.S_IFREG {
-				chNode, err = n.fs.newBlobNode(entry.Name, entry.Hash, entry.Mode)
-				if err != nil {
-					panic(fmt.Sprintf("newBlobNode %s: %s", entry.Name, err))
-				}
-			} else {
-				panic(fmt.Sprintf("unexpected file %06o for %s\n", entry.Mode, entry.Hash))
+	if n.loaded {
+		return n.children, n.childrenMap, fuse.OK
+	}
+
+	entries, err := n.fs.store.Tree(n.oid)
+	if err != nil {
+		return nil, nil, fuse.ENOENT
+	}
+	children := append([]gitEntry{}, n.children...)
+	childrenMap := make(map[string]gitEntry, len(n.childrenMap)+len(entries))
+	for name, ch := range n.childrenMap {
+		childrenMap[name] = ch
+	}
+	var chNode gitEntry
+	for _, entry := range entries {
+		isdir := entry.Mode&syscall.S_IFDIR != 0
+		if isdir {
+			chNode = n.fs.newDirNode("", "", n.path, entry.Name, entry.Hash)
+		} else if entry.Mode&^07777 == syscall.S_IFLNK {
+			chNode = n.fs.newLinkNode(n.path, entry.Name, entry.Hash)
+		} else if entry.Mode&^07777 == syscall.S_IFREG {
+			chNode, err = n.fs.newBlobNode(n.path, entry.Name, entry.Hash, entry.Mode)
+			if err != nil {
+				panic(fmt.Sprintf("newBlobNode %s: %s", entry.Name, err))
 			}
-			n.children = append(n.children, chNode)
-			n.childrenMap[entry.Name] = chNode
+		} else {
+			panic(fmt.Sprintf("unexpected file %06o for %s\n", entry.Mode, entry.Hash))
+		}
+		children = append(children, chNode)
+		childrenMap[entry.Name] = chNode
+	}
+	n.children, n.childrenMap = children, childrenMap
+	n.loaded = true
+	return n.children, n.childrenMap, fuse.OK
+}
+
+// lookup returns the direct child of n called name.
+func (n *dirNode) lookup(name string) (gitEntry, fuse.Status) {
+	_, childrenMap, code := n.getChildren()
+	if code != fuse.OK {
+		return nil, code
+	}
+	child, ok := childrenMap[name]
+	if !ok || !n.fs.visible(child) {
+		return nil, fuse.ENOENT
+	}
+	return child, fuse.OK
+}
+
+func (n *dirNode) SetSparse(sparse *Sparse) []string {
+	var (
+		old     []bool
+		entries []gitEntry
+	)
+	collect := func() {
+		n.walkLoaded(func(e gitEntry) {
+			old = append(old, n.fs.visible(e))
+			entries = append(entries, e)
+		})
+	}
+	collect()
+
+	n.fs.sparseMu.Lock()
+	n.fs.sparse = sparse
+	n.fs.sparseMu.Unlock()
+
+	var changed []string
+	for i, e := range entries {
+		if n.fs.visible(e) != old[i] {
+			changed = append(changed, e.Path())
+		}
+	}
+	return changed
+}
+
+// walkLoaded calls fn for every entry below n whose directory has already
+// been read, without reading any new trees.
+func (n *dirNode) walkLoaded(fn func(gitEntry)) {
+	n.Lock()
+	if !n.loaded {
+		n.Unlock()
+		return
+	}
+	children := n.children
+	n.Unlock()
+	for _, ch := range children {
+		fn(ch)
+		if dir, ok := ch.(*dirNode); ok {
+			dir.walkLoaded(fn)
 		}
 	}
-	return fuse.OK
 }
 
 // Directory handling
 func (n *dirNode) OpenDir(name string, context *fuse.Context) (stream []fuse.DirEntry, code fuse.Status) {
 	defer func() {
-		log.Debugf("OpenDir current <%s> name <%s>: chilren: %v, status: %v", n.oid, name, len(stream), code)
+		n.fs.logOp("OpenDir", n.path, n.oid).WithField(logging.FieldStatus, statusName(code)).Debugf("name <%s>: %d entries", name, len(stream))
 	}()
-	if n.tree == nil {
-		if code = n.getChildren(); code != fuse.OK {
+	if name == "" {
+		var children []gitEntry
+		if children, _, code = n.getChildren(); code != fuse.OK {
 			return
 		}
-	}
-
-	if name == "" {
 		stream = append(stream, n.parents...)
-		for _, ch := range n.children {
-			stream = append(stream, fuse.DirEntry{ch.Mode(), ch.Name(), ch.Ino()})
+		for _, ch := range children {
+			if !n.fs.visible(ch) {
+				continue
+			}
+			stream = append(stream, fuse.DirEntry{Mode: ch.Mode(), Name: ch.Name(), Ino: ch.Ino()})
 		}
-		code = fuse.OK
 		return
 	}
 
 	rs := strings.SplitN(name, "/", 2)
-	child, ok := n.childrenMap[rs[0]]
-	if !ok {
-		code = fuse.ENOENT
+	var child gitEntry
+	if child, code = n.lookup(rs[0]); code != fuse.OK {
 		return
 	}
 	if child.Mode()&fuse.S_IFDIR == 0 {
@@ -150,7 +219,7 @@ func (n *dirNode) OpenDir(name string, context *fuse.Context) (stream []fuse.Dir
 
 func (n *dirNode) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr, code fuse.Status) {
 	defer func() {
-		log.Debugf("Getattr current <%s> name <%s> attr: %v, status: %v", n.oid, name, attr, code)
+		n.fs.logOp("GetAttr", n.path, n.oid).WithField(logging.FieldStatus, statusName(code)).Debugf("name <%s>: attr %v", name, attr)
 	}()
 	if name == "" {
 		attr = &fuse.Attr{Mode: n.mode, Size: 64, Ino: n.Ino(), Mtime: uint64(n.time.Unix()), Atime: uint64(n.time.Unix()), Ctime: uint64(n.time.Unix())}
@@ -158,16 +227,10 @@ func (n *dirNode) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr,
 		return
 	}
 
-	if n.tree == nil {
-		if code = n.getChildren(); code != fuse.OK {
-			return
-		}
-	}
-
 	rs := strings.SplitN(name, "/", 2)
-	child, ok := n.childrenMap[rs[0]]
-	if !ok {
-		return nil, fuse.ENOENT
+	child, code := n.lookup(rs[0])
+	if code != fuse.OK {
+		return nil, code
 	}
 	if len(rs) == 1 {
 		return child.GetAttr("", context)
@@ -177,18 +240,12 @@ func (n *dirNode) GetAttr(name string, context *fuse.Context) (attr *fuse.Attr,
 
 func (n *dirNode) Open(name string, flags uint32, context *fuse.Context) (file nodefs.File, code fuse.Status) {
 	defer func() {
-		log.Debugf("Open current <%s> name <%s>, status: %v", n.oid, name, code)
+		n.fs.logOp("Open", n.path, n.oid).WithField(logging.FieldStatus, statusName(code)).Debugf("name <%s>", name)
 	}()
-	if n.tree == nil {
-		if code = n.getChildren(); code != fuse.OK {
-			return nil, code
-		}
-	}
-
 	rs := strings.SplitN(name, "/", 2)
-	child, ok := n.childrenMap[rs[0]]
-	if !ok {
-		return nil, fuse.ENOENT
+	child, code := n.lookup(rs[0])
+	if code != fuse.OK {
+		return nil, code
 	}
 	if len(rs) == 1 {
 		if len(n.parents) > 0 && name == ".git" {
@@ -201,18 +258,12 @@ func (n *dirNode) Open(name string, flags uint32, context *fuse.Context) (file n
 
 func (n *dirNode) Readlink(name string, context *fuse.Context) (link string, code fuse.Status) {
 	defer func() {
-		log.Debugf("Readlink current <%s> name <%s> link: %v, status: %v", n.oid, name, link, code)
+		n.fs.logOp("Readlink", n.path, n.oid).WithField(logging.FieldStatus, statusName(code)).Debugf("name <%s>: link %s", name, link)
 	}()
-	if n.tree == nil {
-		if code = n.getChildren(); code != fuse.OK {
-			return "", code
-		}
-	}
-
 	rs := strings.SplitN(name, "/", 2)
-	child, ok := n.childrenMap[rs[0]]
-	if !ok {
-		return "", fuse.ENOENT
+	child, code := n.lookup(rs[0])
+	if code != fuse.OK {
+		return "", code
 	}
 	if len(rs) == 1 {
 		return child.(*linkNode).Readlink("", context)
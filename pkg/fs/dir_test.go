@@ -0,0 +1,249 @@
+package fs
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// countingStore counts the tree objects read through it.
+type countingStore struct {
+	ObjectStore
+
+	mu    sync.Mutex
+	trees map[plumbing.Hash]int
+}
+
+func (s *countingStore) Tree(oid plumbing.Hash) ([]object.TreeEntry, error) {
+	s.mu.Lock()
+	s.trees[oid]++
+	s.mu.Unlock()
+	return s.ObjectStore.Tree(oid)
+}
+
+// newTestTree returns the tree of master in f read with backend, and the
+// store counting its tree reads.
+func newTestTree(t *testing.T, f *fixture, backend string) (GitFS, *countingStore) {
+	t.Helper()
+	store, err := NewObjectStore(f.gitdir, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingStore{ObjectStore: store, trees: map[plumbing.Hash]int{}}
+	r := &Repository{gitdir: f.gitdir, store: counting, cache: newContentCache(DefaultCacheSize)}
+	t.Cleanup(func() { r.Close() })
+
+	tree, err := r.NewTreeFS("master", path.Join(f.gitdir, "worktrees", "wt"), &GitFSOptions{Lazy: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tree, counting
+}
+
+func readFile(t *testing.T, tree GitFS, name string) string {
+	file, code := tree.Open(name, uint32(os.O_RDONLY), nil)
+	if !code.Ok() {
+		t.Errorf("open %s: %v", name, code)
+		return ""
+	}
+	defer file.Release()
+	buf := make([]byte, 4096)
+	res, code := file.Read(buf, 0)
+	if !code.Ok() {
+		t.Errorf("read %s: %v", name, code)
+		return ""
+	}
+	data, _ := res.Bytes(buf)
+	return string(data)
+}
+
+// TestConcurrentLookups has many goroutines look up the same fresh tree
+// at once, each in its own order, to be run with -race.
+func TestConcurrentLookups(t *testing.T) {
+	f := newFixture(t, 4)
+
+	var files, links []string
+	for name := range f.files {
+		files = append(files, name)
+	}
+	for name := range f.links {
+		links = append(links, name)
+	}
+	sort.Strings(files)
+	sort.Strings(links)
+
+	for _, backend := range []string{StoreGoGit, StoreCatFile} {
+		t.Run(backend, func(t *testing.T) {
+			for round := 0; round < 4; round++ {
+				tree, store := newTestTree(t, f, backend)
+
+				const workers = 32
+				start := make(chan struct{})
+				var wg sync.WaitGroup
+				for w := 0; w < workers; w++ {
+					wg.Add(1)
+					go func(w int) {
+						defer wg.Done()
+						<-start
+						for i := range f.dirs {
+							dir := f.dirs[(i+w)%len(f.dirs)]
+							if _, code := tree.OpenDir(dir, nil); !code.Ok() {
+								t.Errorf("opendir %s: %v", dir, code)
+							}
+						}
+						for i := range files {
+							name := files[(i+w)%len(files)]
+							if attr, code := tree.GetAttr(name, nil); !code.Ok() {
+								t.Errorf("getattr %s: %v", name, code)
+							} else if attr.Size != uint64(len(f.files[name])) {
+								t.Errorf("getattr %s: size %d, want %d", name, attr.Size, len(f.files[name]))
+							}
+							if got := readFile(t, tree, name); got != f.files[name] {
+								t.Errorf("read %s: %q, want %q", name, got, f.files[name])
+							}
+						}
+						for i := range links {
+							name := links[(i+w)%len(links)]
+							if target, code := tree.Readlink(name, nil); !code.Ok() {
+								t.Errorf("readlink %s: %v", name, code)
+							} else if target != f.links[name] {
+								t.Errorf("readlink %s: %q, want %q", name, target, f.links[name])
+							}
+						}
+					}(w)
+				}
+				close(start)
+				wg.Wait()
+
+				// The root and every dir below it, each its own tree.
+				if len(store.trees) != len(f.dirs)+1 {
+					t.Errorf("%d trees read, want %d", len(store.trees), len(f.dirs)+1)
+				}
+				for oid, n := range store.trees {
+					if n != 1 {
+						t.Errorf("tree %s read %d times, want once", oid, n)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestConcurrentSwaps looks up a tree from many goroutines while others
+// switch it between two revisions and two sparse cones, replacing the dir
+// nodes the lookups go through. Every lookup must see one revision or the
+// other, or nothing for a path the cone hides.
+func TestConcurrentSwaps(t *testing.T) {
+	f := newFixture(t, 3)
+	// other changes every file of d0 and removes d1.
+	want := map[string]map[string]bool{}
+	for name, contents := range f.files {
+		want[name] = map[string]bool{contents: true}
+	}
+	f.git(t, "checkout", "-q", "-b", "other")
+	for name := range f.files {
+		if !strings.HasPrefix(name, "d0/") {
+			continue
+		}
+		contents := "other " + f.files[name]
+		if err := ioutil.WriteFile(filepath.Join(f.gitdir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want[name][contents] = true
+	}
+	f.git(t, "rm", "-q", "-r", "d1")
+	f.git(t, "commit", "-q", "-a", "-m", "other")
+	f.git(t, "checkout", "-q", "master")
+
+	var files []string
+	for name := range f.files {
+		files = append(files, name)
+	}
+	sort.Strings(files)
+
+	for _, backend := range []string{StoreGoGit, StoreCatFile} {
+		t.Run(backend, func(t *testing.T) {
+			tree, _ := newTestTree(t, f, backend)
+
+			const workers = 16
+			stop := make(chan struct{})
+			var swappers, lookups sync.WaitGroup
+			swappers.Add(2)
+			go func() {
+				defer swappers.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					revision := []string{"other", "master"}[i%2]
+					if _, err := tree.SetRevision(revision); err != nil {
+						t.Errorf("set revision %s: %v", revision, err)
+						return
+					}
+				}
+			}()
+			go func() {
+				defer swappers.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if i%2 == 0 {
+						tree.SetSparse(NewConeSparse([]string{"d0", "d2"}))
+					} else {
+						tree.SetSparse(nil)
+					}
+				}
+			}()
+
+			for w := 0; w < workers; w++ {
+				lookups.Add(1)
+				go func(w int) {
+					defer lookups.Done()
+					for round := 0; round < 4; round++ {
+						for i := range f.dirs {
+							dir := f.dirs[(i+w)%len(f.dirs)]
+							if _, code := tree.OpenDir(dir, nil); !code.Ok() && code != fuse.ENOENT {
+								t.Errorf("opendir %s: %v", dir, code)
+							}
+						}
+						for i := range files {
+							name := files[(i+w)%len(files)]
+							file, code := tree.Open(name, uint32(os.O_RDONLY), nil)
+							if code == fuse.ENOENT {
+								continue
+							} else if !code.Ok() {
+								t.Errorf("open %s: %v", name, code)
+								continue
+							}
+							buf := make([]byte, 4096)
+							res, code := file.Read(buf, 0)
+							if !code.Ok() {
+								t.Errorf("read %s: %v", name, code)
+							} else if data, _ := res.Bytes(buf); !want[name][string(data)] {
+								t.Errorf("read %s: %q, from neither revision", name, data)
+							}
+							file.Release()
+						}
+					}
+				}(w)
+			}
+			lookups.Wait()
+			close(stop)
+			swappers.Wait()
+		})
+	}
+}
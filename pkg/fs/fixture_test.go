@@ -0,0 +1,85 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"testing"
+)
+
+// fixture is a repository with one commit, on master, of the tree
+// described by files and links.
+type fixture struct {
+	gitdir string
+	// files maps the path of every regular file to its contents.
+	files map[string]string
+	// links maps the path of every symlink to its target.
+	links map[string]string
+	// dirs are the paths of the directories below the root.
+	dirs []string
+}
+
+// newFixture creates a repository of width dirs of width subdirs, each
+// holding width files and a symlink. Every file and so every tree has
+// contents of its own, no two directories share a tree object.
+func newFixture(t testing.TB, width int) *fixture {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	f := &fixture{
+		gitdir: t.TempDir(),
+		files:  map[string]string{"README": "fixture\n"},
+		links:  map[string]string{"link": "README"},
+	}
+	for i := 0; i < width; i++ {
+		dir := fmt.Sprintf("d%d", i)
+		f.dirs = append(f.dirs, dir)
+		for j := 0; j < width; j++ {
+			sub := path.Join(dir, fmt.Sprintf("s%d", j))
+			f.dirs = append(f.dirs, sub)
+			for k := 0; k < width; k++ {
+				name := path.Join(sub, fmt.Sprintf("f%d", k))
+				f.files[name] = name + "\n"
+			}
+			f.links[path.Join(sub, "link")] = "f0"
+		}
+	}
+
+	for name, contents := range f.files {
+		p := filepath.Join(f.gitdir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range f.links {
+		if err := os.Symlink(target, filepath.Join(f.gitdir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.git(t, "init", "-q", "-b", "master")
+	f.git(t, "add", "-A")
+	f.git(t, "commit", "-q", "-m", "fixture")
+	return f
+}
+
+func (f *fixture) git(t testing.TB, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-C", f.gitdir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=fixture", "GIT_AUTHOR_EMAIL=fixture@example.com",
+		"GIT_COMMITTER_NAME=fixture", "GIT_COMMITTER_EMAIL=fixture@example.com",
+		"GIT_CONFIG_NOSYSTEM=1", "HOME="+f.gitdir,
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("git %v: %v", args, err)
+	}
+	return string(out)
+}
@@ -1,57 +1,191 @@
 package fs
 
 import (
+	"context"
 	"fmt"
+	"sync"
 	"sync/atomic"
 
-	gogit "github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
 )
 
+// DefaultCacheSize is the size of the in-memory blob content cache used
+// when GitFSOptions.CacheSize is not set.
+const DefaultCacheSize = 256 << 20
+
 type GitFSOptions struct {
 	Lazy    bool
 	Disk    bool
 	TempDir string
+
+	// CacheSize bounds the in-memory blob content cache, in bytes.
+	CacheSize uint64
+
+	// SparseFile is a sparse-checkout file limiting the visible paths.
+	SparseFile string
+
+	// ObjectStore is the backend NewTreeFSRoot reads objects with.
+	ObjectStore string
+
+	// Log is where the tree logs, the log of the process if nil.
+	Log *log.Entry
+}
+
+// GitFS is the read-only filesystem of a git tree.
+type GitFS interface {
+	pathfs.FileSystem
+
+	// Prefetch loads the blobs under paths into the content cache.
+	Prefetch(ctx context.Context, paths []string, opts PrefetchOptions) (PrefetchProgress, error)
+
+	// SetSparse replaces the sparse-checkout patterns, nil showing the
+	// whole tree. It returns the already looked up paths whose visibility
+	// changed.
+	SetSparse(sparse *Sparse) []string
+
+	// SetRevision switches the filesystem to the tree of revision. It
+	// returns the paths already looked up in the previous tree.
+	SetRevision(revision string) ([]string, error)
+
+	// Commit returns the commit whose tree is served.
+	Commit() plumbing.Hash
+
+	// CacheStats returns what the blob caches hold.
+	CacheStats() (CacheStats, error)
+
+	// DropCaches empties the blob caches, returning what they held. The
+	// memory cache is shared with the other trees of the repository.
+	DropCaches() (CacheStats, error)
+
+	// LoadedPaths returns the paths looked up so far.
+	LoadedPaths() []string
+
+	// LoadedOid returns the object of name if it was already looked up,
+	// without reading any tree.
+	LoadedOid(name string) (plumbing.Hash, bool)
 }
 
 type treeFS struct {
-	repository *gogit.Repository
+	store ObjectStore
+
+	opts  *GitFSOptions
+	cache *contentCache
+	log   *log.Entry
 
-	opts *GitFSOptions
+	sparseMu sync.RWMutex
+	sparse   *Sparse
 
 	automaticIno uint64
 }
 
-func NewTreeFSRoot(gitdir, revision, worktree string, opts *GitFSOptions) (pathfs.FileSystem, error) {
-	repository, err := gogit.PlainOpen(gitdir)
+// Repository holds the objects of a git repository and the blob content
+// cache shared by every tree mounted from it.
+type Repository struct {
+	gitdir string
+	store  ObjectStore
+	cache  *contentCache
+}
+
+// OpenRepository opens the repository at gitdir with the named object
+// store backend and a content cache of cacheSize bytes, DefaultCacheSize
+// if zero.
+func OpenRepository(gitdir, backend string, cacheSize uint64) (*Repository, error) {
+	store, err := NewObjectStore(gitdir, backend)
 	if err != nil {
 		return nil, err
 	}
+	if cacheSize == 0 {
+		cacheSize = DefaultCacheSize
+	}
+	return &Repository{
+		gitdir: gitdir,
+		store:  store,
+		cache:  newContentCache(cacheSize),
+	}, nil
+}
+
+func (r *Repository) Close() error {
+	return r.store.Close()
+}
+
+// NewTreeFS returns the filesystem of the tree of revision. Its .git file
+// points at the worktree admin dir.
+func (r *Repository) NewTreeFS(revision, worktree string, opts *GitFSOptions) (GitFS, error) {
 	t := treeFS{
-		repository:   repository,
+		store:        r.store,
 		opts:         opts,
+		cache:        r.cache,
+		log:          opts.Log,
 		automaticIno: 1,
 	}
+	if t.log == nil {
+		t.log = log.NewEntry(log.StandardLogger())
+	}
+	var err error
+	if opts.SparseFile != "" {
+		if t.sparse, err = LoadSparse(opts.SparseFile); err != nil {
+			return nil, fmt.Errorf("sparse checkout: %v", err)
+		}
+	}
 
-	oid, err := repository.ResolveRevision(plumbing.Revision(revision))
+	commit, err := r.store.ResolveCommit(revision)
 	if err != nil {
-		return nil, fmt.Errorf("resolve revision: %v", err)
+		return nil, err
 	}
-	commit, err := repository.CommitObject(*oid)
+	root, err := r.store.ResolveTree(commit.String())
 	if err != nil {
-		return nil, fmt.Errorf("commit object: %v", err)
+		return nil, err
 	}
-	root, err := commit.Tree()
+	return &rootNode{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		fs:         &t,
+		gitdir:     r.gitdir,
+		worktree:   worktree,
+		commit:     commit,
+		dir:        t.newDirNode(r.gitdir, worktree, "", "", root),
+	}, nil
+}
+
+// ResolveCommit returns the commit named by revision.
+func (r *Repository) ResolveCommit(revision string) (plumbing.Hash, error) {
+	return r.store.ResolveCommit(revision)
+}
+
+func NewTreeFSRoot(gitdir, revision, worktree string, opts *GitFSOptions) (GitFS, error) {
+	r, err := OpenRepository(gitdir, opts.ObjectStore, opts.CacheSize)
 	if err != nil {
-		return nil, fmt.Errorf("root tree: %v", err)
+		return nil, err
 	}
-	return t.newDirNode(gitdir, worktree, "", root.Hash), nil
+	return r.NewTreeFS(revision, worktree, opts)
 }
 
 func (t *treeFS) onMount(nodeFs *pathfs.PathNodeFs) {
 }
 
+// visible reports whether e is part of the sparse checkout.
+func (t *treeFS) visible(e gitEntry) bool {
+	if _, ok := e.(*mockBlobNode); ok {
+		return true
+	}
+	t.sparseMu.RLock()
+	defer t.sparseMu.RUnlock()
+	return t.sparse.Includes(e.Path(), e.Mode()&fuse.S_IFDIR != 0)
+}
+
+// logOp returns the log of op on the object oid at name.
+func (t *treeFS) logOp(op, name string, oid plumbing.Hash) *log.Entry {
+	return t.log.WithFields(log.Fields{
+		logging.FieldOp:   op,
+		logging.FieldPath: name,
+		logging.FieldOid:  oid.String(),
+	})
+}
+
 func (t *treeFS) geninodeid() uint64 {
 	return atomic.AddUint64(&t.automaticIno, 1)
 }
@@ -1,6 +1,7 @@
 package fs
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/go-git/go-git/v5/plumbing"
@@ -16,9 +17,16 @@ type gitEntry interface {
 	// Name is the basename of the file in the directory.
 	Name() string
 
+	// Path is the slash separated path of the file from the root of
+	// the tree.
+	Path() string
+
 	// Ino is the inode number.
 	Ino() uint64
 
+	// Oid is the object of the file.
+	Oid() plumbing.Hash
+
 	GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status)
 }
 
@@ -29,6 +37,7 @@ type gitNode struct {
 
 	inode uint64
 	name  string
+	path  string
 	mode  uint32
 	oid   plumbing.Hash
 
@@ -47,12 +56,21 @@ func (n *gitNode) Name() string {
 	return n.name
 }
 
+func (n *gitNode) Path() string {
+	return n.path
+}
+
+func (n *gitNode) Oid() plumbing.Hash {
+	return n.oid
+}
+
 func (n *gitNode) Ino() uint64 {
-	if n.inode > 0 {
-		return n.inode
+	if ino := atomic.LoadUint64(&n.inode); ino > 0 {
+		return ino
 	}
-	n.inode = n.fs.geninodeid()
-	return n.inode
+	// Several lookups may race to number the same node; the first one wins.
+	atomic.CompareAndSwapUint64(&n.inode, 0, n.fs.geninodeid())
+	return atomic.LoadUint64(&n.inode)
 }
 
 func (n *gitNode) Access(name string, mode uint32, context *fuse.Context) (code fuse.Status) {
@@ -0,0 +1,239 @@
+package fs
+
+import (
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
+)
+
+// InstrumentOptions says what an instrumented filesystem records.
+type InstrumentOptions struct {
+	// Worktree labels the metrics.
+	Worktree string
+
+	// Recorder, if set, records the paths looked up and opened.
+	Recorder *AccessRecorder
+
+	// Log is where the operations are logged, the log of the process if
+	// nil. Every operation is logged at the debug level, slow ones as
+	// warnings and those failing with EIO as errors.
+	Log *log.Entry
+	// SlowOp is the latency past which an operation is slow, none is if
+	// zero.
+	SlowOp time.Duration
+	// Lower, if set, is the tree under the worktree, giving the objects
+	// of the paths logged.
+	Lower GitFS
+
+	// Watchdog reports the operations that hang.
+	Watchdog WatchdogOptions
+
+	// Interrupts, if set, hands the reads interrupted by the kernel on
+	// to the files opened.
+	Interrupts *Interrupts
+}
+
+// instrumentedFS records the operations the kernel sends to the
+// filesystem of a worktree.
+type instrumentedFS struct {
+	pathfs.FileSystem
+
+	opts     InstrumentOptions
+	watchdog *watchdog
+}
+
+// NewInstrumentedFS wraps the filesystem served for a worktree, recording
+// the count and latency of its read operations and logging them.
+func NewInstrumentedFS(fs pathfs.FileSystem, opts InstrumentOptions) pathfs.FileSystem {
+	if opts.Log == nil {
+		opts.Log = log.WithField(logging.FieldWorktree, opts.Worktree)
+	}
+	f := &instrumentedFS{FileSystem: fs, opts: opts}
+	if opts.Watchdog.Threshold > 0 {
+		f.watchdog = &watchdog{fs: f, inflight: map[uint64]*inflightOp{}}
+	}
+	return f
+}
+
+// statusName returns the errno name of code, OK for success.
+func statusName(code fuse.Status) string {
+	if code.Ok() {
+		return "OK"
+	}
+	if name := unix.ErrnoName(syscall.Errno(code)); name != "" {
+		return name
+	}
+	return strconv.Itoa(int(code))
+}
+
+// begin starts timing op on name; the returned func ends it with its
+// status.
+func (f *instrumentedFS) begin(op, name string) func(code fuse.Status) {
+	start := time.Now()
+	return func(code fuse.Status) {
+		latency := time.Since(start)
+		opDuration.With(f.opts.Worktree, op).Observe(latency.Seconds())
+		opTotal.With(f.opts.Worktree, op, statusName(code)).Inc()
+		f.log(op, name, code, latency)
+	}
+}
+
+func (f *instrumentedFS) log(op, name string, code fuse.Status, latency time.Duration) {
+	slow := f.opts.SlowOp > 0 && latency >= f.opts.SlowOp
+	failed := code == fuse.EIO
+	if !slow && !failed && !f.opts.Log.Logger.IsLevelEnabled(log.DebugLevel) {
+		return
+	}
+	entry := f.entry(op, name).WithFields(log.Fields{
+		logging.FieldStatus:  statusName(code),
+		logging.FieldLatency: latency.Seconds(),
+	})
+	switch {
+	case failed:
+		entry.Error("operation failed")
+	case slow:
+		entry.Warn("slow operation")
+	default:
+		entry.Debug("operation")
+	}
+}
+
+// entry returns the log of op on name.
+func (f *instrumentedFS) entry(op, name string) *log.Entry {
+	entry := f.opts.Log.WithFields(log.Fields{
+		logging.FieldOp:   op,
+		logging.FieldPath: name,
+	})
+	if f.opts.Lower != nil {
+		if oid, ok := f.opts.Lower.LoadedOid(name); ok {
+			entry = entry.WithField(logging.FieldOid, oid.String())
+		}
+	}
+	return entry
+}
+
+func (f *instrumentedFS) record(name string, dir, opened bool) {
+	if f.opts.Recorder != nil {
+		f.opts.Recorder.record(name, dir, opened)
+	}
+}
+
+func (f *instrumentedFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	context, _ = f.detach(context, nil)
+	var attr *fuse.Attr
+	code, ok := f.call("GetAttr", name, func() (code fuse.Status) {
+		attr, code = f.FileSystem.GetAttr(name, context)
+		return code
+	}, nil)
+	if !ok {
+		return nil, code
+	}
+	if code.Ok() {
+		f.record(name, attr.IsDir(), false)
+	}
+	return attr, code
+}
+
+func (f *instrumentedFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	context, _ = f.detach(context, nil)
+	var stream []fuse.DirEntry
+	code, ok := f.call("OpenDir", name, func() (code fuse.Status) {
+		stream, code = f.FileSystem.OpenDir(name, context)
+		return code
+	}, nil)
+	if !ok {
+		return nil, code
+	}
+	if code.Ok() {
+		f.record(name, true, true)
+	}
+	return stream, code
+}
+
+func (f *instrumentedFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	request := context
+	context, _ = f.detach(context, nil)
+	var file nodefs.File
+	code, ok := f.call("Open", name, func() (code fuse.Status) {
+		file, code = f.FileSystem.Open(name, flags, context)
+		return code
+	}, func() {
+		// Nobody got the file, nobody will release it.
+		if file != nil {
+			file.Release()
+		}
+	})
+	if !ok {
+		return nil, code
+	}
+	if !code.Ok() {
+		return file, code
+	}
+	f.record(name, false, true)
+	file = &instrumentedFile{File: file, fs: f, name: name}
+	f.opts.Interrupts.opened(request, file)
+	return file, code
+}
+
+func (f *instrumentedFS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	context, _ = f.detach(context, nil)
+	var target string
+	code, ok := f.call("Readlink", name, func() (code fuse.Status) {
+		target, code = f.FileSystem.Readlink(name, context)
+		return code
+	}, nil)
+	if !ok {
+		return "", code
+	}
+	if code.Ok() {
+		f.record(name, false, true)
+	}
+	return target, code
+}
+
+// instrumentedFile records the reads of a file opened through an
+// instrumentedFS.
+type instrumentedFile struct {
+	nodefs.File
+
+	fs   *instrumentedFS
+	name string
+}
+
+func (f *instrumentedFile) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	return f.ReadInterruptible(nil, dest, off)
+}
+
+func (f *instrumentedFile) ReadInterruptible(cancel <-chan struct{}, dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	_, dest = f.fs.detach(nil, dest)
+	var res fuse.ReadResult
+	code, ok := f.fs.call("Read", f.name, func() (code fuse.Status) {
+		res, code = readInterruptible(f.File, cancel, dest, off)
+		return code
+	}, nil)
+	switch {
+	case !ok:
+		// The read goes on into dest, which is left to it.
+		return nil, code
+	case !f.fs.detaching():
+		return res, code
+	case res == nil:
+		putReadBuf(dest)
+		return res, code
+	}
+	return &pooledResult{ReadResult: res, buf: dest}, code
+}
+
+// Flush is watched for close not to hang behind a hung Read.
+func (f *instrumentedFile) Flush() fuse.Status {
+	code, _ := f.fs.call("Flush", f.name, f.File.Flush, nil)
+	return code
+}
@@ -0,0 +1,131 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// interruptibleFile is a file whose reads give up once cancel is closed,
+// when the kernel interrupts them.
+type interruptibleFile interface {
+	ReadInterruptible(cancel <-chan struct{}, dest []byte, off int64) (fuse.ReadResult, fuse.Status)
+}
+
+// readInterruptible reads f, handing it cancel if it can give up.
+func readInterruptible(f nodefs.File, cancel <-chan struct{}, dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	if i, ok := f.(interruptibleFile); ok {
+		return i.ReadInterruptible(cancel, dest, off)
+	}
+	return f.Read(dest, off)
+}
+
+// Interrupts hands the cancel channel of read requests, closed once the
+// kernel interrupts them, on to the files read. nodefs neither passes it
+// to File.Read nor tells which file a handle stands for, so the
+// filesystem tells which file it opens for an Open request, known by its
+// cancel channel while it runs, and Interrupts keeps it by its handle.
+type Interrupts struct {
+	mu sync.Mutex
+	// opening holds the Open requests in flight and the file they opened.
+	opening map[<-chan struct{}]interruptibleFile
+	files   map[uint64]interruptibleFile
+}
+
+// NewInterrupts returns the Interrupts of a mount, to be set both in the
+// options of its instrumented filesystem and around its raw filesystem.
+func NewInterrupts() *Interrupts {
+	return &Interrupts{
+		opening: map[<-chan struct{}]interruptibleFile{},
+		files:   map[uint64]interruptibleFile{},
+	}
+}
+
+// opened records f as the file opened for the request of context.
+func (i *Interrupts) opened(context *fuse.Context, f nodefs.File) {
+	if i == nil || context == nil {
+		return
+	}
+	g, ok := f.(interruptibleFile)
+	if !ok {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if _, ok := i.opening[context.Cancel]; ok {
+		i.opening[context.Cancel] = g
+	}
+}
+
+// Wrap returns the raw filesystem of a mount with its reads handed their
+// cancel channel.
+func (i *Interrupts) Wrap(raw fuse.RawFileSystem) fuse.RawFileSystem {
+	return &interruptibleFS{RawFileSystem: raw, i: i}
+}
+
+type interruptibleFS struct {
+	fuse.RawFileSystem
+	i *Interrupts
+}
+
+func (fs *interruptibleFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	if cancel == nil {
+		return fs.RawFileSystem.Open(cancel, input, out)
+	}
+	fs.i.mu.Lock()
+	fs.i.opening[cancel] = nil
+	fs.i.mu.Unlock()
+
+	code := fs.RawFileSystem.Open(cancel, input, out)
+
+	fs.i.mu.Lock()
+	defer fs.i.mu.Unlock()
+	if f := fs.i.opening[cancel]; f != nil && code.Ok() {
+		fs.i.files[out.Fh] = f
+	}
+	delete(fs.i.opening, cancel)
+	return code
+}
+
+func (fs *interruptibleFS) Read(cancel <-chan struct{}, input *fuse.ReadIn, buf []byte) (fuse.ReadResult, fuse.Status) {
+	fs.i.mu.Lock()
+	f := fs.i.files[input.Fh]
+	fs.i.mu.Unlock()
+	if f == nil {
+		return fs.RawFileSystem.Read(cancel, input, buf)
+	}
+	return f.ReadInterruptible(cancel, buf, int64(input.Offset))
+}
+
+func (fs *interruptibleFS) Release(cancel <-chan struct{}, input *fuse.ReleaseIn) {
+	// The handle is given out again once released.
+	fs.i.mu.Lock()
+	delete(fs.i.files, input.Fh)
+	fs.i.mu.Unlock()
+	fs.RawFileSystem.Release(cancel, input)
+}
+
+// contextReader stops reading once its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// requestContext returns c as a context, done once the request is
+// interrupted, or a context never done if there is no request.
+func requestContext(c *fuse.Context) context.Context {
+	if c == nil {
+		return context.Background()
+	}
+	return c
+}
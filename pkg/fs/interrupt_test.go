@@ -0,0 +1,62 @@
+package fs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+)
+
+// openingRawFS opens file for every Open, telling interrupts like the
+// filesystem of a mount does.
+type openingRawFS struct {
+	fuse.RawFileSystem
+	interrupts *Interrupts
+	file       nodefs.File
+}
+
+func (fs *openingRawFS) Open(cancel <-chan struct{}, input *fuse.OpenIn, out *fuse.OpenOut) fuse.Status {
+	fs.interrupts.opened(&fuse.Context{Cancel: cancel}, fs.file)
+	out.Fh = 7
+	return fuse.OK
+}
+
+func TestInterruptedRead(t *testing.T) {
+	interrupts := NewInterrupts()
+	loading := make(chan struct{})
+	file := &lazyBlobFile{
+		ctor: func(ctx context.Context) (nodefs.File, error) {
+			close(loading)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	raw := interrupts.Wrap(&openingRawFS{
+		RawFileSystem: fuse.NewDefaultRawFileSystem(),
+		interrupts:    interrupts,
+		file:          file,
+	})
+
+	var out fuse.OpenOut
+	if code := raw.Open(make(chan struct{}), &fuse.OpenIn{}, &out); !code.Ok() {
+		t.Fatalf("Open: %v", code)
+	}
+	cancel := make(chan struct{})
+	go func() {
+		<-loading
+		close(cancel)
+	}()
+	if _, code := raw.Read(cancel, &fuse.ReadIn{Fh: out.Fh}, make([]byte, 16)); code != fuse.EINTR {
+		t.Fatalf("interrupted Read: got %v, want EINTR", code)
+	}
+
+	raw.Release(nil, &fuse.ReleaseIn{Fh: out.Fh})
+	if len(interrupts.files) != 0 || len(interrupts.opening) != 0 {
+		t.Errorf("released file still known: %d files, %d opening", len(interrupts.files), len(interrupts.opening))
+	}
+	// The handle is no longer ours, its reads go to nodefs.
+	if _, code := raw.Read(cancel, &fuse.ReadIn{Fh: out.Fh}, make([]byte, 16)); code != fuse.ENOSYS {
+		t.Errorf("Read after Release: got %v, want ENOSYS", code)
+	}
+}
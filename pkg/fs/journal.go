@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultJournalSize is the number of changes a Journal keeps.
+const DefaultJournalSize = 10000
+
+// JournalEntry is a change made through the overlay. NewPath is set for
+// renames and links.
+type JournalEntry struct {
+	Seq     uint64    `json:"seq"`
+	Time    time.Time `json:"time"`
+	Op      string    `json:"op"`
+	Path    string    `json:"path"`
+	NewPath string    `json:"new_path,omitempty"`
+}
+
+// Journal keeps the latest changes made through an overlay, numbered from
+// 1. Once full, the oldest entries are dropped.
+type Journal struct {
+	mu      sync.Mutex
+	entries []JournalEntry
+	start   int
+	next    uint64
+}
+
+func NewJournal(size int) *Journal {
+	if size <= 0 {
+		size = DefaultJournalSize
+	}
+	return &Journal{entries: make([]JournalEntry, 0, size), next: 1}
+}
+
+func (j *Journal) record(op, path, newPath string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	e := JournalEntry{Seq: j.next, Time: time.Now(), Op: op, Path: path, NewPath: newPath}
+	j.next++
+	if len(j.entries) < cap(j.entries) {
+		j.entries = append(j.entries, e)
+		return
+	}
+	j.entries[j.start] = e
+	j.start = (j.start + 1) % len(j.entries)
+}
+
+// Since returns the entries numbered seq and up, and the number the next
+// entry will get. Entries dropped from a full journal are missing, which
+// the caller notices from the first Seq being larger than asked for.
+func (j *Journal) Since(seq uint64) ([]JournalEntry, uint64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var entries []JournalEntry
+	for i := range j.entries {
+		e := j.entries[(j.start+i)%len(j.entries)]
+		if e.Seq >= seq {
+			entries = append(entries, e)
+		}
+	}
+	return entries, j.next
+}
@@ -2,13 +2,15 @@ package fs
 
 import (
 	"io/ioutil"
+	"path"
 	"sync"
 	"time"
 
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/hanwen/go-fuse/v2/fuse"
 	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
-	log "github.com/sirupsen/logrus"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
 )
 
 type linkNode struct {
@@ -17,11 +19,12 @@ type linkNode struct {
 	target []byte
 }
 
-func (t *treeFS) newLinkNode(name string, oid plumbing.Hash) *linkNode {
+func (t *treeFS) newLinkNode(parent, name string, oid plumbing.Hash) *linkNode {
 	return &linkNode{
 		gitNode: gitNode{
 			fs:         t,
 			name:       name,
+			path:       path.Join(parent, name),
 			oid:        oid,
 			FileSystem: pathfs.NewDefaultFileSystem(),
 			time:       time.Now(),
@@ -34,27 +37,27 @@ func (n *linkNode) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse
 }
 
 func (n *linkNode) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	n.Lock()
+	defer n.Unlock()
 	if n.target != nil {
 		return string(n.target), fuse.OK
 	}
-	n.Lock()
-	defer n.Unlock()
-	blob, err := n.fs.repository.BlobObject(n.oid)
-	if err != nil {
-		return "", fuse.EIO
+	reader, err := n.fs.store.Blob(n.oid)
+	if err == plumbing.ErrObjectNotFound {
+		missingObjects.Inc()
 	}
-
-	reader, err := blob.Reader()
 	if err != nil {
-		log.Errorf("Error reading blob %s: %s", n.oid.String(), err)
+		n.fs.logOp("Readlink", n.path, n.oid).WithField(logging.FieldStatus, "EIO").Errorf("read blob: %v", err)
 		return "", fuse.EIO
 	}
+	defer reader.Close()
 	content, err := ioutil.ReadAll(reader)
 	if err != nil {
-		log.Errorf("Error reading blob %s: %s", n.oid.String(), err)
+		n.fs.logOp("Readlink", n.path, n.oid).WithField(logging.FieldStatus, "EIO").Errorf("read blob: %v", err)
 		return "", fuse.EIO
 	}
 
+	blobBytes.Add(uint64(len(content)))
 	n.target = append([]byte{}, content...)
 	return string(n.target), fuse.OK
 }
@@ -0,0 +1,94 @@
+package fs
+
+import (
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/metrics"
+)
+
+// Names of the caches in the cache metrics.
+const (
+	memoryCache = "memory"
+	diskCache   = "disk"
+)
+
+var (
+	opDuration = metrics.NewHistogramVec("gitfs_fuse_op_duration_seconds",
+		"Time taken by FUSE operations.", metrics.LatencyBuckets, "worktree", "op")
+	opTotal = metrics.NewCounterVec("gitfs_fuse_ops_total",
+		"FUSE operations by result.", "worktree", "op", "status")
+
+	blobBytes = metrics.NewCounter("gitfs_blob_decompressed_bytes_total",
+		"Bytes of blob contents read from the object store.")
+	cacheHits = metrics.NewCounterVec("gitfs_cache_hits_total",
+		"Blob reads served from a cache.", "cache")
+	cacheMisses = metrics.NewCounterVec("gitfs_cache_misses_total",
+		"Blob reads that had to go to the object store.", "cache")
+	missingObjects = metrics.NewCounter("gitfs_missing_objects_total",
+		"Reads of objects missing from the object store.")
+
+	hungOps = metrics.NewCounterVec("gitfs_fuse_hung_ops_total",
+		"FUSE operations that ran past the watchdog threshold.", "worktree", "op")
+
+	copyUps = metrics.NewCounterVec("gitfs_upper_copy_ups_total",
+		"Tree entries copied up into the upper layer.", "worktree")
+)
+
+func init() {
+	// Both caches show up before their first read, for the hit rates.
+	for _, cache := range []string{memoryCache, diskCache} {
+		cacheHits.With(cache)
+		cacheMisses.With(cache)
+	}
+}
+
+// OpStats sums up the calls of one FUSE operation.
+type OpStats struct {
+	Count   uint64  `json:"count"`
+	Errors  uint64  `json:"errors"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Stats are the counters of a worktree, along with those of its process
+// that every worktree served by it shares.
+type Stats struct {
+	Ops     map[string]OpStats `json:"ops"`
+	CopyUps uint64             `json:"copy_ups"`
+
+	BlobBytes      uint64            `json:"blob_bytes"`
+	MissingObjects uint64            `json:"missing_objects"`
+	CacheHits      map[string]uint64 `json:"cache_hits"`
+	CacheMisses    map[string]uint64 `json:"cache_misses"`
+}
+
+// WorktreeStats returns the counters of the worktree whose metrics are
+// labeled with name.
+func WorktreeStats(name string) Stats {
+	s := Stats{
+		Ops:            map[string]OpStats{},
+		CopyUps:        copyUps.With(name).Value(),
+		BlobBytes:      blobBytes.Value(),
+		MissingObjects: missingObjects.Value(),
+		CacheHits:      map[string]uint64{},
+		CacheMisses:    map[string]uint64{},
+	}
+	opDuration.Each(func(values []string, h *metrics.Histogram) {
+		if values[0] == name {
+			op := s.Ops[values[1]]
+			op.Count, op.Seconds = h.Count()
+			s.Ops[values[1]] = op
+		}
+	})
+	opTotal.Each(func(values []string, c *metrics.Counter) {
+		if values[0] == name && values[2] != "OK" {
+			op := s.Ops[values[1]]
+			op.Errors += c.Value()
+			s.Ops[values[1]] = op
+		}
+	})
+	cacheHits.Each(func(values []string, c *metrics.Counter) {
+		s.CacheHits[values[0]] = c.Value()
+	})
+	cacheMisses.Each(func(values []string, c *metrics.Counter) {
+		s.CacheMisses[values[0]] = c.Value()
+	})
+	return s
+}
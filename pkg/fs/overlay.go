@@ -0,0 +1,1045 @@
+package fs
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/metrics"
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+)
+
+// copyBufSize is the size of the reads copying a file up from the tree.
+const copyBufSize = 128 << 10
+
+// OverlayFS stacks the upper layer of a worktree on top of its git tree.
+// Changed files live in the upper dir. Deletions of tree paths are kept
+// as whiteouts and opaque dirs the way overlayfs keeps them; they are read
+// once and then tracked exactly, so nothing is cached with a TTL.
+type OverlayFS struct {
+	pathfs.FileSystem
+
+	lower    pathfs.FileSystem
+	loopback pathfs.FileSystem
+	layer    *upper.Layer
+	journal  *Journal
+	copyUps  *metrics.Counter
+
+	// mu is held for reading by lookups and for writing by changes, so
+	// that a change and its whiteouts are seen together.
+	mu sync.RWMutex
+	// deleted holds the whiteouts and opaque dirs of the layer.
+	deleted map[string]bool
+}
+
+// NewOverlayFS returns the overlay of layer on top of the tree lower. The
+// metrics of the overlay are labeled with name.
+func NewOverlayFS(lower pathfs.FileSystem, layer *upper.Layer, name string) (*OverlayFS, error) {
+	if err := os.MkdirAll(layer.Dir, 0755); err != nil {
+		return nil, err
+	}
+	o := &OverlayFS{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		lower:      lower,
+		loopback:   pathfs.NewLoopbackFileSystem(layer.Dir),
+		layer:      layer,
+		journal:    NewJournal(DefaultJournalSize),
+		copyUps:    copyUps.With(name),
+	}
+	if err := o.reload(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o *OverlayFS) String() string {
+	return "overlay"
+}
+
+// Layer returns the upper layer of the overlay.
+func (o *OverlayFS) Layer() *upper.Layer {
+	return o.layer
+}
+
+// Journal returns the changes made through the overlay.
+func (o *OverlayFS) Journal() *Journal {
+	return o.journal
+}
+
+func (o *OverlayFS) reload() error {
+	deletions, err := o.layer.Deletions()
+	if err != nil {
+		return err
+	}
+	deleted := make(map[string]bool, len(deletions))
+	for _, name := range deletions {
+		deleted[name] = true
+	}
+	o.deleted = deleted
+	return nil
+}
+
+// Reload reads the whiteouts again after the layer was changed
+// without going through the overlay.
+func (o *OverlayFS) Reload() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.reload()
+}
+
+// Update runs fn with every change through the overlay held off, writes
+// to open files included, for fn to change the layer, or move the tree
+// below, from outside the overlay. fn returns the paths it changed in the
+// layer, which are journaled as op. The whiteouts are read again
+// afterwards. fn must not go through the mount.
+func (o *OverlayFS) Update(op string, fn func(layer *upper.Layer) ([]string, error)) ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	changed, err := fn(o.layer)
+	if rerr := o.reload(); err == nil {
+		err = rerr
+	}
+	for _, name := range changed {
+		o.journal.record(op, name, "")
+	}
+	return changed, err
+}
+
+// Reset drops the changes to the paths matched by pathspecs, or every
+// change if hard is set, and returns the paths it touched.
+func (o *OverlayFS) Reset(pathspecs []string, hard bool) ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if hard {
+		pathspecs = []string{"."}
+	}
+	reset, err := o.layer.Reset(pathspecs)
+	if err == nil && hard {
+		err = o.layer.Clear()
+	}
+	if rerr := o.reload(); err == nil {
+		err = rerr
+	}
+	for _, name := range reset {
+		o.journal.record("reset", name, "")
+	}
+	return reset, err
+}
+
+func parentOf(name string) string {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return ""
+	}
+	return name[:i]
+}
+
+// whiteout reports whether name is deleted by a whiteout, rather than
+// being an opaque dir.
+func (o *OverlayFS) whiteout(name string) bool {
+	if !o.deleted[name] {
+		return false
+	}
+	fi, err := os.Lstat(o.layer.Abs(name))
+	return err != nil || !fi.IsDir()
+}
+
+// inUpper reports whether the upper dir has an entry at name, other than
+// a whiteout.
+func (o *OverlayFS) inUpper(name string) bool {
+	if o.whiteout(name) {
+		return false
+	}
+	_, err := os.Lstat(o.layer.Abs(name))
+	return err == nil
+}
+
+// hidden reports whether the tree entry at name is deleted, itself or
+// through one of its parents.
+func (o *OverlayFS) hidden(name string) bool {
+	if len(o.deleted) == 0 {
+		return false
+	}
+	for n := name; n != ""; n = parentOf(n) {
+		if o.deleted[n] {
+			return true
+		}
+	}
+	return false
+}
+
+func (o *OverlayFS) lowerAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	if o.hidden(name) {
+		return nil, fuse.ENOENT
+	}
+	return o.lower.GetAttr(name, context)
+}
+
+func (o *OverlayFS) getAttr(name string, context *fuse.Context) (attr *fuse.Attr, inUpper bool, code fuse.Status) {
+	if !o.whiteout(name) {
+		if attr, code = o.loopback.GetAttr(name, context); code.Ok() {
+			if attr.IsRegular() && attr.Size == 0 && o.layer.Metacopy(name) {
+				if lower, lcode := o.lowerAttr(name, context); lcode.Ok() {
+					attr.Size, attr.Blocks = lower.Size, lower.Blocks
+				}
+			}
+			return attr, true, code
+		}
+	}
+	attr, code = o.lowerAttr(name, context)
+	return attr, false, code
+}
+
+// markDeleted hides the tree entry at name, copying up its parents so
+// that the whiteout has a dir to go into.
+func (o *OverlayFS) markDeleted(name string, context *fuse.Context) fuse.Status {
+	if o.deleted[name] {
+		return fuse.OK
+	}
+	if code := o.promoteParents(name, context); !code.Ok() {
+		return code
+	}
+	if err := o.layer.Delete(name); err != nil {
+		return fuse.ToStatus(err)
+	}
+	o.deleted[name] = true
+	return fuse.OK
+}
+
+func (o *OverlayFS) undelete(name string) fuse.Status {
+	if !o.deleted[name] {
+		return fuse.OK
+	}
+	if err := o.layer.Undelete(name); err != nil {
+		return fuse.ToStatus(err)
+	}
+	delete(o.deleted, name)
+	return fuse.OK
+}
+
+// replace runs create to make an entry at name, in place of the whiteout
+// at name if there is one. The whiteout is put back if create fails.
+func (o *OverlayFS) replace(name string, context *fuse.Context, create func() fuse.Status) fuse.Status {
+	whiteout := o.whiteout(name)
+	if whiteout {
+		if code := o.undelete(name); !code.Ok() {
+			return code
+		}
+	}
+	code := create()
+	if !code.Ok() && whiteout {
+		o.markDeleted(name, context)
+	}
+	return code
+}
+
+// dropBelow removes the whiteouts below the upper dir at dir and makes
+// the dirs below it transparent. They are redundant once dir is opaque or
+// gone.
+func (o *OverlayFS) dropBelow(dir string) fuse.Status {
+	if err := o.layer.DropDeletions(dir); err != nil && !os.IsNotExist(err) {
+		return fuse.ToStatus(err)
+	}
+	o.forgetBelow(dir)
+	return fuse.OK
+}
+
+// forgetBelow drops dir and the paths below it from deleted, after the
+// upper dir at dir went away with its whiteouts.
+func (o *OverlayFS) forgetBelow(dir string) {
+	delete(o.deleted, dir)
+	for name := range o.deleted {
+		if strings.HasPrefix(name, dir+"/") {
+			delete(o.deleted, name)
+		}
+	}
+}
+
+// promoteParents creates the parent dirs of name in the upper dir.
+func (o *OverlayFS) promoteParents(name string, context *fuse.Context) fuse.Status {
+	dir := parentOf(name)
+	if dir == "" {
+		return fuse.OK
+	}
+	if fi, err := os.Lstat(o.layer.Abs(dir)); err == nil {
+		if !fi.IsDir() {
+			return fuse.ENOTDIR
+		}
+		return fuse.OK
+	}
+	return o.copyUp(dir, copyData, nil, context)
+}
+
+// copyMode is what of a tree file copyUp copies.
+type copyMode int
+
+const (
+	// copyData copies the file with its contents.
+	copyData copyMode = iota
+	// copyEmpty leaves the contents behind, for a file about to be
+	// truncated.
+	copyEmpty
+	// copyMeta leaves a metacopy, for a change of the metadata alone.
+	copyMeta
+)
+
+// staged is the contents of a tree file fetched into a temp file, before
+// the change copying the file up takes the lock.
+type staged struct {
+	path string
+	// ino is the inode of the tree file fetched; a tree moved meanwhile
+	// has new ones.
+	ino uint64
+}
+
+func (s *staged) remove() {
+	if s != nil {
+		os.Remove(s.path)
+	}
+}
+
+// stage copies the contents of the tree file name into a temp file.
+func (o *OverlayFS) stage(name string, attr *fuse.Attr, context *fuse.Context) (*staged, fuse.Status) {
+	f, err := o.layer.TempFile()
+	if err != nil {
+		return nil, fuse.ToStatus(err)
+	}
+	s := &staged{path: f.Name(), ino: attr.Ino}
+	if code := o.copyFile(name, f, context); !code.Ok() {
+		s.remove()
+		return nil, code
+	}
+	return s, fuse.OK
+}
+
+// fetch stages the contents of name if copying it up with copyData will
+// need them, holding off no other change while it reads the tree. The
+// caller removes what is left of it once it is done.
+func (o *OverlayFS) fetch(name string, context *fuse.Context) (*staged, fuse.Status) {
+	o.mu.RLock()
+	var attr *fuse.Attr
+	if !o.inUpper(name) || o.layer.Metacopy(name) {
+		attr, _ = o.lowerAttr(name, context)
+	}
+	o.mu.RUnlock()
+	if attr == nil || !attr.IsRegular() {
+		// copyUp has nothing to read, or fails again under the lock.
+		return nil, fuse.OK
+	}
+	return o.stage(name, attr, context)
+}
+
+// stagedFiles are the contents fetched for the tree files at and below a
+// directory, by path.
+type stagedFiles map[string]*staged
+
+func (s stagedFiles) remove() {
+	for _, f := range s {
+		f.remove()
+	}
+}
+
+// fetchAll stages the contents of every file at or below name that
+// copying name up with everything below it will need, like fetch.
+func (o *OverlayFS) fetchAll(name string, context *fuse.Context) (stagedFiles, fuse.Status) {
+	var (
+		names []string
+		attrs []*fuse.Attr
+	)
+	var walk func(name string)
+	walk = func(name string) {
+		attr, _, code := o.getAttr(name, context)
+		if !code.Ok() {
+			return
+		}
+		if attr.IsDir() {
+			entries, _ := o.readDir(name, context)
+			for _, e := range entries {
+				walk(path.Join(name, e.Name))
+			}
+			return
+		}
+		if o.inUpper(name) && !o.layer.Metacopy(name) {
+			return
+		}
+		if attr, code := o.lowerAttr(name, context); code.Ok() && attr.IsRegular() {
+			names, attrs = append(names, name), append(attrs, attr)
+		}
+	}
+	o.mu.RLock()
+	walk(name)
+	o.mu.RUnlock()
+
+	staged := stagedFiles{}
+	for i, name := range names {
+		s, code := o.stage(name, attrs[i], context)
+		if !code.Ok() {
+			staged.remove()
+			return nil, code
+		}
+		staged[name] = s
+	}
+	return staged, fuse.OK
+}
+
+// copyUp copies the tree entry at name into the upper dir, unless it is
+// there already, the way mode says. A metacopy there gets contents of its
+// own for the other modes. The contents of a file are taken from s if
+// they were fetched from the tree still below.
+func (o *OverlayFS) copyUp(name string, mode copyMode, s *staged, context *fuse.Context) fuse.Status {
+	if o.inUpper(name) {
+		if mode == copyMeta || !o.layer.Metacopy(name) {
+			return fuse.OK
+		}
+		return o.fill(name, mode, s, context)
+	}
+	attr, code := o.lowerAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if code := o.promoteParents(name, context); !code.Ok() {
+		return code
+	}
+
+	p := o.layer.Abs(name)
+	perm := os.FileMode(attr.Mode & 07777)
+	switch {
+	case attr.IsDir():
+		if err := os.Mkdir(p, perm); err != nil {
+			return fuse.ToStatus(err)
+		}
+	case attr.IsSymlink():
+		target, code := o.lower.Readlink(name, context)
+		if !code.Ok() {
+			return code
+		}
+		if err := os.Symlink(target, p); err != nil {
+			return fuse.ToStatus(err)
+		}
+		o.copyUps.Inc()
+		return fuse.OK
+	case mode != copyData:
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return fuse.ToStatus(err)
+		}
+		f.Close()
+		if mode == copyMeta {
+			if err := o.layer.SetMetacopy(name); err != nil {
+				os.Remove(p)
+				return fuse.ToStatus(err)
+			}
+		}
+	default:
+		if s == nil || s.ino != attr.Ino {
+			if s, code = o.stage(name, attr, context); !code.Ok() {
+				return code
+			}
+			defer s.remove()
+		}
+		if err := os.Rename(s.path, p); err != nil {
+			return fuse.ToStatus(err)
+		}
+	}
+	o.copyUps.Inc()
+	if err := os.Chmod(p, perm); err != nil {
+		return fuse.ToStatus(err)
+	}
+	atime, mtime := time.Unix(int64(attr.Atime), 0), time.Unix(int64(attr.Mtime), 0)
+	return fuse.ToStatus(os.Chtimes(p, atime, mtime))
+}
+
+// fill gives the metacopy at name contents of its own, those of the tree
+// file unless mode is copyEmpty, keeping the metadata it has.
+func (o *OverlayFS) fill(name string, mode copyMode, s *staged, context *fuse.Context) fuse.Status {
+	if mode == copyEmpty {
+		return fuse.ToStatus(o.layer.ClearMetacopy(name))
+	}
+	attr, code := o.lowerAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if s == nil || s.ino != attr.Ino {
+		if s, code = o.stage(name, attr, context); !code.Ok() {
+			return code
+		}
+		defer s.remove()
+	}
+
+	p := o.layer.Abs(name)
+	fi, err := os.Lstat(p)
+	if err != nil {
+		return fuse.ToStatus(err)
+	}
+	st := fi.Sys().(*syscall.Stat_t)
+	if err := os.Chmod(s.path, fi.Mode().Perm()); err != nil {
+		return fuse.ToStatus(err)
+	}
+	if err := os.Lchown(s.path, int(st.Uid), int(st.Gid)); err != nil {
+		return fuse.ToStatus(err)
+	}
+	atime, mtime := time.Unix(st.Atim.Unix()), time.Unix(st.Mtim.Unix())
+	if err := os.Chtimes(s.path, atime, mtime); err != nil {
+		return fuse.ToStatus(err)
+	}
+	o.copyUps.Inc()
+	return fuse.ToStatus(os.Rename(s.path, p))
+}
+
+// copyFile copies the contents of the tree file name to f and closes it.
+func (o *OverlayFS) copyFile(name string, f *os.File, context *fuse.Context) fuse.Status {
+	defer f.Close()
+	src, code := o.lower.Open(name, uint32(os.O_RDONLY), context)
+	if !code.Ok() {
+		return code
+	}
+	defer src.Release()
+	buf := make([]byte, copyBufSize)
+	for off := int64(0); ; {
+		res, code := src.Read(buf, off)
+		if !code.Ok() {
+			return code
+		}
+		data, code := res.Bytes(buf)
+		if !code.Ok() {
+			return code
+		}
+		if len(data) == 0 {
+			break
+		}
+		if _, err := f.Write(data); err != nil {
+			return fuse.ToStatus(err)
+		}
+		off += int64(len(data))
+	}
+	return fuse.ToStatus(f.Close())
+}
+
+// materialize copies the directory at name and everything below it into
+// the upper dir, taking the contents of files from staged.
+func (o *OverlayFS) materialize(name string, staged stagedFiles, context *fuse.Context) fuse.Status {
+	if code := o.copyUp(name, copyData, nil, context); !code.Ok() {
+		return code
+	}
+	entries, code := o.readDir(name, context)
+	if !code.Ok() {
+		return code
+	}
+	for _, e := range entries {
+		child := path.Join(name, e.Name)
+		if e.Mode&fuse.S_IFDIR != 0 {
+			code = o.materialize(child, staged, context)
+		} else {
+			code = o.copyUp(child, copyData, staged[child], context)
+		}
+		if !code.Ok() {
+			return code
+		}
+	}
+	return fuse.OK
+}
+
+func (o *OverlayFS) readDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	attr, inUpper, code := o.getAttr(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if !attr.IsDir() {
+		return nil, fuse.ENOTDIR
+	}
+
+	var stream []fuse.DirEntry
+	seen := map[string]bool{}
+	if inUpper {
+		entries, code := o.loopback.OpenDir(name, context)
+		if !code.Ok() {
+			return nil, code
+		}
+		for _, e := range entries {
+			if e.Mode&fuse.S_IFDIR == 0 && o.deleted[path.Join(name, e.Name)] {
+				continue
+			}
+			seen[e.Name] = true
+			stream = append(stream, e)
+		}
+	}
+	if !o.hidden(name) {
+		entries, code := o.lower.OpenDir(name, context)
+		if code.Ok() {
+			for _, e := range entries {
+				if e.Name == "." || e.Name == ".." || seen[e.Name] || o.deleted[path.Join(name, e.Name)] {
+					continue
+				}
+				stream = append(stream, e)
+			}
+		}
+	}
+	return stream, fuse.OK
+}
+
+func (o *OverlayFS) OnMount(nodeFs *pathfs.PathNodeFs) {
+	o.lower.OnMount(nodeFs)
+}
+
+func (o *OverlayFS) StatFs(name string) *fuse.StatfsOut {
+	return o.loopback.StatFs("")
+}
+
+func (o *OverlayFS) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	attr, _, code := o.getAttr(name, context)
+	return attr, code
+}
+
+func (o *OverlayFS) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	_, inUpper, code := o.getAttr(name, context)
+	if !code.Ok() || !inUpper {
+		return code
+	}
+	return o.loopback.Access(name, mode, context)
+}
+
+func (o *OverlayFS) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.readDir(name, context)
+}
+
+func (o *OverlayFS) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	if flags&fuse.O_ANYWRITE == 0 {
+		o.mu.RLock()
+		defer o.mu.RUnlock()
+		_, inUpper, code := o.getAttr(name, context)
+		if !code.Ok() {
+			return nil, code
+		}
+		if inUpper && !o.layer.Metacopy(name) {
+			return o.loopback.Open(name, flags, context)
+		}
+		return o.lower.Open(name, flags, context)
+	}
+
+	mode, s := copyEmpty, (*staged)(nil)
+	if flags&syscall.O_TRUNC == 0 {
+		mode = copyData
+		var code fuse.Status
+		if s, code = o.fetch(name, context); !code.Ok() {
+			return nil, code
+		}
+		defer s.remove()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if code := o.copyUp(name, mode, s, context); !code.Ok() {
+		return nil, code
+	}
+	o.journal.record("write", name, "")
+	f, code := o.loopback.Open(name, flags, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	return &overlayFile{File: f, o: o}, fuse.OK
+}
+
+// overlayFile is a file of the upper dir open for writing. Its changes
+// wait for Update to be done with the layer.
+type overlayFile struct {
+	nodefs.File
+	o *OverlayFS
+}
+
+func (f *overlayFile) InnerFile() nodefs.File {
+	return f.File
+}
+
+func (f *overlayFile) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.o.mu.RLock()
+	defer f.o.mu.RUnlock()
+	return f.File.Write(data, off)
+}
+
+func (f *overlayFile) Truncate(size uint64) fuse.Status {
+	f.o.mu.RLock()
+	defer f.o.mu.RUnlock()
+	return f.File.Truncate(size)
+}
+
+func (f *overlayFile) Allocate(off uint64, size uint64, mode uint32) fuse.Status {
+	f.o.mu.RLock()
+	defer f.o.mu.RUnlock()
+	return f.File.Allocate(off, size, mode)
+}
+
+func (f *overlayFile) Chmod(perms uint32) fuse.Status {
+	f.o.mu.RLock()
+	defer f.o.mu.RUnlock()
+	return f.File.Chmod(perms)
+}
+
+func (f *overlayFile) Chown(uid uint32, gid uint32) fuse.Status {
+	f.o.mu.RLock()
+	defer f.o.mu.RUnlock()
+	return f.File.Chown(uid, gid)
+}
+
+func (f *overlayFile) Utimens(atime *time.Time, mtime *time.Time) fuse.Status {
+	f.o.mu.RLock()
+	defer f.o.mu.RUnlock()
+	return f.File.Utimens(atime, mtime)
+}
+
+func (o *OverlayFS) Create(name string, flags uint32, mode uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, _, code := o.getAttr(name, context); code.Ok() {
+		return nil, fuse.Status(syscall.EEXIST)
+	}
+	if code := o.promoteParents(name, context); !code.Ok() {
+		return nil, code
+	}
+	var f nodefs.File
+	code := o.replace(name, context, func() (code fuse.Status) {
+		f, code = o.loopback.Create(name, flags, mode, context)
+		return code
+	})
+	if !code.Ok() {
+		return nil, code
+	}
+	o.journal.record("create", name, "")
+	return &overlayFile{File: f, o: o}, fuse.OK
+}
+
+func (o *OverlayFS) Mkdir(name string, mode uint32, context *fuse.Context) fuse.Status {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, _, code := o.getAttr(name, context); code.Ok() {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if code := o.promoteParents(name, context); !code.Ok() {
+		return code
+	}
+	// A dir made where the tree had an entry that was deleted is opaque.
+	whiteout := o.whiteout(name)
+	code := o.replace(name, context, func() fuse.Status {
+		return o.loopback.Mkdir(name, mode, context)
+	})
+	if code.Ok() && whiteout {
+		code = o.markDeleted(name, context)
+	}
+	if !code.Ok() {
+		return code
+	}
+	o.journal.record("mkdir", name, "")
+	return fuse.OK
+}
+
+func (o *OverlayFS) Mknod(name string, mode uint32, dev uint32, context *fuse.Context) fuse.Status {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, _, code := o.getAttr(name, context); code.Ok() {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if code := o.promoteParents(name, context); !code.Ok() {
+		return code
+	}
+	code := o.replace(name, context, func() fuse.Status {
+		return o.loopback.Mknod(name, mode, dev, context)
+	})
+	if !code.Ok() {
+		return code
+	}
+	o.journal.record("mknod", name, "")
+	return fuse.OK
+}
+
+func (o *OverlayFS) Symlink(value string, linkName string, context *fuse.Context) fuse.Status {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, _, code := o.getAttr(linkName, context); code.Ok() {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if code := o.promoteParents(linkName, context); !code.Ok() {
+		return code
+	}
+	code := o.replace(linkName, context, func() fuse.Status {
+		return o.loopback.Symlink(value, linkName, context)
+	})
+	if !code.Ok() {
+		return code
+	}
+	o.journal.record("symlink", linkName, "")
+	return fuse.OK
+}
+
+func (o *OverlayFS) Link(oldName string, newName string, context *fuse.Context) fuse.Status {
+	s, code := o.fetch(oldName, context)
+	if !code.Ok() {
+		return code
+	}
+	defer s.remove()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if _, _, code := o.getAttr(newName, context); code.Ok() {
+		return fuse.Status(syscall.EEXIST)
+	}
+	if code := o.copyUp(oldName, copyData, s, context); !code.Ok() {
+		return code
+	}
+	if code := o.promoteParents(newName, context); !code.Ok() {
+		return code
+	}
+	code = o.replace(newName, context, func() fuse.Status {
+		return o.loopback.Link(oldName, newName, context)
+	})
+	if !code.Ok() {
+		return code
+	}
+	o.journal.record("link", oldName, newName)
+	return fuse.OK
+}
+
+func (o *OverlayFS) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	_, inUpper, code := o.getAttr(name, context)
+	if !code.Ok() {
+		return "", code
+	}
+	if inUpper {
+		return o.loopback.Readlink(name, context)
+	}
+	return o.lower.Readlink(name, context)
+}
+
+func (o *OverlayFS) Unlink(name string, context *fuse.Context) fuse.Status {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	attr, inUpper, code := o.getAttr(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if attr.IsDir() {
+		return fuse.Status(syscall.EISDIR)
+	}
+	if inUpper {
+		if code := o.loopback.Unlink(name, context); !code.Ok() {
+			return code
+		}
+	}
+	if _, code := o.lowerAttr(name, context); code.Ok() {
+		if code := o.markDeleted(name, context); !code.Ok() {
+			return code
+		}
+	}
+	o.journal.record("delete", name, "")
+	return fuse.OK
+}
+
+func (o *OverlayFS) Rmdir(name string, context *fuse.Context) fuse.Status {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries, code := o.readDir(name, context)
+	if !code.Ok() {
+		return code
+	}
+	if len(entries) > 0 {
+		return fuse.Status(syscall.ENOTEMPTY)
+	}
+	if o.inUpper(name) {
+		// The dir looks empty, but may still hold whiteouts.
+		if code := o.dropBelow(name); !code.Ok() {
+			return code
+		}
+		if code := o.loopback.Rmdir(name, context); !code.Ok() {
+			return code
+		}
+	}
+	if _, code := o.lowerAttr(name, context); code.Ok() {
+		if code := o.markDeleted(name, context); !code.Ok() {
+			return code
+		}
+	}
+	o.journal.record("rmdir", name, "")
+	return fuse.OK
+}
+
+// Rename moves oldName in the upper dir, copying it up first. A directory
+// from the tree is copied up with everything below it, the contents of
+// its files read before taking the lock.
+func (o *OverlayFS) Rename(oldName string, newName string, context *fuse.Context) fuse.Status {
+	staged, code := o.fetchAll(oldName, context)
+	if !code.Ok() {
+		return code
+	}
+	defer staged.remove()
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	attr, _, code := o.getAttr(oldName, context)
+	if !code.Ok() {
+		return code
+	}
+	if dst, _, code := o.getAttr(newName, context); code.Ok() {
+		switch {
+		case dst.IsDir() && !attr.IsDir():
+			return fuse.Status(syscall.EISDIR)
+		case !dst.IsDir() && attr.IsDir():
+			return fuse.Status(syscall.ENOTDIR)
+		case dst.IsDir():
+			entries, code := o.readDir(newName, context)
+			if !code.Ok() {
+				return code
+			}
+			if len(entries) > 0 {
+				return fuse.Status(syscall.ENOTEMPTY)
+			}
+			if o.inUpper(newName) {
+				if code := o.dropBelow(newName); !code.Ok() {
+					return code
+				}
+			}
+		}
+	}
+
+	_, code = o.lowerAttr(oldName, context)
+	inLower := code.Ok()
+	if attr.IsDir() {
+		code = o.materialize(oldName, staged, context)
+	} else {
+		code = o.copyUp(oldName, copyData, staged[oldName], context)
+	}
+	if !code.Ok() {
+		return code
+	}
+	if code := o.promoteParents(newName, context); !code.Ok() {
+		return code
+	}
+	code = o.replace(newName, context, func() fuse.Status {
+		return o.loopback.Rename(oldName, newName, context)
+	})
+	if !code.Ok() {
+		return code
+	}
+
+	// The whiteouts and opaque mark of a dir moved along with it.
+	o.forgetBelow(oldName)
+	if inLower {
+		code = o.markDeleted(oldName, context)
+	}
+	if code.Ok() && attr.IsDir() {
+		// Everything under the dir was copied up, so the tree dir at the
+		// new name, if any, must not show through, and nothing below it
+		// needs hiding.
+		o.forgetBelow(newName)
+		code = o.dropBelow(newName)
+		if code.Ok() {
+			code = fuse.ToStatus(o.layer.Undelete(newName))
+		}
+		if _, lcode := o.lower.GetAttr(newName, context); code.Ok() && lcode.Ok() {
+			code = o.markDeleted(newName, context)
+		}
+	}
+	o.journal.record("rename", oldName, newName)
+	return code
+}
+
+// modify copies name up and applies fn to it in the upper dir. The
+// contents of the file are read from the tree before taking the lock.
+func (o *OverlayFS) modify(op, name string, mode copyMode, context *fuse.Context, fn func() fuse.Status) fuse.Status {
+	var s *staged
+	if mode == copyData {
+		var code fuse.Status
+		if s, code = o.fetch(name, context); !code.Ok() {
+			return code
+		}
+		defer s.remove()
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if code := o.copyUp(name, mode, s, context); !code.Ok() {
+		return code
+	}
+	if code := fn(); !code.Ok() {
+		return code
+	}
+	o.journal.record(op, name, "")
+	return fuse.OK
+}
+
+// Chmod, Chown and Utimens leave a metacopy: the contents of a file are
+// only copied up once they change.
+
+func (o *OverlayFS) Chmod(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return o.modify("chmod", name, copyMeta, context, func() fuse.Status {
+		return o.loopback.Chmod(name, mode, context)
+	})
+}
+
+func (o *OverlayFS) Chown(name string, uid uint32, gid uint32, context *fuse.Context) fuse.Status {
+	return o.modify("chown", name, copyMeta, context, func() fuse.Status {
+		return o.loopback.Chown(name, uid, gid, context)
+	})
+}
+
+func (o *OverlayFS) Utimens(name string, atime *time.Time, mtime *time.Time, context *fuse.Context) fuse.Status {
+	return o.modify("utimens", name, copyMeta, context, func() fuse.Status {
+		return o.loopback.Utimens(name, atime, mtime, context)
+	})
+}
+
+func (o *OverlayFS) Truncate(name string, size uint64, context *fuse.Context) fuse.Status {
+	mode := copyData
+	if size == 0 {
+		mode = copyEmpty
+	}
+	return o.modify("truncate", name, mode, context, func() fuse.Status {
+		return o.loopback.Truncate(name, size, context)
+	})
+}
+
+func (o *OverlayFS) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	_, inUpper, code := o.getAttr(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if inUpper {
+		return o.loopback.GetXAttr(name, attribute, context)
+	}
+	return o.lower.GetXAttr(name, attribute, context)
+}
+
+func (o *OverlayFS) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	_, inUpper, code := o.getAttr(name, context)
+	if !code.Ok() {
+		return nil, code
+	}
+	if inUpper {
+		return o.loopback.ListXAttr(name, context)
+	}
+	return o.lower.ListXAttr(name, context)
+}
+
+func (o *OverlayFS) SetXAttr(name string, attr string, data []byte, flags int, context *fuse.Context) fuse.Status {
+	return o.modify("setxattr", name, copyData, context, func() fuse.Status {
+		return o.loopback.SetXAttr(name, attr, data, flags, context)
+	})
+}
+
+func (o *OverlayFS) RemoveXAttr(name string, attr string, context *fuse.Context) fuse.Status {
+	return o.modify("removexattr", name, copyData, context, func() fuse.Status {
+		return o.loopback.RemoveXAttr(name, attr, context)
+	})
+}
@@ -0,0 +1,260 @@
+package fs
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultPrefetchWorkers is the number of blobs loaded in parallel when
+// PrefetchOptions.Workers is not set.
+const DefaultPrefetchWorkers = 8
+
+// PrefetchOptions controls a Prefetch run.
+type PrefetchOptions struct {
+	// Workers is the number of blobs loaded in parallel.
+	Workers int
+
+	// Progress, if set, is called after every blob.
+	Progress func(PrefetchProgress)
+}
+
+// PrefetchProgress reports how far a Prefetch run has got.
+type PrefetchProgress struct {
+	Total  int    `json:"total"`
+	Done   int    `json:"done"`
+	Failed int    `json:"failed"`
+	Bytes  uint64 `json:"bytes"`
+}
+
+// ReadPathList reads a prefetch list: one path or pathspec per line,
+// ignoring blank lines and lines starting with '#'. A backslash escapes
+// the character after it, see EscapePath.
+func ReadPathList(r io.Reader) ([]string, error) {
+	var paths []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	return paths, scanner.Err()
+}
+
+// globEscaper escapes the characters special to path.Match.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`)
+
+// EscapePath returns the line of a prefetch list standing for the path
+// name and nothing else: its glob characters, and a leading '#', are
+// escaped with a backslash.
+func EscapePath(name string) string {
+	name = globEscaper.Replace(name)
+	if strings.HasPrefix(name, "#") {
+		name = `\` + name
+	}
+	return name
+}
+
+// isGlob reports whether pathspec has glob characters that are not
+// escaped.
+func isGlob(pathspec string) bool {
+	for i := 0; i < len(pathspec); i++ {
+		switch pathspec[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// unescapePath returns the path named by a pathspec that is not a glob,
+// dropping the backslashes escaping its characters.
+func unescapePath(pathspec string) string {
+	if !strings.Contains(pathspec, `\`) {
+		return pathspec
+	}
+	var b strings.Builder
+	for i := 0; i < len(pathspec); i++ {
+		if pathspec[i] == '\\' && i+1 < len(pathspec) {
+			i++
+		}
+		b.WriteByte(pathspec[i])
+	}
+	return b.String()
+}
+
+// find returns the entry at the slash separated path below n.
+func (n *dirNode) find(name string) (gitEntry, fuse.Status) {
+	name = strings.Trim(name, "/")
+	if name == "" {
+		return n, fuse.OK
+	}
+	rs := strings.SplitN(name, "/", 2)
+	child, code := n.lookup(rs[0])
+	if code != fuse.OK {
+		return nil, code
+	}
+	if len(rs) == 1 {
+		return child, fuse.OK
+	}
+	dir, ok := child.(*dirNode)
+	if !ok {
+		return nil, fuse.ENOENT
+	}
+	return dir.find(rs[1])
+}
+
+// walk calls fn for every blob below n, in tree order. dir is the path of n.
+func (n *dirNode) walk(ctx context.Context, dir string, fn func(name string, blob *blobNode)) error {
+	children, _, code := n.getChildren()
+	if code != fuse.OK {
+		return fmt.Errorf("read tree %s: %v", n.oid, code)
+	}
+	for _, ch := range children {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !n.fs.visible(ch) {
+			continue
+		}
+		name := path.Join(dir, ch.Name())
+		switch ch := ch.(type) {
+		case *dirNode:
+			if err := ch.walk(ctx, name, fn); err != nil {
+				return err
+			}
+		case *blobNode:
+			fn(name, ch)
+		}
+	}
+	return nil
+}
+
+// resolvePrefetch expands pathspecs into the blobs they cover. Plain paths
+// name a file or a whole directory; globs are matched against full paths.
+// Escaped glob characters stand for themselves in both.
+func (n *dirNode) resolvePrefetch(ctx context.Context, pathspecs []string) ([]*blobNode, error) {
+	var (
+		blobs []*blobNode
+		seen  = map[plumbing.Hash]bool{}
+		globs []string
+	)
+	add := func(_ string, blob *blobNode) {
+		if !seen[blob.oid] {
+			seen[blob.oid] = true
+			blobs = append(blobs, blob)
+		}
+	}
+	for _, spec := range pathspecs {
+		if isGlob(spec) {
+			globs = append(globs, strings.Trim(spec, "/"))
+			continue
+		}
+		spec = unescapePath(spec)
+		entry, code := n.find(spec)
+		if code != fuse.OK {
+			log.Debugf("prefetch %s: %v", spec, code)
+			continue
+		}
+		switch entry := entry.(type) {
+		case *dirNode:
+			if err := entry.walk(ctx, strings.Trim(spec, "/"), add); err != nil {
+				return nil, err
+			}
+		case *blobNode:
+			add(spec, entry)
+		}
+	}
+	if len(globs) > 0 {
+		err := n.walk(ctx, "", func(name string, blob *blobNode) {
+			for _, glob := range globs {
+				if ok, _ := path.Match(glob, name); ok {
+					add(name, blob)
+					return
+				}
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return blobs, nil
+}
+
+// warm puts the contents of the blob where Open will look for them.
+func (n *blobNode) warm(ctx context.Context) error {
+	if n.fs.opts.Disk {
+		return n.writeDisk(ctx)
+	}
+	if n.fs.cache.has(n.oid) {
+		return nil
+	}
+	_, err := n.readContents(ctx)
+	return err
+}
+
+func (n *dirNode) Prefetch(ctx context.Context, paths []string, opts PrefetchOptions) (PrefetchProgress, error) {
+	var progress PrefetchProgress
+
+	blobs, err := n.resolvePrefetch(ctx, paths)
+	if err != nil {
+		return progress, err
+	}
+	progress.Total = len(blobs)
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultPrefetchWorkers
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		queue = make(chan *blobNode)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for blob := range queue {
+				err := blob.warm(ctx)
+				mu.Lock()
+				progress.Done++
+				if err != nil {
+					progress.Failed++
+					log.Warnf("prefetch %s: %v", blob.oid, err)
+				} else {
+					progress.Bytes += blob.size
+				}
+				if opts.Progress != nil {
+					opts.Progress(progress)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, blob := range blobs {
+		select {
+		case queue <- blob:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return progress, ctx.Err()
+}
@@ -0,0 +1,42 @@
+package fs
+
+import (
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestEscapePath(t *testing.T) {
+	for _, name := range []string{
+		"plain/file.go",
+		"a*b",
+		"dir?/x",
+		"[id]/page.tsx",
+		`back\slash`,
+		"#notes",
+		"dir/#notes",
+	} {
+		line := EscapePath(name)
+		paths, err := ReadPathList(strings.NewReader(line + "\n"))
+		if err != nil || len(paths) != 1 {
+			t.Errorf("%q: read back %q, %v", name, paths, err)
+			continue
+		}
+		spec := paths[0]
+		if isGlob(spec) {
+			t.Errorf("%q: %q read back as a glob", name, spec)
+		}
+		if got := unescapePath(spec); got != name {
+			t.Errorf("%q: %q read back as %q", name, spec, got)
+		}
+		if ok, err := path.Match(spec, name); !ok || err != nil {
+			t.Errorf("%q: %q does not match it as a glob: %v", name, spec, err)
+		}
+	}
+
+	for _, spec := range []string{"*.go", `a\*b/*`, "dir/[ab]"} {
+		if !isGlob(spec) {
+			t.Errorf("%q not taken for a glob", spec)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package fs
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+)
+
+// rootNode is the filesystem handed out by NewTreeFS. It forwards to the
+// root directory of the current revision, which SetRevision replaces
+// while mounted.
+type rootNode struct {
+	pathfs.FileSystem
+
+	fs       *treeFS
+	gitdir   string
+	worktree string
+
+	mu     sync.RWMutex
+	commit plumbing.Hash
+	dir    *dirNode
+}
+
+func (r *rootNode) root() *dirNode {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.dir
+}
+
+func (r *rootNode) String() string {
+	return "gitfs"
+}
+
+func (r *rootNode) OnMount(nodeFs *pathfs.PathNodeFs) {
+	r.fs.onMount(nodeFs)
+}
+
+func (r *rootNode) GetAttr(name string, context *fuse.Context) (*fuse.Attr, fuse.Status) {
+	return r.root().GetAttr(name, context)
+}
+
+func (r *rootNode) OpenDir(name string, context *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	return r.root().OpenDir(name, context)
+}
+
+func (r *rootNode) Open(name string, flags uint32, context *fuse.Context) (nodefs.File, fuse.Status) {
+	return r.root().Open(name, flags, context)
+}
+
+func (r *rootNode) Readlink(name string, context *fuse.Context) (string, fuse.Status) {
+	return r.root().Readlink(name, context)
+}
+
+func (r *rootNode) Access(name string, mode uint32, context *fuse.Context) fuse.Status {
+	return r.root().Access(name, mode, context)
+}
+
+func (r *rootNode) GetXAttr(name string, attribute string, context *fuse.Context) ([]byte, fuse.Status) {
+	return r.root().GetXAttr(name, attribute, context)
+}
+
+func (r *rootNode) ListXAttr(name string, context *fuse.Context) ([]string, fuse.Status) {
+	return r.root().ListXAttr(name, context)
+}
+
+func (r *rootNode) Prefetch(ctx context.Context, paths []string, opts PrefetchOptions) (PrefetchProgress, error) {
+	return r.root().Prefetch(ctx, paths, opts)
+}
+
+func (r *rootNode) SetSparse(sparse *Sparse) []string {
+	return r.root().SetSparse(sparse)
+}
+
+func (r *rootNode) SetRevision(revision string) ([]string, error) {
+	commit, err := r.fs.store.ResolveCommit(revision)
+	if err != nil {
+		return nil, err
+	}
+	oid, err := r.fs.store.ResolveTree(commit.String())
+	if err != nil {
+		return nil, err
+	}
+	dir := r.fs.newDirNode(r.gitdir, r.worktree, "", "", oid)
+
+	r.mu.Lock()
+	old := r.dir
+	r.commit, r.dir = commit, dir
+	r.mu.Unlock()
+
+	return loadedPaths(old), nil
+}
+
+func loadedPaths(dir *dirNode) []string {
+	var paths []string
+	dir.walkLoaded(func(e gitEntry) {
+		paths = append(paths, e.Path())
+	})
+	return paths
+}
+
+func (r *rootNode) Commit() plumbing.Hash {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.commit
+}
+
+func (r *rootNode) CacheStats() (CacheStats, error) {
+	s := r.fs.cache.stats()
+	var err error
+	s.DiskEntries, s.DiskBytes, err = r.fs.diskCache(false)
+	return s, err
+}
+
+func (r *rootNode) DropCaches() (CacheStats, error) {
+	s := r.fs.cache.clear()
+	var err error
+	s.DiskEntries, s.DiskBytes, err = r.fs.diskCache(true)
+	return s, err
+}
+
+func (r *rootNode) LoadedPaths() []string {
+	return loadedPaths(r.root())
+}
+
+func (r *rootNode) LoadedOid(name string) (plumbing.Hash, bool) {
+	var e gitEntry = r.root()
+	if name == "" {
+		return e.Oid(), true
+	}
+	for _, part := range strings.Split(name, "/") {
+		dir, ok := e.(*dirNode)
+		if !ok {
+			return plumbing.ZeroHash, false
+		}
+		dir.Lock()
+		e, ok = dir.childrenMap[part]
+		loaded := dir.loaded
+		dir.Unlock()
+		if !loaded || !ok {
+			return plumbing.ZeroHash, false
+		}
+	}
+	return e.Oid(), true
+}
@@ -0,0 +1,249 @@
+package fs
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// Sparse decides which paths of the tree are visible, following the
+// patterns of a sparse-checkout file. Files matching cone mode patterns
+// (see git-sparse-checkout(1)) are handled as directory sets, anything
+// else as gitignore style patterns where a match includes the path.
+type Sparse struct {
+	cone bool
+
+	// Cone mode: directories included with everything below them, and
+	// directories of which only the direct files are included.
+	recursive map[string]bool
+	parents   map[string]bool
+
+	lines    []string
+	patterns []gitignore.Pattern
+}
+
+// ParseSparse reads sparse-checkout patterns from r.
+func ParseSparse(r io.Reader) (*Sparse, error) {
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if s, ok := parseCone(lines); ok {
+		return s, nil
+	}
+	return newPatternSparse(lines), nil
+}
+
+func newPatternSparse(lines []string) *Sparse {
+	s := &Sparse{lines: lines}
+	for _, line := range lines {
+		s.patterns = append(s.patterns, gitignore.ParsePattern(line, nil))
+	}
+	return s
+}
+
+// parseCone recognizes the restricted pattern set written by
+// "git sparse-checkout set --cone". It starts with the "/*" and "!/*/"
+// header, without which directory patterns such as "/docs/", as written
+// by --no-cone, keep their gitignore meaning.
+func parseCone(lines []string) (*Sparse, bool) {
+	if len(lines) < 2 || lines[0] != "/*" || lines[1] != "!/*/" {
+		return nil, false
+	}
+	var (
+		dirs        = map[string]bool{}
+		parentsOnly = map[string]bool{}
+	)
+	for _, line := range lines[2:] {
+		switch {
+		case strings.HasPrefix(line, "!/") && strings.HasSuffix(line, "/*/"):
+			dir := strings.TrimSuffix(strings.TrimPrefix(line, "!/"), "/*/")
+			if dir == "" || strings.ContainsAny(dir, "*?[") {
+				return nil, false
+			}
+			parentsOnly[dir] = true
+		case strings.HasPrefix(line, "/") && strings.HasSuffix(line, "/") && len(line) > 2:
+			dir := strings.Trim(line, "/")
+			if strings.ContainsAny(dir, "*?[!") {
+				return nil, false
+			}
+			dirs[dir] = true
+		default:
+			return nil, false
+		}
+	}
+
+	s := &Sparse{
+		cone:      true,
+		recursive: map[string]bool{},
+		parents:   map[string]bool{},
+	}
+	for dir := range dirs {
+		if parentsOnly[dir] {
+			s.parents[dir] = true
+		} else {
+			s.recursive[dir] = true
+		}
+	}
+	return s, true
+}
+
+// NewConeSparse returns a cone mode Sparse including dirs recursively.
+func NewConeSparse(dirs []string) *Sparse {
+	s := &Sparse{
+		cone:      true,
+		recursive: map[string]bool{},
+		parents:   map[string]bool{},
+	}
+	for _, dir := range dirs {
+		dir = strings.Trim(dir, "/")
+		if dir == "" {
+			continue
+		}
+		s.recursive[dir] = true
+		for p := path.Dir(dir); p != "."; p = path.Dir(p) {
+			s.parents[p] = true
+		}
+	}
+	for dir := range s.recursive {
+		delete(s.parents, dir)
+	}
+	return s
+}
+
+// LoadSparse reads the sparse-checkout file at name. It returns nil if
+// the file does not exist.
+func LoadSparse(name string) (*Sparse, error) {
+	f, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseSparse(f)
+}
+
+// Cone reports whether s uses cone mode patterns.
+func (s *Sparse) Cone() bool {
+	return s.cone
+}
+
+// Patterns returns the patterns of s. In cone mode these are the included
+// directories, parents first.
+func (s *Sparse) Patterns() []string {
+	if !s.cone {
+		return append([]string{}, s.lines...)
+	}
+	var dirs []string
+	for dir := range s.recursive {
+		dirs = append(dirs, dir)
+	}
+	for dir := range s.parents {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	return dirs
+}
+
+// Add returns a copy of s that also includes patterns.
+func (s *Sparse) Add(patterns []string) *Sparse {
+	if !s.cone {
+		return newPatternSparse(append(s.Patterns(), patterns...))
+	}
+	var dirs []string
+	for dir := range s.recursive {
+		dirs = append(dirs, dir)
+	}
+	return NewConeSparse(append(dirs, patterns...))
+}
+
+// WriteTo writes s in the sparse-checkout file format.
+func (s *Sparse) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	if !s.cone {
+		for _, p := range s.Patterns() {
+			b.WriteString(p + "\n")
+		}
+	} else {
+		b.WriteString("/*\n!/*/\n")
+		for _, dir := range s.Patterns() {
+			b.WriteString("/" + dir + "/\n")
+			if s.parents[dir] {
+				b.WriteString("!/" + dir + "/*/\n")
+			}
+		}
+	}
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// Includes reports whether the entry at the slash separated name is part
+// of the sparse checkout.
+func (s *Sparse) Includes(name string, isDir bool) bool {
+	if s == nil || name == "" {
+		return true
+	}
+	if s.cone {
+		return s.coneIncludes(name, isDir)
+	}
+
+	parts := strings.Split(name, "/")
+	// A path is included when it or one of its parent directories
+	// matches; the last matching pattern wins.
+	for i := len(parts); i > 0; i-- {
+		dir := i < len(parts) || isDir
+		for j := len(s.patterns) - 1; j >= 0; j-- {
+			switch s.patterns[j].Match(parts[:i], dir) {
+			case gitignore.Exclude:
+				return true
+			case gitignore.Include:
+				return false
+			}
+		}
+	}
+	// Directories are walked so that patterns can match below them.
+	return isDir
+}
+
+func (s *Sparse) coneIncludes(name string, isDir bool) bool {
+	for p := name; p != "."; p = path.Dir(p) {
+		if s.recursive[p] {
+			return true
+		}
+	}
+	if isDir {
+		if s.parents[name] {
+			return true
+		}
+		prefix := name + "/"
+		for dir := range s.recursive {
+			if strings.HasPrefix(dir, prefix) {
+				return true
+			}
+		}
+		for dir := range s.parents {
+			if strings.HasPrefix(dir, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+	dir := path.Dir(name)
+	return dir == "." || s.parents[dir]
+}
@@ -0,0 +1,182 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Object store backends selectable with NewObjectStore.
+const (
+	StoreGoGit   = "go-git"
+	StoreCatFile = "cat-file"
+)
+
+// ObjectStore reads the git objects a tree filesystem is built from.
+// Implementations must be safe for concurrent use and return
+// plumbing.ErrObjectNotFound for objects they do not have.
+type ObjectStore interface {
+	// ResolveCommit returns the commit named by revision.
+	ResolveCommit(revision string) (plumbing.Hash, error)
+
+	// ResolveTree returns the root tree of the commit named by revision.
+	ResolveTree(revision string) (plumbing.Hash, error)
+
+	// Tree returns the entries of a tree object.
+	Tree(oid plumbing.Hash) ([]object.TreeEntry, error)
+
+	// BlobSize returns the size of a blob without reading it.
+	BlobSize(oid plumbing.Hash) (int64, error)
+
+	// Blob returns the contents of a blob. The reader must be closed.
+	Blob(oid plumbing.Hash) (io.ReadCloser, error)
+
+	Close() error
+}
+
+// NewObjectStore opens the repository at gitdir with the named backend.
+func NewObjectStore(gitdir, backend string) (ObjectStore, error) {
+	switch backend {
+	case "", StoreGoGit:
+		return newGoGitStore(gitdir)
+	case StoreCatFile:
+		return newCatFileStore(gitdir, DefaultCatFileProcs)
+	default:
+		return nil, fmt.Errorf("unknown object store %q", backend)
+	}
+}
+
+// DefaultGoGitRepos is the number of opened copies of the repository the
+// go-git object store keeps.
+const DefaultGoGitRepos = 4
+
+// goGitStore reads objects with go-git. The object storage of go-git is
+// not safe for concurrent use: it caches loose objects before they are
+// fully read, builds its pack indexes lazily and shares them. Each call
+// borrows a copy of the repository of its own instead. The contents of a
+// blob are read in full before its reader is returned, so reading them
+// needs no repository at all.
+type goGitStore struct {
+	gitdir string
+	repos  chan *gogit.Repository
+	slots  chan struct{}
+}
+
+func newGoGitStore(gitdir string) (*goGitStore, error) {
+	s := &goGitStore{
+		gitdir: gitdir,
+		repos:  make(chan *gogit.Repository, DefaultGoGitRepos),
+		slots:  make(chan struct{}, DefaultGoGitRepos),
+	}
+	// Fail early on something that is not a repository.
+	repository, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	s.put(repository)
+	return s, nil
+}
+
+// get borrows a copy of the repository, opening one if fewer than
+// DefaultGoGitRepos are.
+func (s *goGitStore) get() (*gogit.Repository, error) {
+	select {
+	case repository := <-s.repos:
+		return repository, nil
+	default:
+	}
+	select {
+	case repository := <-s.repos:
+		return repository, nil
+	case s.slots <- struct{}{}:
+	}
+	repository, err := gogit.PlainOpen(s.gitdir)
+	if err != nil {
+		<-s.slots
+		return nil, err
+	}
+	return repository, nil
+}
+
+func (s *goGitStore) put(repository *gogit.Repository) {
+	s.repos <- repository
+}
+
+func (s *goGitStore) commit(revision string) (*object.Commit, error) {
+	repository, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	defer s.put(repository)
+	oid, err := repository.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, fmt.Errorf("resolve revision: %v", err)
+	}
+	commit, err := repository.CommitObject(*oid)
+	if err != nil {
+		return nil, fmt.Errorf("commit object: %v", err)
+	}
+	return commit, nil
+}
+
+func (s *goGitStore) ResolveCommit(revision string) (plumbing.Hash, error) {
+	commit, err := s.commit(revision)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return commit.Hash, nil
+}
+
+func (s *goGitStore) ResolveTree(revision string) (plumbing.Hash, error) {
+	commit, err := s.commit(revision)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return commit.TreeHash, nil
+}
+
+func (s *goGitStore) Tree(oid plumbing.Hash) ([]object.TreeEntry, error) {
+	repository, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	defer s.put(repository)
+	tree, err := repository.TreeObject(oid)
+	if err != nil {
+		return nil, err
+	}
+	return tree.Entries, nil
+}
+
+func (s *goGitStore) BlobSize(oid plumbing.Hash) (int64, error) {
+	repository, err := s.get()
+	if err != nil {
+		return 0, err
+	}
+	defer s.put(repository)
+	blob, err := repository.BlobObject(oid)
+	if err != nil {
+		return 0, err
+	}
+	return blob.Size, nil
+}
+
+func (s *goGitStore) Blob(oid plumbing.Hash) (io.ReadCloser, error) {
+	repository, err := s.get()
+	if err != nil {
+		return nil, err
+	}
+	defer s.put(repository)
+	blob, err := repository.BlobObject(oid)
+	if err != nil {
+		return nil, err
+	}
+	return blob.Reader()
+}
+
+func (s *goGitStore) Close() error {
+	return nil
+}
@@ -0,0 +1,278 @@
+package fs
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+// missingOid is an object no fixture has.
+var missingOid = plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")
+
+// storeFixture is a fixture and the objects git itself reports in it.
+type storeFixture struct {
+	*fixture
+	commit plumbing.Hash
+	tree   plumbing.Hash
+	// blobs maps the path of every file to its blob.
+	blobs map[string]plumbing.Hash
+}
+
+// newStoreFixture creates a fixture, with its objects loose or packed.
+func newStoreFixture(t testing.TB, packed bool) *storeFixture {
+	f := &storeFixture{fixture: newFixture(t, 3), blobs: map[string]plumbing.Hash{}}
+	if packed {
+		f.git(t, "gc", "-q")
+	}
+	f.commit = plumbing.NewHash(strings.TrimSpace(f.git(t, "rev-parse", "master")))
+	f.tree = plumbing.NewHash(strings.TrimSpace(f.git(t, "rev-parse", "master^{tree}")))
+	for name := range f.files {
+		f.blobs[name] = plumbing.NewHash(strings.TrimSpace(f.git(t, "rev-parse", "master:"+name)))
+	}
+	return f
+}
+
+func readBlob(s ObjectStore, oid plumbing.Hash) (string, error) {
+	r, err := s.Blob(oid)
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(r)
+	if cerr := r.Close(); err == nil {
+		err = cerr
+	}
+	return string(data), err
+}
+
+var storeCases = []struct {
+	name string
+	run  func(t *testing.T, s ObjectStore, f *storeFixture)
+}{
+	{"ResolveCommit", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		for _, revision := range []string{"master", "HEAD", f.commit.String()} {
+			if oid, err := s.ResolveCommit(revision); err != nil || oid != f.commit {
+				t.Errorf("ResolveCommit(%s) = %s, %v, want %s", revision, oid, err, f.commit)
+			}
+		}
+	}},
+	{"ResolveCommitMissing", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		for _, revision := range []string{"nosuchbranch", missingOid.String()} {
+			if oid, err := s.ResolveCommit(revision); err == nil {
+				t.Errorf("ResolveCommit(%s) = %s, want an error", revision, oid)
+			}
+		}
+	}},
+	{"ResolveTree", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		for _, revision := range []string{"master", f.commit.String()} {
+			if oid, err := s.ResolveTree(revision); err != nil || oid != f.tree {
+				t.Errorf("ResolveTree(%s) = %s, %v, want %s", revision, oid, err, f.tree)
+			}
+		}
+		if oid, err := s.ResolveTree("nosuchbranch"); err == nil {
+			t.Errorf("ResolveTree(nosuchbranch) = %s, want an error", oid)
+		}
+	}},
+	{"Tree", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		entries, err := s.Tree(f.tree)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, e := range entries {
+			got = append(got, fmt.Sprintf("%s %o", e.Name, e.Mode))
+		}
+		want := []string{
+			fmt.Sprintf("README %o", filemode.Regular),
+			fmt.Sprintf("link %o", filemode.Symlink),
+		}
+		for _, dir := range f.dirs {
+			if !strings.Contains(dir, "/") {
+				want = append(want, fmt.Sprintf("%s %o", dir, filemode.Dir))
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("Tree = %v, want %v", got, want)
+		}
+		for _, e := range entries {
+			if e.Name == "README" && e.Hash != f.blobs["README"] {
+				t.Errorf("README is %s, want %s", e.Hash, f.blobs["README"])
+			}
+		}
+	}},
+	{"TreeMissing", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		if _, err := s.Tree(missingOid); err != plumbing.ErrObjectNotFound {
+			t.Errorf("Tree(missing) = %v, want %v", err, plumbing.ErrObjectNotFound)
+		}
+		if _, err := s.Tree(f.blobs["README"]); err != plumbing.ErrObjectNotFound {
+			t.Errorf("Tree(blob) = %v, want %v", err, plumbing.ErrObjectNotFound)
+		}
+	}},
+	{"BlobSize", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		for name, oid := range f.blobs {
+			if size, err := s.BlobSize(oid); err != nil || size != int64(len(f.files[name])) {
+				t.Errorf("BlobSize(%s) = %d, %v, want %d", name, size, err, len(f.files[name]))
+			}
+		}
+	}},
+	{"BlobSizeMissing", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		if _, err := s.BlobSize(missingOid); err != plumbing.ErrObjectNotFound {
+			t.Errorf("BlobSize(missing) = %v, want %v", err, plumbing.ErrObjectNotFound)
+		}
+		if _, err := s.BlobSize(f.tree); err != plumbing.ErrObjectNotFound {
+			t.Errorf("BlobSize(tree) = %v, want %v", err, plumbing.ErrObjectNotFound)
+		}
+	}},
+	{"Blob", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		for name, oid := range f.blobs {
+			if got, err := readBlob(s, oid); err != nil || got != f.files[name] {
+				t.Errorf("Blob(%s) = %q, %v, want %q", name, got, err, f.files[name])
+			}
+		}
+	}},
+	{"BlobMissing", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		if _, err := s.Blob(missingOid); err != plumbing.ErrObjectNotFound {
+			t.Errorf("Blob(missing) = %v, want %v", err, plumbing.ErrObjectNotFound)
+		}
+		if _, err := s.Blob(f.tree); err != plumbing.ErrObjectNotFound {
+			t.Errorf("Blob(tree) = %v, want %v", err, plumbing.ErrObjectNotFound)
+		}
+		// The store still answers after a miss.
+		if got, err := readBlob(s, f.blobs["README"]); err != nil || got != f.files["README"] {
+			t.Errorf("Blob(README) after a miss = %q, %v", got, err)
+		}
+	}},
+	{"BlobPartialRead", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		// A reader closed before the end must not leave the rest of the
+		// blob behind for the next reads.
+		for i := 0; i < 2*DefaultCatFileProcs; i++ {
+			r, err := s.Blob(f.blobs["README"])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := r.Read(make([]byte, 1)); err != nil {
+				t.Fatal(err)
+			}
+			r.Close()
+		}
+		for name, oid := range f.blobs {
+			if got, err := readBlob(s, oid); err != nil || got != f.files[name] {
+				t.Errorf("Blob(%s) = %q, %v, want %q", name, got, err, f.files[name])
+			}
+		}
+	}},
+	{"Concurrent", func(t *testing.T, s ObjectStore, f *storeFixture) {
+		// Many more readers than cat-file processes, mixing every call.
+		var names []string
+		for name := range f.blobs {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var wg sync.WaitGroup
+		for w := 0; w < 8*DefaultCatFileProcs; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for i := range names {
+					name := names[(i+w)%len(names)]
+					oid := f.blobs[name]
+					switch (i + w) % 4 {
+					case 0:
+						if size, err := s.BlobSize(oid); err != nil || size != int64(len(f.files[name])) {
+							t.Errorf("BlobSize(%s) = %d, %v", name, size, err)
+						}
+					case 1:
+						if _, err := s.Tree(f.tree); err != nil {
+							t.Errorf("Tree: %v", err)
+						}
+					case 2:
+						if _, err := s.Blob(missingOid); err != plumbing.ErrObjectNotFound {
+							t.Errorf("Blob(missing) = %v", err)
+						}
+					}
+					if got, err := readBlob(s, oid); err != nil || got != f.files[name] {
+						t.Errorf("Blob(%s) = %q, %v, want %q", name, got, err, f.files[name])
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+	}},
+}
+
+// TestObjectStores runs the same cases against every backend.
+func TestObjectStores(t *testing.T) {
+	for _, packed := range []bool{false, true} {
+		f := newStoreFixture(t, packed)
+		for _, backend := range []string{StoreGoGit, StoreCatFile} {
+			t.Run(fmt.Sprintf("%s/packed=%v", backend, packed), func(t *testing.T) {
+				for _, c := range storeCases {
+					t.Run(c.name, func(t *testing.T) {
+						s, err := NewObjectStore(f.gitdir, backend)
+						if err != nil {
+							t.Fatal(err)
+						}
+						defer s.Close()
+						c.run(t, s, f)
+					})
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkObjectStores reads every blob of a packed fixture, one of them
+// large, from many goroutines at once.
+func BenchmarkObjectStores(b *testing.B) {
+	f := newStoreFixture(b, false)
+	large := strings.Repeat("large blob\n", 1<<17)
+	if err := ioutil.WriteFile(filepath.Join(f.gitdir, "large"), []byte(large), 0644); err != nil {
+		b.Fatal(err)
+	}
+	f.git(b, "add", "large")
+	f.git(b, "commit", "-q", "-m", "large")
+	f.git(b, "gc", "-q")
+	f.blobs["large"] = plumbing.NewHash(strings.TrimSpace(f.git(b, "rev-parse", "master:large")))
+	for _, backend := range []string{StoreGoGit, StoreCatFile} {
+		b.Run(backend, func(b *testing.B) {
+			s, err := NewObjectStore(f.gitdir, backend)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer s.Close()
+			var oids []plumbing.Hash
+			for _, oid := range f.blobs {
+				oids = append(oids, oid)
+			}
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, err := readBlob(s, oids[i%len(oids)]); err != nil {
+						b.Error(err)
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestNewObjectStore(t *testing.T) {
+	if _, err := NewObjectStore(t.TempDir(), "svn"); err == nil {
+		t.Error("unknown backend opened")
+	}
+	for _, backend := range []string{StoreGoGit, StoreCatFile} {
+		if s, err := NewObjectStore(t.TempDir(), backend); err == nil {
+			s.Close()
+			t.Errorf("%s opened a directory that is not a repository", backend)
+		}
+	}
+}
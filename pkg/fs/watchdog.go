@@ -0,0 +1,225 @@
+package fs
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/logging"
+)
+
+// The policies of the watchdog for hung operations.
+const (
+	// WatchdogLog only reports hung operations.
+	WatchdogLog = "log"
+	// WatchdogEIO fails hung operations with EIO.
+	WatchdogEIO = "eio"
+	// WatchdogEINTR fails hung operations with EINTR.
+	WatchdogEINTR = "eintr"
+)
+
+// WatchdogOptions say when an operation is hung and what happens to it.
+type WatchdogOptions struct {
+	// Threshold is how long an operation runs before it is hung, there is
+	// no watchdog if zero.
+	Threshold time.Duration
+	// Policy is one of WatchdogLog, WatchdogEIO and WatchdogEINTR,
+	// WatchdogLog if empty. A failed operation goes on in the background,
+	// its result is dropped. To be able to give up on them, the policies
+	// failing operations run every operation in a goroutine of its own,
+	// with a copy of its context and a buffer of its own for a read.
+	Policy string
+}
+
+// CheckWatchdogPolicy returns an error if policy is not a known policy.
+func CheckWatchdogPolicy(policy string) error {
+	switch policy {
+	case "", WatchdogLog, WatchdogEIO, WatchdogEINTR:
+		return nil
+	}
+	return fmt.Errorf("unknown watchdog policy %q, %s, %s or %s", policy, WatchdogLog, WatchdogEIO, WatchdogEINTR)
+}
+
+// failStatus is what hung operations fail with, OK if they go on.
+func (o WatchdogOptions) failStatus() fuse.Status {
+	switch o.Policy {
+	case WatchdogEIO:
+		return fuse.EIO
+	case WatchdogEINTR:
+		return fuse.EINTR
+	}
+	return fuse.OK
+}
+
+// minDumpInterval is the least time between two goroutine dumps, which
+// are large.
+const minDumpInterval = time.Minute
+
+type inflightOp struct {
+	op    string
+	path  string
+	start time.Time
+}
+
+// watchdog tracks the operations in flight on an instrumentedFS and
+// reports those running past the threshold.
+type watchdog struct {
+	fs *instrumentedFS
+
+	mu       sync.Mutex
+	next     uint64
+	inflight map[uint64]*inflightOp
+
+	// lastDump is when the goroutines were last dumped, in unix
+	// nanoseconds, for hung operations piling up to dump them once.
+	lastDump int64
+}
+
+// watch tracks op on name until the returned func is called.
+func (w *watchdog) watch(op, name string) func() {
+	o := &inflightOp{op: op, path: name, start: time.Now()}
+	w.mu.Lock()
+	id := w.next
+	w.next++
+	w.inflight[id] = o
+	w.mu.Unlock()
+
+	timer := time.AfterFunc(w.fs.opts.Watchdog.Threshold, func() { w.report(o) })
+	return func() {
+		timer.Stop()
+		w.mu.Lock()
+		delete(w.inflight, id)
+		w.mu.Unlock()
+	}
+}
+
+func (w *watchdog) report(o *inflightOp) {
+	hungOps.With(w.fs.opts.Worktree, o.op).Inc()
+	w.mu.Lock()
+	inflight := len(w.inflight)
+	w.mu.Unlock()
+
+	entry := w.fs.entry(o.op, o.path).WithField(logging.FieldLatency, time.Since(o.start).Seconds())
+	entry.Warnf("operation hung, %d in flight", inflight)
+
+	interval := w.fs.opts.Watchdog.Threshold
+	if interval < minDumpInterval {
+		interval = minDumpInterval
+	}
+	now := time.Now().UnixNano()
+	last := atomic.LoadInt64(&w.lastDump)
+	if now-last < int64(interval) || !atomic.CompareAndSwapInt64(&w.lastDump, last, now) {
+		return
+	}
+	entry.Warnf("goroutines:\n%s", stacks())
+}
+
+// stacks returns the stacks of every goroutine.
+func stacks() []byte {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			return buf[:n]
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+// call runs fn, which does op on name, timing and logging it and watching
+// it if there is a watchdog. If the policy fails hung operations, fn runs
+// in its own goroutine and call returns the status of the policy once it
+// hangs, with ok unset: the results of fn must then be left alone, and
+// abandon, if set, is called with them once fn returns.
+func (f *instrumentedFS) call(op, name string, fn func() fuse.Status, abandon func()) (code fuse.Status, ok bool) {
+	done := f.begin(op, name)
+	if f.watchdog == nil {
+		code = fn()
+		done(code)
+		return code, true
+	}
+	stop := f.watchdog.watch(op, name)
+	fail := f.opts.Watchdog.failStatus()
+	if fail == fuse.OK {
+		code = fn()
+		stop()
+		done(code)
+		return code, true
+	}
+
+	result := make(chan fuse.Status, 1)
+	go func() { result <- fn() }()
+	timer := time.NewTimer(f.opts.Watchdog.Threshold)
+	defer timer.Stop()
+	select {
+	case code = <-result:
+		stop()
+		done(code)
+		return code, true
+	case <-timer.C:
+		done(fail)
+		go func() {
+			<-result
+			stop()
+			if abandon != nil {
+				abandon()
+			}
+		}()
+		return fail, false
+	}
+}
+
+// detaching reports whether call may give up on operations.
+func (f *instrumentedFS) detaching() bool {
+	return f.watchdog != nil && f.opts.Watchdog.failStatus() != fuse.OK
+}
+
+// detach returns what fn can use of the arguments of a request after call
+// gave up on it: go-fuse reuses them for the next requests. Read gets a
+// buffer of its own instead of dest, from readBufs. They are kept as they
+// are if the policy never gives up on fn.
+func (f *instrumentedFS) detach(context *fuse.Context, dest []byte) (*fuse.Context, []byte) {
+	if !f.detaching() {
+		return context, dest
+	}
+	var c *fuse.Context
+	if context != nil {
+		copied := *context
+		c = &copied
+	}
+	if dest != nil {
+		dest = getReadBuf(len(dest))
+	}
+	return c, dest
+}
+
+// readBufs holds the buffers of detached reads that were done with, for
+// the next reads not to allocate one each.
+var readBufs sync.Pool
+
+func getReadBuf(size int) []byte {
+	if buf, ok := readBufs.Get().(*[]byte); ok && cap(*buf) >= size {
+		return (*buf)[:size]
+	}
+	return make([]byte, size)
+}
+
+func putReadBuf(buf []byte) {
+	readBufs.Put(&buf)
+}
+
+// pooledResult is the result of a detached read, whose buffer goes back
+// to readBufs once go-fuse sent the data.
+type pooledResult struct {
+	fuse.ReadResult
+	buf []byte
+}
+
+func (r *pooledResult) Done() {
+	r.ReadResult.Done()
+	putReadBuf(r.buf)
+}
@@ -0,0 +1,125 @@
+// Package logging sets up the structured logs of the processes serving
+// worktrees: the format of every line, the fields operations are logged
+// with and the log file of each worktree.
+package logging
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The fields the operations on a worktree are logged with.
+const (
+	FieldWorktree = "worktree"
+	FieldOp       = "op"
+	FieldPath     = "path"
+	FieldOid      = "oid"
+	FieldStatus   = "status"
+	// FieldLatency is the duration of the operation in seconds.
+	FieldLatency = "latency"
+)
+
+// The formats of the lines of the logs.
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+// NewFormatter returns the formatter of the named format.
+func NewFormatter(format string) (log.Formatter, error) {
+	switch format {
+	case "", FormatText:
+		return &log.TextFormatter{FullTimestamp: true}, nil
+	case FormatJSON:
+		return &log.JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, %s or %s", format, FormatText, FormatJSON)
+}
+
+// SetFormat sets the format of the logs of the process.
+func SetFormat(format string) error {
+	formatter, err := NewFormatter(format)
+	if err != nil {
+		return err
+	}
+	log.SetFormatter(formatter)
+	return nil
+}
+
+// Options says where the log of a worktree goes.
+type Options struct {
+	// Format is the format of the lines, the text format if empty.
+	Format string
+
+	// File is the log file of the worktree. If empty, the worktree logs
+	// to the log of the process.
+	File string
+	// MaxSize is the size in bytes past which File is rotated,
+	// DefaultMaxSize if zero.
+	MaxSize int64
+	// Backups is the number of rotated files kept.
+	Backups int
+}
+
+// Logger is the log of a worktree.
+type Logger struct {
+	*log.Entry
+
+	file *RotatingFile
+}
+
+var (
+	mu      sync.Mutex
+	loggers = map[*Logger]bool{}
+)
+
+// Open returns the log of the worktree name. Its lines carry the name of
+// the worktree, and its level follows the level of the process set with
+// SetLevel.
+func Open(name string, opts Options) (*Logger, error) {
+	if opts.File == "" {
+		return &Logger{Entry: log.WithField(FieldWorktree, name)}, nil
+	}
+	formatter, err := NewFormatter(opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	file, err := OpenRotatingFile(opts.File, opts.MaxSize, opts.Backups)
+	if err != nil {
+		return nil, err
+	}
+	logger := log.New()
+	logger.SetOutput(file)
+	logger.SetFormatter(formatter)
+
+	mu.Lock()
+	defer mu.Unlock()
+	logger.SetLevel(log.GetLevel())
+	l := &Logger{Entry: log.NewEntry(logger).WithField(FieldWorktree, name), file: file}
+	loggers[l] = true
+	return l, nil
+}
+
+// Close closes the log file of the worktree, if it has one.
+func (l *Logger) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	mu.Lock()
+	delete(loggers, l)
+	mu.Unlock()
+	return l.file.Close()
+}
+
+// SetLevel sets the level of the process and of the logs of every
+// worktree it serves.
+func SetLevel(level log.Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	log.SetLevel(level)
+	for l := range loggers {
+		l.Logger.SetLevel(level)
+	}
+}
@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// DefaultMaxSize is the size a log file is rotated at by default.
+const DefaultMaxSize = 10 << 20
+
+// RotatingFile is a log file that is renamed to <file>.1 once it grows
+// past its max size, <file>.1 to <file>.2 and so on up to the number of
+// backups kept.
+type RotatingFile struct {
+	name    string
+	maxSize int64
+	backups int
+
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens name for appending, rotating it at maxSize bytes,
+// DefaultMaxSize if zero, and keeping backups rotated files.
+func OpenRotatingFile(name string, maxSize int64, backups int) (*RotatingFile, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	r := &RotatingFile{name: name, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size = f, fi.Size()
+	return nil
+}
+
+// rotate moves the file out of the way of a new one. The new file is
+// opened even if renaming failed, for the log to go on.
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	err := r.shift()
+	if oerr := r.open(); err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func (r *RotatingFile) shift() error {
+	if r.backups <= 0 {
+		if err := os.Remove(r.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	for i := r.backups - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.name, r.name+".1"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Write writes p to the file, rotating it first if p would take it past
+// its max size. A line is never split between two files.
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,302 @@
+// Package metrics keeps counters and histograms and writes them in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// LatencyBuckets are the upper bounds, in seconds, of the buckets of the
+// latency histograms: from the 100µs of a cached lookup to the seconds of
+// a blob read from a slow disk.
+var LatencyBuckets = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// sample is one series of a metric, or all the series of a histogram.
+type sample interface {
+	write(w *bufio.Writer, name, labels string)
+}
+
+// family is a metric with its series, one per set of label values.
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	newFn  func() sample
+
+	mu       sync.RWMutex
+	children map[string]*child
+}
+
+type child struct {
+	values []string
+	labels string
+	s      sample
+}
+
+func (f *family) with(values []string) sample {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	f.mu.RLock()
+	c, ok := f.children[key]
+	f.mu.RUnlock()
+	if ok {
+		return c.s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c, ok := f.children[key]; ok {
+		return c.s
+	}
+	c = &child{
+		values: append([]string(nil), values...),
+		labels: formatLabels(f.labels, values),
+		s:      f.newFn(),
+	}
+	f.children[key] = c
+	return c.s
+}
+
+// each calls fn for every series with its label values.
+func (f *family) each(fn func(values []string, s sample)) {
+	f.mu.RLock()
+	children := make([]*child, 0, len(f.children))
+	for _, c := range f.children {
+		children = append(children, c)
+	}
+	f.mu.RUnlock()
+	for _, c := range children {
+		fn(c.values, c.s)
+	}
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escape(f.help, false))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.typ)
+	keys := make([]string, 0, len(f.children))
+	for k := range f.children {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		c := f.children[k]
+		c.s.write(w, f.name, c.labels)
+	}
+}
+
+// escape escapes a help text, or a label value if quote is set.
+func escape(s string, quote bool) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	if quote {
+		s = strings.ReplaceAll(s, `"`, `\"`)
+	}
+	return s
+}
+
+// formatLabels returns the pairs of names and values the way they follow
+// a metric name, without the braces.
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, escape(values[i], true))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Registry holds the metrics written together.
+type Registry struct {
+	mu       sync.Mutex
+	families []*family
+}
+
+// Default is the registry the New functions register with.
+var Default = &Registry{}
+
+func (r *Registry) register(f *family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, g := range r.families {
+		if g.name == f.name {
+			panic("metrics: " + f.name + " registered twice")
+		}
+	}
+	r.families = append(r.families, f)
+}
+
+// WriteText writes every metric in the text exposition format.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.mu.Lock()
+	families := append([]*family(nil), r.families...)
+	r.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		f.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Counter is a value that only goes up.
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w *bufio.Writer, name, labels string) {
+	fmt.Fprintf(w, "%s%s %d\n", name, braces(labels), c.Value())
+}
+
+// NewCounter registers a counter without labels.
+func NewCounter(name, help string) *Counter {
+	return NewCounterVec(name, help).With()
+}
+
+// CounterVec is a counter with a series per set of label values.
+type CounterVec struct {
+	f *family
+}
+
+// NewCounterVec registers a counter with the named labels.
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	f := &family{
+		name:     name,
+		help:     help,
+		typ:      "counter",
+		labels:   labels,
+		newFn:    func() sample { return &Counter{} },
+		children: map[string]*child{},
+	}
+	Default.register(f)
+	return &CounterVec{f}
+}
+
+// With returns the counter of the label values, in the order of the
+// label names.
+func (v *CounterVec) With(values ...string) *Counter {
+	return v.f.with(values).(*Counter)
+}
+
+// Each calls fn for every counter with its label values.
+func (v *CounterVec) Each(fn func(values []string, c *Counter)) {
+	v.f.each(func(values []string, s sample) { fn(values, s.(*Counter)) })
+}
+
+// Histogram counts observations in buckets of increasing upper bounds.
+type Histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// Count returns the number of observations and their sum.
+func (h *Histogram) Count() (uint64, float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.count, h.sum
+}
+
+func (h *Histogram) write(w *bufio.Writer, name, labels string) {
+	h.mu.Lock()
+	counts := append([]uint64(nil), h.counts...)
+	sum, count := h.sum, h.count
+	h.mu.Unlock()
+
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	cumulative := uint64(0)
+	for i, bound := range h.bounds {
+		cumulative += counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), count)
+}
+
+// HistogramVec is a histogram with a series per set of label values.
+type HistogramVec struct {
+	f *family
+}
+
+// NewHistogramVec registers a histogram with the given bucket bounds,
+// sorted, and the named labels.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	f := &family{
+		name:   name,
+		help:   help,
+		typ:    "histogram",
+		labels: labels,
+		newFn: func() sample {
+			return &Histogram{bounds: buckets, counts: make([]uint64, len(buckets))}
+		},
+		children: map[string]*child{},
+	}
+	Default.register(f)
+	return &HistogramVec{f}
+}
+
+// With returns the histogram of the label values, in the order of the
+// label names.
+func (v *HistogramVec) With(values ...string) *Histogram {
+	return v.f.with(values).(*Histogram)
+}
+
+// Each calls fn for every histogram with its label values.
+func (v *HistogramVec) Each(fn func(values []string, h *Histogram)) {
+	v.f.each(func(values []string, s sample) { fn(values, s.(*Histogram)) })
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Handler serves the metrics of r.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteText(w)
+	})
+}
+
+// Listen listens on addr, a unix socket if it starts with "unix:" or
+// contains a slash, a local TCP address otherwise. A TCP address without
+// a host listens on the loopback interface only; other hosts have to be
+// loopback addresses too, the metrics are not meant to leave the host.
+func Listen(addr string) (net.Listener, error) {
+	if strings.HasPrefix(addr, "unix:") || strings.Contains(addr, "/") {
+		sock := strings.TrimPrefix(addr, "unix:")
+		// A socket left behind by a process that died has nobody
+		// listening.
+		if conn, err := net.Dial("unix", sock); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is in use", sock)
+		}
+		os.Remove(sock)
+		return net.Listen("unix", sock)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch host {
+	case "":
+		host = "127.0.0.1"
+	case "localhost":
+	default:
+		if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+			return nil, fmt.Errorf("%s is not a loopback address", host)
+		}
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, port))
+}
+
+// Serve serves the metrics of the default registry on l at /metrics
+// until l is closed.
+func Serve(l net.Listener) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler(Default))
+	return http.Serve(l, mux)
+}
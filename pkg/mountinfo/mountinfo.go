@@ -0,0 +1,220 @@
+// Package mountinfo reads the mount table of the kernel and recognizes
+// the worktrees mounted by this program in it.
+package mountinfo
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Subtype is the FUSE subtype of our mounts; they show up in the mount
+// table as fuse.git-fuse-worktree.
+const Subtype = "git-fuse-worktree"
+
+// Mount is a line of /proc/self/mountinfo, see proc(5).
+type Mount struct {
+	ID       int
+	Parent   int
+	Major    int
+	Minor    int
+	Root     string
+	Path     string
+	Options  string
+	Optional []string
+	FSType   string
+	Source   string
+	// SuperOptions are the options of the superblock.
+	SuperOptions string
+}
+
+// unescape decodes the octal escapes the kernel writes for spaces, tabs,
+// newlines and backslashes in paths.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func parseLine(line string) (Mount, error) {
+	fields := strings.Fields(line)
+	sep := -1
+	for i, f := range fields {
+		if f == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 6 || len(fields) < sep+4 {
+		return Mount{}, fmt.Errorf("bad mountinfo line %q", line)
+	}
+	var m Mount
+	var err error
+	if m.ID, err = strconv.Atoi(fields[0]); err != nil {
+		return m, fmt.Errorf("bad mountinfo line %q: %v", line, err)
+	}
+	if m.Parent, err = strconv.Atoi(fields[1]); err != nil {
+		return m, fmt.Errorf("bad mountinfo line %q: %v", line, err)
+	}
+	if _, err := fmt.Sscanf(fields[2], "%d:%d", &m.Major, &m.Minor); err != nil {
+		return m, fmt.Errorf("bad mountinfo line %q: %v", line, err)
+	}
+	m.Root = unescape(fields[3])
+	m.Path = unescape(fields[4])
+	m.Options = fields[5]
+	m.Optional = fields[6:sep]
+	m.FSType = fields[sep+1]
+	m.Source = unescape(fields[sep+2])
+	m.SuperOptions = fields[sep+3]
+	return m, nil
+}
+
+// Parse reads a mountinfo file.
+func Parse(r io.Reader) ([]Mount, error) {
+	var mounts []Mount
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if scanner.Text() == "" {
+			continue
+		}
+		m, err := parseLine(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, m)
+	}
+	return mounts, scanner.Err()
+}
+
+// Mounts returns the mount table of this process.
+func Mounts() ([]Mount, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Parse(f)
+}
+
+// realPath resolves the symlinks of the parent of p, the way the kernel
+// reports mountpoints. p itself is left alone since a stale mount cannot
+// be resolved.
+func realPath(p string) string {
+	p, err := filepath.Abs(p)
+	if err != nil {
+		return p
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(p))
+	if err != nil {
+		return p
+	}
+	return filepath.Join(dir, filepath.Base(p))
+}
+
+// Lookup returns the mount at mountpoint, the one on top if several are
+// stacked there, or nil if nothing is mounted there.
+func Lookup(mountpoint string) (*Mount, error) {
+	mounts, err := Mounts()
+	if err != nil {
+		return nil, err
+	}
+	mountpoint = realPath(mountpoint)
+	var found *Mount
+	for i := range mounts {
+		if mounts[i].Path == mountpoint {
+			found = &mounts[i]
+		}
+	}
+	return found, nil
+}
+
+// Stale reports whether the mount at mountpoint lost its FUSE server:
+// its root gives ENOTCONN, or ECONNABORTED once the connection was
+// aborted.
+func Stale(mountpoint string) bool {
+	_, err := os.Stat(mountpoint)
+	return errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.ECONNABORTED)
+}
+
+// fsNameEscaper keeps the separator of FsName and the commas of the
+// mount options out of the names.
+var (
+	fsNameEscaper   = strings.NewReplacer("%", "%25", ",", "%2C", "#", "%23", " ", "%20")
+	fsNameUnescaper = strings.NewReplacer("%25", "%", "%2C", ",", "%23", "#", "%20", " ")
+)
+
+// FsName is the source of the mount of the worktree name of the
+// repository at gitDir, <git-dir>#<name> with both escaped.
+func FsName(gitDir, name string) string {
+	return fsNameEscaper.Replace(filepath.Clean(gitDir)) + "#" + fsNameEscaper.Replace(name)
+}
+
+// Worktree returns the repository and name of the worktree mounted by m,
+// with ok unset if m is not one of our mounts.
+func (m *Mount) Worktree() (gitDir, name string, ok bool) {
+	if m.FSType != "fuse."+Subtype {
+		return "", "", false
+	}
+	i := strings.LastIndexByte(m.Source, '#')
+	if i < 0 {
+		return "", "", false
+	}
+	return fsNameUnescaper.Replace(m.Source[:i]), fsNameUnescaper.Replace(m.Source[i+1:]), true
+}
+
+// IsWorktree reports whether m is the mount of the worktree name of the
+// repository at gitDir.
+func (m *Mount) IsWorktree(gitDir, name string) bool {
+	dir, n, ok := m.Worktree()
+	return ok && dir == filepath.Clean(gitDir) && n == name
+}
+
+// Worktrees returns our mounts, of the repository at gitDir if it is set.
+func Worktrees(gitDir string) ([]Mount, error) {
+	mounts, err := Mounts()
+	if err != nil {
+		return nil, err
+	}
+	var ours []Mount
+	for _, m := range mounts {
+		dir, _, ok := m.Worktree()
+		if ok && (gitDir == "" || dir == filepath.Clean(gitDir)) {
+			ours = append(ours, m)
+		}
+	}
+	return ours, nil
+}
+
+// Fusermount returns the fusermount binary to run, fusermount3 if it is
+// installed.
+func Fusermount() (string, error) {
+	for _, name := range []string{"fusermount3", "fusermount"} {
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+		// PATH may be empty for a process started by a service manager.
+		if p, err := exec.LookPath(filepath.Join("/bin", name)); err == nil {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("neither fusermount3 nor fusermount is installed")
+}
@@ -0,0 +1,121 @@
+package oci
+
+import (
+	"archive/tar"
+	"fmt"
+	"runtime"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/worktrees"
+)
+
+// Options control how a worktree is exported.
+type Options struct {
+	// Ref names the image in the index of the layout.
+	Ref string
+	// Time is the time of every file in the layers and of the image
+	// itself. If zero, the committer time of the base commit is used.
+	Time time.Time
+	// OS and Architecture default to those of the running program.
+	OS           string
+	Architecture string
+}
+
+type rootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type history struct {
+	Created   string `json:"created"`
+	CreatedBy string `json:"created_by"`
+}
+
+type imageConfig struct {
+	Created      string    `json:"created"`
+	Architecture string    `json:"architecture"`
+	OS           string    `json:"os"`
+	RootFS       rootFS    `json:"rootfs"`
+	History      []history `json:"history"`
+}
+
+type manifest struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	MediaType     string            `json:"mediaType"`
+	Config        Descriptor        `json:"config"`
+	Layers        []Descriptor      `json:"layers"`
+	Annotations   map[string]string `json:"annotations,omitempty"`
+}
+
+// Export writes the worktree cfg to l as an image of two layers, the tree
+// of its base commit and its upper dir, tags it opts.Ref and returns its
+// manifest. Exporting the same tree and changes at the same time gives
+// the same digests.
+func Export(repo *gogit.Repository, cfg *worktrees.Config, l *Layout, opts Options) (Descriptor, error) {
+	base, err := cfg.BaseCommit(repo)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	tree, err := base.Tree()
+	if err != nil {
+		return Descriptor{}, err
+	}
+	mtime := opts.Time
+	if mtime.IsZero() {
+		mtime = base.Committer.When
+	}
+	mtime = mtime.UTC().Truncate(time.Second)
+	if opts.OS == "" {
+		opts.OS = runtime.GOOS
+	}
+	if opts.Architecture == "" {
+		opts.Architecture = runtime.GOARCH
+	}
+
+	baseLayer, baseDiffID, err := l.WriteLayer(func(tw *tar.Writer) error {
+		return writeTree(tw, repo.Storer, tree, "", mtime)
+	})
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("tree layer: %v", err)
+	}
+	upperLayer, upperDiffID, err := l.WriteLayer(func(tw *tar.Writer) error {
+		return writeUpper(tw, tree, cfg.Layer(), mtime)
+	})
+	if err != nil {
+		return Descriptor{}, fmt.Errorf("upper layer: %v", err)
+	}
+
+	created := mtime.Format(time.RFC3339)
+	config, err := l.WriteJSON(MediaTypeConfig, imageConfig{
+		Created:      created,
+		Architecture: opts.Architecture,
+		OS:           opts.OS,
+		RootFS:       rootFS{Type: "layers", DiffIDs: []string{baseDiffID, upperDiffID}},
+		History: []history{
+			{Created: created, CreatedBy: fmt.Sprintf("git-fuse-worktree: tree of %s", base.Hash)},
+			{Created: created, CreatedBy: fmt.Sprintf("git-fuse-worktree: upper dir of %s", cfg.Name)},
+		},
+	})
+	if err != nil {
+		return Descriptor{}, err
+	}
+	desc, err := l.WriteJSON(MediaTypeManifest, manifest{
+		SchemaVersion: 2,
+		MediaType:     MediaTypeManifest,
+		Config:        config,
+		Layers:        []Descriptor{baseLayer, upperLayer},
+		Annotations: map[string]string{
+			"org.opencontainers.image.created":  created,
+			"org.opencontainers.image.revision": base.Hash.String(),
+		},
+	})
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if err := l.Tag(opts.Ref, desc); err != nil {
+		return Descriptor{}, err
+	}
+	return desc, nil
+}
@@ -0,0 +1,198 @@
+package oci
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+)
+
+const (
+	// whiteoutPrefix marks a deleted path in a layer.
+	whiteoutPrefix = ".wh."
+	// opaqueWhiteout in a dir hides everything the layers below have in
+	// it.
+	opaqueWhiteout = ".wh..wh..opq"
+)
+
+// header returns a tar header owned by root, with mtime as its only time,
+// so that nothing about the machine the layer is written on ends up in
+// it.
+func header(name string, typ byte, mode int64, mtime time.Time) *tar.Header {
+	if typ == tar.TypeDir {
+		name += "/"
+	}
+	return &tar.Header{Typeflag: typ, Name: name, Mode: mode, ModTime: mtime}
+}
+
+// writeTree writes the entries of tree to tw, in tree order, reading the
+// blobs from s as they are needed.
+func writeTree(tw *tar.Writer, s storer.EncodedObjectStorer, tree *object.Tree, dir string, mtime time.Time) error {
+	for _, e := range tree.Entries {
+		name := path.Join(dir, e.Name)
+		switch e.Mode {
+		case filemode.Dir:
+			if err := tw.WriteHeader(header(name, tar.TypeDir, 0755, mtime)); err != nil {
+				return err
+			}
+			sub, err := object.GetTree(s, e.Hash)
+			if err != nil {
+				return err
+			}
+			if err := writeTree(tw, s, sub, name, mtime); err != nil {
+				return err
+			}
+		case filemode.Submodule:
+			// Submodules are not checked out, git leaves an empty dir.
+			if err := tw.WriteHeader(header(name, tar.TypeDir, 0755, mtime)); err != nil {
+				return err
+			}
+		case filemode.Symlink, filemode.Regular, filemode.Deprecated, filemode.Executable:
+			if err := writeBlob(tw, s, name, e, mtime); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeBlob(tw *tar.Writer, s storer.EncodedObjectStorer, name string, e object.TreeEntry, mtime time.Time) error {
+	blob, err := object.GetBlob(s, e.Hash)
+	if err != nil {
+		return err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if e.Mode == filemode.Symlink {
+		target, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		hdr := header(name, tar.TypeSymlink, 0777, mtime)
+		hdr.Linkname = string(target)
+		return tw.WriteHeader(hdr)
+	}
+	mode := int64(0644)
+	if e.Mode == filemode.Executable {
+		mode = 0755
+	}
+	hdr := header(name, tar.TypeReg, mode, mtime)
+	hdr.Size = blob.Size
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, r)
+	return err
+}
+
+// upperEntry is an entry of the upper layer, or a whiteout if fi is nil.
+type upperEntry struct {
+	name   string
+	fi     os.FileInfo
+	opaque bool
+}
+
+// writeUpper writes the upper layer to tw, sorted by name, with its
+// whiteouts and opaque dirs in the form OCI layers use. The contents of
+// metacopies are read from tree, the tree the layer is on top of.
+func writeUpper(tw *tar.Writer, tree *object.Tree, layer *upper.Layer, mtime time.Time) error {
+	deletions, err := layer.Deletions()
+	if err != nil {
+		return err
+	}
+	var entries []upperEntry
+	opaque := map[string]bool{}
+	for _, name := range deletions {
+		if fi, err := os.Lstat(layer.Abs(name)); err == nil && fi.IsDir() {
+			opaque[name] = true
+			continue
+		}
+		dir, base := path.Split(name)
+		entries = append(entries, upperEntry{name: dir + whiteoutPrefix + base})
+	}
+	err = layer.Walk(func(name string, fi os.FileInfo) error {
+		entries = append(entries, upperEntry{name: name, fi: fi, opaque: opaque[name]})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	for _, e := range entries {
+		if err := writeUpperEntry(tw, tree, layer, e, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeUpperEntry(tw *tar.Writer, tree *object.Tree, layer *upper.Layer, e upperEntry, mtime time.Time) error {
+	if e.fi == nil {
+		return tw.WriteHeader(header(e.name, tar.TypeReg, 0, mtime))
+	}
+	mode := int64(e.fi.Mode().Perm())
+	switch {
+	case e.fi.IsDir():
+		if err := tw.WriteHeader(header(e.name, tar.TypeDir, mode, mtime)); err != nil {
+			return err
+		}
+		if e.opaque {
+			return tw.WriteHeader(header(path.Join(e.name, opaqueWhiteout), tar.TypeReg, 0, mtime))
+		}
+		return nil
+	case e.fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(layer.Abs(e.name))
+		if err != nil {
+			return err
+		}
+		hdr := header(e.name, tar.TypeSymlink, 0777, mtime)
+		hdr.Linkname = target
+		return tw.WriteHeader(hdr)
+	case e.fi.Mode().IsRegular():
+		r, size, err := upperFile(tree, layer, e)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		hdr := header(e.name, tar.TypeReg, mode, mtime)
+		hdr.Size = size
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, r)
+		return err
+	}
+	// Devices, fifos and sockets have no place in an image of a worktree.
+	return nil
+}
+
+// upperFile opens the regular file e, reading a metacopy from tree.
+func upperFile(tree *object.Tree, layer *upper.Layer, e upperEntry) (io.ReadCloser, int64, error) {
+	if layer.Metacopy(e.name) {
+		if f, err := tree.File(e.name); err == nil {
+			r, err := f.Reader()
+			return r, f.Size, err
+		}
+	}
+	f, err := os.Open(layer.Abs(e.name))
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, e.fi.Size(), nil
+}
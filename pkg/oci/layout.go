@@ -0,0 +1,225 @@
+// Package oci writes worktrees as images in the OCI image layout: the
+// base tree as one layer read straight from git objects, and the changes
+// of the upper dir with their whiteouts as a second layer on top.
+package oci
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	MediaTypeIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeLayer    = "application/vnd.oci.image.layer.v1.tar+gzip"
+
+	// RefNameAnnotation names a manifest in the index of a layout.
+	RefNameAnnotation = "org.opencontainers.image.ref.name"
+
+	layoutFile    = "oci-layout"
+	layoutVersion = "1.0.0"
+	indexFile     = "index.json"
+)
+
+// Descriptor points at a blob of the layout.
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// Layout is an OCI image layout on disk.
+type Layout struct {
+	Dir string
+}
+
+// OpenLayout returns the layout in dir, creating it if needed.
+func OpenLayout(dir string) (*Layout, error) {
+	l := &Layout{Dir: dir}
+	if err := os.MkdirAll(l.blobDir(), 0755); err != nil {
+		return nil, err
+	}
+	p := filepath.Join(dir, layoutFile)
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		data, _ := json.Marshal(map[string]string{"imageLayoutVersion": layoutVersion})
+		if err := ioutil.WriteFile(p, data, 0644); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Layout) blobDir() string {
+	return filepath.Join(l.Dir, "blobs", "sha256")
+}
+
+// blobWriter writes a blob to a temporary file, hashing it on the way.
+type blobWriter struct {
+	f    *os.File
+	hash *hashWriter
+	w    io.Writer
+}
+
+// hashWriter counts and hashes what is written to it.
+type hashWriter struct {
+	h    hash.Hash
+	size int64
+}
+
+func (h *hashWriter) Write(p []byte) (int, error) {
+	h.size += int64(len(p))
+	return h.h.Write(p)
+}
+
+func (h *hashWriter) digest() string {
+	return "sha256:" + hex.EncodeToString(h.h.Sum(nil))
+}
+
+func newHashWriter() *hashWriter {
+	return &hashWriter{h: sha256.New()}
+}
+
+func (l *Layout) newBlob() (*blobWriter, error) {
+	f, err := ioutil.TempFile(l.Dir, ".blob-")
+	if err != nil {
+		return nil, err
+	}
+	b := &blobWriter{f: f, hash: newHashWriter()}
+	b.w = io.MultiWriter(f, b.hash)
+	return b, nil
+}
+
+func (b *blobWriter) Write(p []byte) (int, error) {
+	return b.w.Write(p)
+}
+
+// commit moves the blob to its place in the layout. A blob that is there
+// already has the same contents.
+func (l *Layout) commit(b *blobWriter, mediaType string) (Descriptor, error) {
+	if err := b.f.Close(); err != nil {
+		os.Remove(b.f.Name())
+		return Descriptor{}, err
+	}
+	desc := Descriptor{MediaType: mediaType, Digest: b.hash.digest(), Size: b.hash.size}
+	if err := os.Chmod(b.f.Name(), 0644); err != nil {
+		os.Remove(b.f.Name())
+		return Descriptor{}, err
+	}
+	if err := os.Rename(b.f.Name(), l.BlobPath(desc.Digest)); err != nil {
+		os.Remove(b.f.Name())
+		return Descriptor{}, err
+	}
+	return desc, nil
+}
+
+func (b *blobWriter) abort() {
+	b.f.Close()
+	os.Remove(b.f.Name())
+}
+
+// BlobPath returns where the blob digest is stored.
+func (l *Layout) BlobPath(digest string) string {
+	return filepath.Join(l.blobDir(), digest[len("sha256:"):])
+}
+
+// WriteBlob stores data as a blob of type mediaType.
+func (l *Layout) WriteBlob(mediaType string, data []byte) (Descriptor, error) {
+	b, err := l.newBlob()
+	if err != nil {
+		return Descriptor{}, err
+	}
+	if _, err := b.Write(data); err != nil {
+		b.abort()
+		return Descriptor{}, err
+	}
+	return l.commit(b, mediaType)
+}
+
+// WriteJSON stores v as a JSON blob of type mediaType.
+func (l *Layout) WriteJSON(mediaType string, v interface{}) (Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return l.WriteBlob(mediaType, data)
+}
+
+// WriteLayer stores the tar stream written by fn as a gzipped layer, and
+// returns it along with the digest of the uncompressed tar, its diff ID.
+// The gzip header carries no name or time, so the same entries always
+// give the same digests.
+func (l *Layout) WriteLayer(fn func(tw *tar.Writer) error) (Descriptor, string, error) {
+	b, err := l.newBlob()
+	if err != nil {
+		return Descriptor{}, "", err
+	}
+	zw := gzip.NewWriter(b)
+	diffID := newHashWriter()
+	tw := tar.NewWriter(io.MultiWriter(zw, diffID))
+	err = fn(tw)
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		b.abort()
+		return Descriptor{}, "", err
+	}
+	desc, err := l.commit(b, MediaTypeLayer)
+	return desc, diffID.digest(), err
+}
+
+// Tag records manifest in the index of the layout under ref, replacing
+// the manifest that had the name before.
+func (l *Layout) Tag(ref string, manifest Descriptor) error {
+	p := filepath.Join(l.Dir, indexFile)
+	idx := index{SchemaVersion: 2}
+	data, err := ioutil.ReadFile(p)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return err
+	}
+	idx.MediaType = MediaTypeIndex
+
+	manifest.Annotations = map[string]string{RefNameAnnotation: ref}
+	manifests := []Descriptor{}
+	for _, m := range idx.Manifests {
+		if m.Annotations[RefNameAnnotation] != ref {
+			manifests = append(manifests, m)
+		}
+	}
+	idx.Manifests = append(manifests, manifest)
+
+	if data, err = json.MarshalIndent(idx, "", "  "); err != nil {
+		return err
+	}
+	tmp := p + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p)
+}
@@ -0,0 +1,97 @@
+package upper
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultDeletionDirName is where upper dirs written before whiteouts
+// were used kept their deletion markers, unless told otherwise.
+const DefaultDeletionDirName = "GOUNIONFS_DELETIONS"
+
+// legacyDeletions reads the markers of the unionfs deletion dir, each
+// holding the path it deletes.
+func legacyDeletions(deletionDir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(deletionDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range infos {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(deletionDir, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if name := strings.Trim(string(contents), "/"); name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// NeedsMigration reports whether the upper dir still has the unionfs
+// deletion dir deletionDirName.
+func (l *Layer) NeedsMigration(deletionDirName string) bool {
+	if deletionDirName == "" {
+		deletionDirName = DefaultDeletionDirName
+	}
+	fi, err := os.Lstat(filepath.Join(l.Dir, deletionDirName))
+	return err == nil && fi.IsDir()
+}
+
+// Migrate turns the markers in the unionfs deletion dir deletionDirName
+// into whiteouts and opaque directories, then removes the deletion dir.
+// It returns the number of deletions converted.
+func (l *Layer) Migrate(deletionDirName string) (int, error) {
+	if deletionDirName == "" {
+		deletionDirName = DefaultDeletionDirName
+	}
+	deletionDir := filepath.Join(l.Dir, deletionDirName)
+	names, err := legacyDeletions(deletionDir)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// A marker hid the tree at its path and below; an upper dir at the
+	// same path made that dir opaque, and an upper file already covered
+	// the path by itself.
+	hidden := map[string]bool{}
+	isHidden := func(name string) bool {
+		for dir := filepath.Dir(name); dir != "."; dir = filepath.Dir(dir) {
+			if hidden[dir] {
+				return true
+			}
+		}
+		return false
+	}
+	n := 0
+	for _, name := range names {
+		fi, err := os.Lstat(l.Abs(name))
+		switch {
+		case err == nil && !fi.IsDir():
+			continue
+		case err != nil && !os.IsNotExist(err):
+			return n, err
+		case err != nil:
+			hidden[name] = true
+			if isHidden(name) {
+				continue
+			}
+		}
+		if err := l.Delete(name); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, os.RemoveAll(deletionDir)
+}
@@ -0,0 +1,372 @@
+// Package upper reads and edits the writable layer stacked on top of the
+// git tree of a worktree. It follows the conventions of overlayfs, so the
+// upper dir can be handed to kernel overlayfs and container tooling:
+// changed files live at their own path, a deleted path is a whiteout, and
+// a directory whose tree counterpart must not show through is opaque. A
+// file whose metadata alone changed is an empty metacopy, its contents
+// still being those of the tree.
+package upper
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// whiteoutXattr marks an empty file as a whiteout where no 0/0
+	// character device can be created.
+	whiteoutXattr = "overlay.whiteout"
+	// opaqueXattr is "y" on an opaque directory, and "x" on one holding
+	// whiteouts marked by whiteoutXattr.
+	opaqueXattr = "overlay.opaque"
+	// metacopyXattr marks an empty file as holding the metadata of the
+	// tree file at its path, and none of its contents.
+	metacopyXattr = "overlay.metacopy"
+)
+
+// xattrNamespaces are where the overlay xattrs are looked for: trusted is
+// what kernel overlayfs reads by default, user what it reads when mounted
+// with userxattr, as unprivileged mounts are.
+var xattrNamespaces = []string{"trusted.", "user."}
+
+// Layer is the upper dir of a worktree.
+type Layer struct {
+	Dir string
+}
+
+func New(dir string) *Layer {
+	return &Layer{Dir: dir}
+}
+
+// Abs returns the path of name inside the upper dir.
+func (l *Layer) Abs(name string) string {
+	return filepath.Join(l.Dir, filepath.FromSlash(name))
+}
+
+// getXattr returns the overlay xattr name of p and the namespace it was
+// found in.
+func getXattr(p, name string) (string, string, bool) {
+	buf := make([]byte, 16)
+	for _, ns := range xattrNamespaces {
+		if n, err := unix.Lgetxattr(p, ns+name, buf); err == nil {
+			return string(buf[:n]), ns, true
+		}
+	}
+	return "", "", false
+}
+
+// setXattr sets the overlay xattr name of p, in the trusted namespace if
+// allowed to and in the user namespace otherwise.
+func setXattr(p, name, value string) error {
+	err := unix.Lsetxattr(p, xattrNamespaces[0]+name, []byte(value), 0)
+	if err == nil {
+		return nil
+	}
+	return unix.Lsetxattr(p, xattrNamespaces[1]+name, []byte(value), 0)
+}
+
+func removeXattr(p, name string) error {
+	if _, ns, ok := getXattr(p, name); ok {
+		return unix.Lremovexattr(p, ns+name)
+	}
+	return nil
+}
+
+func isWhiteout(p string, fi os.FileInfo) bool {
+	mode := fi.Mode()
+	if mode&os.ModeDevice != 0 && mode&os.ModeCharDevice != 0 {
+		st, ok := fi.Sys().(*syscall.Stat_t)
+		return ok && st.Rdev == 0
+	}
+	if mode.IsRegular() && fi.Size() == 0 {
+		_, _, ok := getXattr(p, whiteoutXattr)
+		return ok
+	}
+	return false
+}
+
+func isOpaque(p string) bool {
+	v, _, ok := getXattr(p, opaqueXattr)
+	return ok && v == "y"
+}
+
+// whiteout creates a whiteout at p: a 0/0 character device, or where
+// that is not permitted an empty file with the whiteout xattr, whose
+// parent dir then has to be marked as holding such whiteouts.
+func whiteout(p string) error {
+	err := unix.Mknod(p, unix.S_IFCHR, 0)
+	if err != unix.EPERM {
+		return err
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	f.Close()
+	if err := setXattr(p, whiteoutXattr, ""); err != nil {
+		os.Remove(p)
+		return err
+	}
+	dir := filepath.Dir(p)
+	if _, _, ok := getXattr(dir, opaqueXattr); ok {
+		return nil
+	}
+	return setXattr(dir, opaqueXattr, "x")
+}
+
+// walk calls fn for every entry below the upper dir, parents before their
+// children.
+func (l *Layer) walk(fn func(name, p string, fi os.FileInfo) error) error {
+	if _, err := os.Lstat(l.Dir); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(l.Dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == l.Dir {
+			return nil
+		}
+		rel, err := filepath.Rel(l.Dir, p)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), p, fi)
+	})
+}
+
+// Metacopy reports whether the file at name is a metacopy, whose contents
+// are those of the tree file at its path.
+func (l *Layer) Metacopy(name string) bool {
+	_, _, ok := getXattr(l.Abs(name), metacopyXattr)
+	return ok
+}
+
+// SetMetacopy marks the empty file at name as a metacopy.
+func (l *Layer) SetMetacopy(name string) error {
+	return setXattr(l.Abs(name), metacopyXattr, "")
+}
+
+// ClearMetacopy makes the metacopy at name an empty file of its own.
+func (l *Layer) ClearMetacopy(name string) error {
+	return removeXattr(l.Abs(name), metacopyXattr)
+}
+
+// TempFile creates a file next to the upper dir, on the same filesystem,
+// for contents to be renamed into the upper dir once complete.
+func (l *Layer) TempFile() (*os.File, error) {
+	return ioutil.TempFile(filepath.Dir(l.Dir), "."+filepath.Base(l.Dir)+"-")
+}
+
+// Deletions returns the whiteouts and opaque directories, sorted. Either
+// hides the tree at its path.
+func (l *Layer) Deletions() ([]string, error) {
+	var names []string
+	err := l.walk(func(name, p string, fi os.FileInfo) error {
+		if isWhiteout(p, fi) || fi.IsDir() && isOpaque(p) {
+			names = append(names, name)
+		}
+		return nil
+	})
+	sort.Strings(names)
+	return names, err
+}
+
+// Walk calls fn for every file, symlink and directory in the upper dir,
+// parents before their children, skipping whiteouts.
+func (l *Layer) Walk(fn func(name string, fi os.FileInfo) error) error {
+	return l.walk(func(name, p string, fi os.FileInfo) error {
+		if isWhiteout(p, fi) {
+			return nil
+		}
+		return fn(name, fi)
+	})
+}
+
+// Delete hides the tree at name: a directory in the upper dir becomes
+// opaque, otherwise a whiteout is created.
+func (l *Layer) Delete(name string) error {
+	p := l.Abs(name)
+	fi, err := os.Lstat(p)
+	switch {
+	case err == nil && fi.IsDir():
+		return setXattr(p, opaqueXattr, "y")
+	case err == nil && isWhiteout(p, fi):
+		return nil
+	case err == nil:
+		return &os.PathError{Op: "whiteout", Path: p, Err: syscall.EEXIST}
+	case !os.IsNotExist(err):
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return whiteout(p)
+}
+
+// MkdirAll makes the dir name and its parents in the upper dir. A
+// whiteout in the way is replaced by an opaque dir, so that the tree it
+// hid stays hidden.
+func (l *Layer) MkdirAll(name string) error {
+	if name == "" || name == "." {
+		return nil
+	}
+	if err := l.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	p := l.Abs(name)
+	fi, err := os.Lstat(p)
+	switch {
+	case err == nil && fi.IsDir():
+		return nil
+	case err == nil && isWhiteout(p, fi):
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+		if err := os.Mkdir(p, 0755); err != nil {
+			return err
+		}
+		return setXattr(p, opaqueXattr, "y")
+	case err == nil:
+		return &os.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+	case !os.IsNotExist(err):
+		return err
+	}
+	return os.Mkdir(p, 0755)
+}
+
+// Undelete removes the whiteout at name, or makes the directory at name
+// transparent again. There is nothing to undo below a whiteout.
+func (l *Layer) Undelete(name string) error {
+	p := l.Abs(name)
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return removeXattr(p, opaqueXattr)
+	}
+	if isWhiteout(p, fi) {
+		return os.Remove(p)
+	}
+	return nil
+}
+
+// DropDeletions removes the whiteouts below the directory name and makes
+// the directories below it transparent.
+func (l *Layer) DropDeletions(name string) error {
+	root := l.Abs(name)
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		if fi.IsDir() {
+			return removeXattr(p, opaqueXattr)
+		}
+		if isWhiteout(p, fi) {
+			return os.Remove(p)
+		}
+		return nil
+	})
+}
+
+// Clear removes every change from the upper dir, keeping the dir itself.
+func (l *Layer) Clear() error {
+	infos, err := os.ReadDir(l.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, fi := range infos {
+		if err := os.RemoveAll(filepath.Join(l.Dir, fi.Name())); err != nil {
+			return err
+		}
+	}
+	return removeXattr(l.Dir, opaqueXattr)
+}
+
+// Match reports whether name is matched by pathspec: the path itself,
+// anything below it, or a glob matching name.
+func Match(pathspec, name string) bool {
+	pathspec = strings.Trim(pathspec, "/")
+	if pathspec == "" || pathspec == "." || pathspec == name || strings.HasPrefix(name, pathspec+"/") {
+		return true
+	}
+	ok, _ := filepath.Match(pathspec, name)
+	return ok
+}
+
+// Reset drops the changes to the paths matched by pathspecs, so that the
+// tree below shows through again. It returns the paths it touched.
+func (l *Layer) Reset(pathspecs []string) ([]string, error) {
+	matches := func(name string) bool {
+		for _, p := range pathspecs {
+			if Match(p, name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var reset []string
+	deletions, err := l.Deletions()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range deletions {
+		if matches(name) {
+			if err := l.Undelete(name); err != nil {
+				return reset, err
+			}
+			reset = append(reset, name)
+		}
+	}
+
+	var files []string
+	err = l.Walk(func(name string, _ os.FileInfo) error {
+		if matches(name) {
+			files = append(files, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return reset, err
+	}
+	// Directories come before their contents, which RemoveAll takes along.
+	for _, name := range files {
+		if err := os.RemoveAll(l.Abs(name)); err != nil {
+			return reset, err
+		}
+		reset = append(reset, name)
+	}
+	return reset, nil
+}
+
+// Empty reports whether the layer holds no changes.
+func (l *Layer) Empty() (bool, error) {
+	deletions, err := l.Deletions()
+	if err != nil || len(deletions) > 0 {
+		return false, err
+	}
+	empty := true
+	err = l.Walk(func(name string, fi os.FileInfo) error {
+		if !fi.IsDir() {
+			empty = false
+		}
+		return nil
+	})
+	return empty, err
+}
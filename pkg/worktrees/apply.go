@@ -0,0 +1,327 @@
+package worktrees
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+)
+
+// fileState is a file as a worktree shows it.
+type fileState struct {
+	data []byte
+	mode filemode.FileMode
+}
+
+// applier applies patches to a worktree, keeping the results in memory
+// until all of them applied.
+type applier struct {
+	repo    *gogit.Repository
+	layer   *upper.Layer
+	base    *TreeBuilder
+	deleted map[string]bool
+	// files holds the results of the patches so far, nil for a file the
+	// patches deleted.
+	files map[string]*fileState
+}
+
+// inBase reports whether the worktree shows the file name of the base
+// tree, ignoring the patches.
+func (a *applier) inBase(name string) (bool, error) {
+	for n := name; n != "."; n = path.Dir(n) {
+		if a.deleted[n] {
+			return false, nil
+		}
+		if n == name {
+			continue
+		}
+		if fi, err := os.Lstat(a.layer.Abs(n)); err == nil && !fi.IsDir() {
+			return false, nil
+		}
+	}
+	mode, _, ok, err := a.base.Entry(name)
+	return ok && mode.IsFile(), err
+}
+
+// read returns the file name as the worktree shows it with the patches
+// so far applied, or nil if there is none.
+func (a *applier) read(name string) (*fileState, error) {
+	if f, ok := a.files[name]; ok {
+		return f, nil
+	}
+	fi, err := os.Lstat(a.layer.Abs(name))
+	switch {
+	case err == nil && a.deleted[name] && !fi.IsDir():
+		// A whiteout.
+		return nil, nil
+	case err == nil && fi.IsDir():
+		return nil, fmt.Errorf("%s is a directory", name)
+	case err == nil:
+		mode, ok := FileMode(fi)
+		if !ok {
+			return nil, fmt.Errorf("%s is not a file", name)
+		}
+		r, _, err := upperFile(a.layer, a.base, name, fi)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		data, err := ioutil.ReadAll(r)
+		return &fileState{data: data, mode: mode}, err
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	ok, err := a.inBase(name)
+	if err != nil || !ok {
+		return nil, err
+	}
+	mode, hash, _, err := a.base.Entry(name)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := object.GetBlob(a.repo.Storer, hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	return &fileState{data: data, mode: mode}, err
+}
+
+// splitLines splits s after every newline.
+func splitLines(s string) []string {
+	var lines []string
+	for s != "" {
+		i := strings.IndexByte(s, '\n')
+		if i < 0 {
+			return append(lines, s)
+		}
+		lines = append(lines, s[:i+1])
+		s = s[i+1:]
+	}
+	return lines
+}
+
+// findLines returns where want is in lines, at or after min, looking
+// closest to start first; -1 if it is nowhere.
+func findLines(lines, want []string, start, min int) int {
+	matches := func(at int) bool {
+		if at < min || at+len(want) > len(lines) {
+			return false
+		}
+		for i, l := range want {
+			if lines[at+i] != l {
+				return false
+			}
+		}
+		return true
+	}
+	for off := 0; start-off >= min || start+off <= len(lines); off++ {
+		if matches(start + off) {
+			return start + off
+		}
+		if off > 0 && matches(start-off) {
+			return start - off
+		}
+	}
+	return -1
+}
+
+// applyHunks applies the hunks of the patch of name to data. Hunks that
+// moved by some lines are still found, but their context has to match.
+func applyHunks(name string, data []byte, hunks []Hunk) ([]byte, error) {
+	lines := splitLines(string(data))
+	var out []string
+	pos := 0
+	for i, h := range hunks {
+		var from, to []string
+		for _, l := range h.Lines {
+			switch l[0] {
+			case ' ':
+				from, to = append(from, l[1:]), append(to, l[1:])
+			case '-':
+				from = append(from, l[1:])
+			case '+':
+				to = append(to, l[1:])
+			}
+		}
+		// A hunk adding lines only starts after the line it names.
+		start := h.OldStart - 1
+		if h.OldLines == 0 {
+			start = h.OldStart
+		}
+		at := findLines(lines, from, start, pos)
+		if at < 0 {
+			return nil, fmt.Errorf("patch does not apply to %s: hunk %d at line %d", name, i+1, h.OldStart)
+		}
+		out = append(append(out, lines[pos:at]...), to...)
+		pos = at + len(from)
+	}
+	out = append(out, lines[pos:]...)
+	return []byte(strings.Join(out, "")), nil
+}
+
+func (a *applier) apply(fp *FilePatch) error {
+	var old *fileState
+	if fp.OldPath != "" {
+		var err error
+		if old, err = a.read(fp.OldPath); err != nil {
+			return err
+		}
+		if old == nil {
+			return fmt.Errorf("%s does not exist in the worktree", fp.OldPath)
+		}
+	}
+	if fp.NewPath != "" && fp.NewPath != fp.OldPath {
+		cur, err := a.read(fp.NewPath)
+		if err != nil {
+			return err
+		}
+		if cur != nil {
+			return fmt.Errorf("%s already exists in the worktree", fp.NewPath)
+		}
+	}
+	if fp.NewPath == "" {
+		if !fp.Binary {
+			data, err := applyHunks(fp.OldPath, old.data, fp.Hunks)
+			if err != nil {
+				return err
+			}
+			if len(data) > 0 {
+				return fmt.Errorf("patch does not apply to %s: it deletes only part of it", fp.OldPath)
+			}
+		}
+		a.files[fp.OldPath] = nil
+		return nil
+	}
+	if fp.Binary {
+		return fmt.Errorf("patch of binary file %s has no contents", fp.NewPath)
+	}
+
+	f := &fileState{mode: filemode.Regular}
+	if old != nil {
+		f.data, f.mode = old.data, old.mode
+		if fp.OldPath != fp.NewPath {
+			a.files[fp.OldPath] = nil
+		}
+	}
+	if fp.NewMode != filemode.Empty {
+		f.mode = fp.NewMode
+	}
+	data, err := applyHunks(fp.NewPath, f.data, fp.Hunks)
+	if err != nil {
+		return err
+	}
+	f.data = data
+	a.files[fp.NewPath] = f
+	return nil
+}
+
+// remove deletes name from the upper dir, leaving a whiteout if the base
+// tree has it.
+func (a *applier) remove(name string, inBase bool) error {
+	p := a.layer.Abs(name)
+	if fi, err := os.Lstat(p); err == nil && !fi.IsDir() && !a.deleted[name] {
+		if err := os.Remove(p); err != nil {
+			return err
+		}
+	}
+	if inBase {
+		return a.layer.Delete(name)
+	}
+	return nil
+}
+
+// writeUpperFile writes data to name in the upper layer, as a file or
+// symlink depending on mode, in place of whatever was there.
+func writeUpperFile(layer *upper.Layer, name string, mode filemode.FileMode, data []byte) error {
+	if err := layer.Undelete(name); err != nil {
+		return err
+	}
+	if err := layer.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	p := layer.Abs(name)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if mode == filemode.Symlink {
+		return os.Symlink(string(data), p)
+	}
+	perm := os.FileMode(0644)
+	if mode == filemode.Executable {
+		perm = 0755
+	}
+	return ioutil.WriteFile(p, data, perm)
+}
+
+// Apply applies the file patches to the worktree, writing the results
+// into its upper dir, and returns the paths changed. Nothing is written
+// unless every patch applies.
+func (cfg *Config) Apply(repo *gogit.Repository, patches []*FilePatch) ([]string, error) {
+	base, err := cfg.BaseCommit(repo)
+	if err != nil {
+		return nil, err
+	}
+	layer := cfg.Layer()
+	deletions, err := layer.Deletions()
+	if err != nil {
+		return nil, err
+	}
+	a := &applier{
+		repo:    repo,
+		layer:   layer,
+		base:    NewTreeBuilder(repo.Storer, base.TreeHash),
+		deleted: map[string]bool{},
+		files:   map[string]*fileState{},
+	}
+	for _, name := range deletions {
+		a.deleted[name] = true
+	}
+	for _, fp := range patches {
+		if err := a.apply(fp); err != nil {
+			return nil, err
+		}
+	}
+
+	var names []string
+	inBase := map[string]bool{}
+	for name, f := range a.files {
+		names = append(names, name)
+		if f == nil {
+			if inBase[name], err = a.inBase(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	sort.Strings(names)
+	// Deletions go first, a file may be replaced by a dir of new files.
+	for _, name := range names {
+		if a.files[name] == nil {
+			if err := a.remove(name, inBase[name]); err != nil {
+				return names, err
+			}
+		}
+	}
+	for _, name := range names {
+		if f := a.files[name]; f != nil {
+			if err := writeUpperFile(a.layer, name, f.mode, f.data); err != nil {
+				return names, err
+			}
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,206 @@
+package worktrees
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// BaseCommit returns the commit the worktree is based on.
+func (cfg *Config) BaseCommit(repo *gogit.Repository) (*object.Commit, error) {
+	if cfg.Commit == "" {
+		return nil, fmt.Errorf("worktree %s has no base commit", cfg.Name)
+	}
+	return repo.CommitObject(plumbing.NewHash(cfg.Commit))
+}
+
+// MergedTree writes the tree of the base commit with the changes of the
+// worktree applied and returns its hash.
+func (cfg *Config) MergedTree(repo *gogit.Repository) (plumbing.Hash, error) {
+	return cfg.mergedTree(repo, repo.Storer)
+}
+
+// mergedTree is MergedTree storing the new objects in s.
+func (cfg *Config) mergedTree(repo *gogit.Repository, s storer.EncodedObjectStorer) (plumbing.Hash, error) {
+	base, err := cfg.BaseCommit(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	changes, err := cfg.Changes(repo, s)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	b := NewTreeBuilder(s, base.TreeHash)
+	for _, c := range changes {
+		if c.Kind == Deleted {
+			err = b.Remove(c.Path)
+		} else {
+			err = b.Set(c.Path, c.To.Mode, c.To.Hash)
+		}
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	return b.Write()
+}
+
+// Signature returns the identity commits are made with, taken from the
+// GIT_<role>_NAME and GIT_<role>_EMAIL environment or the user section
+// of the git config.
+func Signature(repo *gogit.Repository, role string) (*object.Signature, error) {
+	sig := &object.Signature{
+		Name:  os.Getenv("GIT_" + role + "_NAME"),
+		Email: os.Getenv("GIT_" + role + "_EMAIL"),
+		When:  time.Now(),
+	}
+	if sig.Name == "" || sig.Email == "" {
+		cfg, err := repo.ConfigScoped(config.SystemScope)
+		if err != nil {
+			return nil, err
+		}
+		if sig.Name == "" {
+			sig.Name = cfg.User.Name
+		}
+		if sig.Email == "" {
+			sig.Email = cfg.User.Email
+		}
+	}
+	if sig.Name == "" || sig.Email == "" {
+		return nil, fmt.Errorf("no identity, set user.name and user.email")
+	}
+	return sig, nil
+}
+
+// WriteCommit stores a commit of tree with the given parents.
+func WriteCommit(repo *gogit.Repository, tree plumbing.Hash, parents []plumbing.Hash, message string) (plumbing.Hash, error) {
+	author, err := Signature(repo, "AUTHOR")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	committer, err := Signature(repo, "COMMITTER")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return writeCommit(repo, author, committer, tree, parents, message)
+}
+
+func writeCommit(repo *gogit.Repository, author, committer *object.Signature, tree plumbing.Hash, parents []plumbing.Hash, message string) (plumbing.Hash, error) {
+	commit := &object.Commit{
+		Author:       *author,
+		Committer:    *committer,
+		Message:      message,
+		TreeHash:     tree,
+		ParentHashes: parents,
+	}
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return repo.Storer.SetEncodedObject(obj)
+}
+
+// CommitOptions controls Commit.
+type CommitOptions struct {
+	Message string
+
+	// Branch, if set, is moved to the new commit. Unless Force is set it
+	// must point at the base commit or not exist.
+	Branch string
+	Force  bool
+
+	// Author and Committer are who the commit is made by, the identity
+	// of Signature if nil.
+	Author    *object.Signature
+	Committer *object.Signature
+}
+
+// Commit records the merged tree of the worktree as a commit on top of
+// its base commit.
+func Commit(repo *gogit.Repository, cfg *Config, opts CommitOptions) (plumbing.Hash, error) {
+	base, err := cfg.BaseCommit(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	var (
+		branch plumbing.ReferenceName
+		// old is the branch as read, nil if it does not exist.
+		old *plumbing.Reference
+	)
+	if opts.Branch != "" {
+		branch = plumbing.NewBranchReferenceName(opts.Branch)
+		ref, err := repo.Storer.Reference(branch)
+		switch {
+		case err == plumbing.ErrReferenceNotFound:
+		case err != nil:
+			return plumbing.ZeroHash, err
+		case ref.Hash() != base.Hash && !opts.Force:
+			return plumbing.ZeroHash, fmt.Errorf("branch %s is at %s, not at the base commit %s", opts.Branch, ref.Hash(), base.Hash)
+		default:
+			old = ref
+		}
+	}
+
+	tree, err := cfg.MergedTree(repo)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if tree == base.TreeHash {
+		return plumbing.ZeroHash, fmt.Errorf("nothing to commit")
+	}
+	author, committer := opts.Author, opts.Committer
+	if author == nil {
+		if author, err = Signature(repo, "AUTHOR"); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	if committer == nil {
+		if committer, err = Signature(repo, "COMMITTER"); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	commit, err := writeCommit(repo, author, committer, tree, []plumbing.Hash{base.Hash}, opts.Message)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+
+	if branch != "" {
+		oldHash := plumbing.ZeroHash
+		if old != nil {
+			oldHash = old.Hash()
+		}
+		if err := checkAndSetReference(repo, branch, commit, oldHash); err != nil {
+			return plumbing.ZeroHash, fmt.Errorf("move branch %s: %v", opts.Branch, err)
+		}
+	}
+	return commit, nil
+}
+
+// checkAndSetReference moves name to oid if it still is at old, or does
+// not exist if old is zero, so that a branch moved meanwhile, by a git
+// commit in another worktree for instance, is left alone. It goes through
+// git update-ref, which takes the lock git itself takes and handles
+// packed refs, where the CheckAndSetReference of go-git does neither.
+func checkAndSetReference(repo *gogit.Repository, name plumbing.ReferenceName, oid, old plumbing.Hash) error {
+	s, ok := repo.Storer.(interface{ Filesystem() billy.Filesystem })
+	if !ok {
+		return fmt.Errorf("repository is not on disk")
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", "--git-dir", s.Filesystem().Root(), "update-ref", name.String(), oid.String(), old.String())
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package worktrees
+
+import (
+	"context"
+	"io"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// memStorer keeps the objects written to it in memory, and reads the
+// others from the repository.
+type memStorer struct {
+	storer.EncodedObjectStorer
+	mem *memory.Storage
+}
+
+func newMemStorer(repo *gogit.Repository) *memStorer {
+	return &memStorer{EncodedObjectStorer: repo.Storer, mem: memory.NewStorage()}
+}
+
+func (s *memStorer) SetEncodedObject(o plumbing.EncodedObject) (plumbing.Hash, error) {
+	return s.mem.SetEncodedObject(o)
+}
+
+func (s *memStorer) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	if o, err := s.mem.EncodedObject(t, h); err == nil {
+		return o, nil
+	}
+	return s.EncodedObjectStorer.EncodedObject(t, h)
+}
+
+func (s *memStorer) HasEncodedObject(h plumbing.Hash) error {
+	if err := s.mem.HasEncodedObject(h); err == nil {
+		return nil
+	}
+	return s.EncodedObjectStorer.HasEncodedObject(h)
+}
+
+func (s *memStorer) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	if size, err := s.mem.EncodedObjectSize(h); err == nil {
+		return size, nil
+	}
+	return s.EncodedObjectStorer.EncodedObjectSize(h)
+}
+
+// Diff writes the changes of the worktree against its base commit to w
+// as a git unified diff, with renames detected and binary files marked.
+// The objects of the changes are only kept in memory, nothing is written
+// to the repository.
+func (cfg *Config) Diff(ctx context.Context, repo *gogit.Repository, w io.Writer) error {
+	base, err := cfg.BaseCommit(repo)
+	if err != nil {
+		return err
+	}
+	from, err := base.Tree()
+	if err != nil {
+		return err
+	}
+	s := newMemStorer(repo)
+	hash, err := cfg.mergedTree(repo, s)
+	if err != nil {
+		return err
+	}
+	to, err := object.GetTree(s, hash)
+	if err != nil {
+		return err
+	}
+	changes, err := object.DiffTreeWithOptions(ctx, from, to, object.DefaultDiffTreeOptions)
+	if err != nil {
+		return err
+	}
+	patch, err := changes.PatchContext(ctx)
+	if err != nil {
+		return err
+	}
+	return patch.Encode(w)
+}
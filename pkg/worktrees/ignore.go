@@ -0,0 +1,125 @@
+package worktrees
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+)
+
+// ignorer answers whether untracked paths are excluded by the .gitignore
+// files of the worktree. A .gitignore is read from the upper layer if it
+// was changed there and from the base tree otherwise, and only for the
+// directories asked about.
+type ignorer struct {
+	b       *TreeBuilder
+	layer   *upper.Layer
+	hidden  func(name string) bool
+	exclude []gitignore.Pattern
+	dirs    map[string][]gitignore.Pattern
+}
+
+func newIgnorer(repo *gogit.Repository, b *TreeBuilder, layer *upper.Layer, hidden func(string) bool) (*ignorer, error) {
+	m := &ignorer{b: b, layer: layer, hidden: hidden, dirs: map[string][]gitignore.Pattern{}}
+	if s, ok := repo.Storer.(interface{ Filesystem() billy.Filesystem }); ok {
+		f, err := s.Filesystem().Open("info/exclude")
+		if err == nil {
+			defer f.Close()
+			if m.exclude, err = readPatterns(f, nil); err != nil {
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func readPatterns(r io.Reader, domain []string) ([]gitignore.Pattern, error) {
+	var ps []gitignore.Pattern
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+		ps = append(ps, gitignore.ParsePattern(line, domain))
+	}
+	return ps, scanner.Err()
+}
+
+// patterns returns the patterns of the .gitignore in dir.
+func (m *ignorer) patterns(dir string) ([]gitignore.Pattern, error) {
+	if ps, ok := m.dirs[dir]; ok {
+		return ps, nil
+	}
+	var domain []string
+	if dir != "" {
+		domain = strings.Split(dir, "/")
+	}
+	name := path.Join(dir, ".gitignore")
+
+	var ps []gitignore.Pattern
+	f, err := os.Open(m.layer.Abs(name))
+	if err == nil && m.layer.Metacopy(name) {
+		// The patterns are those of the base tree.
+		f.Close()
+		err = os.ErrNotExist
+	}
+	switch {
+	case err == nil:
+		defer f.Close()
+		if ps, err = readPatterns(f, domain); err != nil {
+			return nil, err
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	case !m.hidden(name):
+		mode, hash, ok, err := m.b.Entry(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok && mode.IsFile() && mode != filemode.Symlink {
+			blob, err := object.GetBlob(m.b.s, hash)
+			if err != nil {
+				return nil, err
+			}
+			r, err := blob.Reader()
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			if ps, err = readPatterns(r, domain); err != nil {
+				return nil, err
+			}
+		}
+	}
+	m.dirs[dir] = ps
+	return ps, nil
+}
+
+// Ignored reports whether the untracked file name is excluded.
+func (m *ignorer) Ignored(name string) (bool, error) {
+	ps := append([]gitignore.Pattern{}, m.exclude...)
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		dirPs, err := m.patterns(strings.Join(parts[:i], "/"))
+		if err != nil {
+			return false, err
+		}
+		ps = append(ps, dirPs...)
+	}
+	if len(ps) == 0 {
+		return false, nil
+	}
+	return gitignore.NewMatcher(ps).Match(parts, false), nil
+}
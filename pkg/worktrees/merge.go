@@ -0,0 +1,181 @@
+package worktrees
+
+import (
+	"bytes"
+	"strings"
+)
+
+// matchLines returns the indexes i, j of the lines a[i] == b[j] that a
+// shortest edit script from a to b keeps, in increasing order. It is the
+// greedy algorithm of Myers, run on what is left between the common
+// prefix and suffix.
+func matchLines(a, b []string) [][2]int {
+	var pairs [][2]int
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		pairs = append(pairs, [2]int{prefix, prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	for _, p := range myers(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]) {
+		pairs = append(pairs, [2]int{prefix + p[0], prefix + p[1]})
+	}
+	for i := suffix; i > 0; i-- {
+		pairs = append(pairs, [2]int{len(a) - i, len(b) - i})
+	}
+	return pairs
+}
+
+func myers(a, b []string) [][2]int {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return nil
+	}
+	max := n + m
+	off := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+search:
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	var pairs [][2]int
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || k != d && v[off+k-1] < v[off+k+1] {
+			prevK = k + 1
+		}
+		prevX := v[off+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x--
+			y--
+			pairs = append(pairs, [2]int{x, y})
+		}
+		if d > 0 {
+			x, y = prevX, prevY
+		}
+	}
+	for i, j := 0, len(pairs)-1; i < j; i, j = i+1, j-1 {
+		pairs[i], pairs[j] = pairs[j], pairs[i]
+	}
+	return pairs
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// conflictLines appends lines to out, each ending in a newline so that a
+// conflict marker can follow.
+func conflictLines(out, lines []string) []string {
+	for _, l := range lines {
+		if !strings.HasSuffix(l, "\n") {
+			l += "\n"
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// Merge3 merges the changes from base to ours and from base to theirs,
+// line by line. Changes to the same lines that differ are conflicts,
+// kept between the markers git uses with ours and theirs labeling the
+// sides. It returns the merged contents and the number of conflicts.
+func Merge3(base, ours, theirs []byte, oursLabel, theirsLabel string) ([]byte, int) {
+	o := splitLines(string(base))
+	a := splitLines(string(ours))
+	b := splitLines(string(theirs))
+
+	// inA and inB map the lines of base to where ours and theirs kept
+	// them.
+	inA, inB := map[int]int{}, map[int]int{}
+	for _, p := range matchLines(o, a) {
+		inA[p[0]] = p[1]
+	}
+	for _, p := range matchLines(o, b) {
+		inB[p[0]] = p[1]
+	}
+
+	var out []string
+	conflicts := 0
+	i, ia, ib := 0, 0, 0
+	for i < len(o) || ia < len(a) || ib < len(b) {
+		if i < len(o) {
+			ka, okA := inA[i]
+			kb, okB := inB[i]
+			if okA && okB && ka == ia && kb == ib {
+				out = append(out, o[i])
+				i, ia, ib = i+1, ia+1, ib+1
+				continue
+			}
+		}
+		// The lines up to the next one both sides kept differ somewhere.
+		j, ja, jb := len(o), len(a), len(b)
+		for k := i; k < len(o); k++ {
+			ka, okA := inA[k]
+			kb, okB := inB[k]
+			if okA && okB {
+				j, ja, jb = k, ka, kb
+				break
+			}
+		}
+		co, ca, cb := o[i:j], a[ia:ja], b[ib:jb]
+		switch {
+		case equalLines(ca, co):
+			out = append(out, cb...)
+		case equalLines(cb, co), equalLines(ca, cb):
+			out = append(out, ca...)
+		default:
+			conflicts++
+			out = append(out, "<<<<<<< "+oursLabel+"\n")
+			out = conflictLines(out, ca)
+			out = append(out, "=======\n")
+			out = conflictLines(out, cb)
+			out = append(out, ">>>>>>> "+theirsLabel+"\n")
+		}
+		i, ia, ib = j, ja, jb
+	}
+	return []byte(strings.Join(out, "")), conflicts
+}
+
+// isBinary reports whether data looks like a binary file, the way git
+// decides: a NUL byte early on.
+func isBinary(data []byte) bool {
+	if len(data) > 8000 {
+		data = data[:8000]
+	}
+	return bytes.IndexByte(data, 0) >= 0
+}
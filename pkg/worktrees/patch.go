@@ -0,0 +1,256 @@
+package worktrees
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+)
+
+// FilePatch is the change to one file in a unified diff. OldPath is
+// empty for a new file, NewPath for a deleted one. The modes are only set
+// when the patch has them.
+type FilePatch struct {
+	OldPath string
+	NewPath string
+	OldMode filemode.FileMode
+	NewMode filemode.FileMode
+	// Binary is set for a binary file whose contents the patch lacks.
+	Binary bool
+	Hunks  []Hunk
+}
+
+// Hunk is a range of changed lines. Lines keep their ' ', '-' or '+'
+// prefix and their newline, which the last line of a side lacks if the
+// file does not end in one.
+type Hunk struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	Lines              []string
+}
+
+// patchParser reads a patch line by line, lines keeping their newline.
+type patchParser struct {
+	r    *bufio.Reader
+	line string
+	eof  bool
+	n    int
+}
+
+func (p *patchParser) next() error {
+	if p.eof {
+		p.line = ""
+		return nil
+	}
+	line, err := p.r.ReadString('\n')
+	if err == io.EOF {
+		p.eof = true
+		err = nil
+	}
+	p.line = line
+	p.n++
+	return err
+}
+
+func (p *patchParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("patch line %d: %s", p.n, fmt.Sprintf(format, args...))
+}
+
+// ParsePatch reads the file patches of a git or plain unified diff.
+func ParsePatch(r io.Reader) ([]*FilePatch, error) {
+	p := &patchParser{r: bufio.NewReader(r)}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	var patches []*FilePatch
+	for p.line != "" {
+		switch {
+		case strings.HasPrefix(p.line, "diff --git "):
+			fp, err := p.parseGit()
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, fp)
+		case strings.HasPrefix(p.line, "--- "):
+			fp := &FilePatch{}
+			if err := p.parseFiles(fp); err != nil {
+				return nil, err
+			}
+			if err := p.parseHunks(fp); err != nil {
+				return nil, err
+			}
+			patches = append(patches, fp)
+		default:
+			// Anything around the diffs, like a commit message, is skipped.
+			if err := p.next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return patches, nil
+}
+
+// parseGit reads a file patch starting at its diff --git line.
+func (p *patchParser) parseGit() (*FilePatch, error) {
+	fp := &FilePatch{}
+	fp.OldPath, fp.NewPath = splitGitPaths(strings.TrimSuffix(p.line, "\n")[len("diff --git "):])
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for {
+		line := strings.TrimSuffix(p.line, "\n")
+		var err error
+		switch {
+		case strings.HasPrefix(line, "old mode "):
+			fp.OldMode, err = filemode.New(line[len("old mode "):])
+		case strings.HasPrefix(line, "new mode "):
+			fp.NewMode, err = filemode.New(line[len("new mode "):])
+		case strings.HasPrefix(line, "new file mode "):
+			fp.OldPath = ""
+			fp.NewMode, err = filemode.New(line[len("new file mode "):])
+		case strings.HasPrefix(line, "deleted file mode "):
+			fp.NewPath = ""
+			fp.OldMode, err = filemode.New(line[len("deleted file mode "):])
+		case strings.HasPrefix(line, "rename from "):
+			fp.OldPath = line[len("rename from "):]
+		case strings.HasPrefix(line, "rename to "):
+			fp.NewPath = line[len("rename to "):]
+		case strings.HasPrefix(line, "index "):
+			// The modes of both sides when unchanged.
+			if fields := strings.Fields(line); len(fields) == 3 {
+				fp.OldMode, err = filemode.New(fields[2])
+				fp.NewMode = fp.OldMode
+			}
+		case strings.HasPrefix(line, "similarity index "), strings.HasPrefix(line, "dissimilarity index "):
+		case strings.HasPrefix(line, "Binary files "):
+			fp.Binary = true
+		case strings.HasPrefix(line, "GIT binary patch"):
+			return nil, p.errorf("binary patches are not supported")
+		case strings.HasPrefix(line, "copy from "), strings.HasPrefix(line, "copy to "):
+			return nil, p.errorf("copies are not supported")
+		case strings.HasPrefix(line, "--- "):
+			if err := p.parseFiles(fp); err != nil {
+				return nil, err
+			}
+			return fp, p.parseHunks(fp)
+		default:
+			return fp, nil
+		}
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// splitGitPaths splits the "a/<old> b/<new>" of a diff --git line. The
+// paths are ambiguous if they contain " b/", in which case both are taken
+// to be the same.
+func splitGitPaths(s string) (string, string) {
+	if i := strings.Index(s, " b/"); i >= 0 && strings.Count(s, " b/") == 1 {
+		return stripPrefix(s[:i]), stripPrefix(s[i+1:])
+	}
+	half := len(s) / 2
+	return stripPrefix(s[:half]), stripPrefix(s[half+1:])
+}
+
+// stripPrefix drops the a/ or b/ of a path in a patch, returning "" for
+// /dev/null.
+func stripPrefix(name string) string {
+	if i := strings.IndexByte(name, '\t'); i >= 0 {
+		name = name[:i]
+	}
+	if name == "/dev/null" {
+		return ""
+	}
+	if strings.HasPrefix(name, "a/") || strings.HasPrefix(name, "b/") {
+		return name[2:]
+	}
+	return name
+}
+
+// parseFiles reads the ---/+++ lines.
+func (p *patchParser) parseFiles(fp *FilePatch) error {
+	fp.OldPath = stripPrefix(strings.TrimSuffix(p.line, "\n")[len("--- "):])
+	if err := p.next(); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(p.line, "+++ ") {
+		return p.errorf("expected +++ line")
+	}
+	fp.NewPath = stripPrefix(strings.TrimSuffix(p.line, "\n")[len("+++ "):])
+	return p.next()
+}
+
+func parseRange(s string) (int, int, error) {
+	start, lines := s, "1"
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		start, lines = s[:i], s[i+1:]
+	}
+	a, err := strconv.Atoi(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	b, err := strconv.Atoi(lines)
+	return a, b, err
+}
+
+// parseHunks reads the hunks following the ---/+++ lines.
+func (p *patchParser) parseHunks(fp *FilePatch) error {
+	for strings.HasPrefix(p.line, "@@ -") {
+		fields := strings.Fields(p.line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[2], "+") {
+			return p.errorf("bad hunk header")
+		}
+		h := Hunk{}
+		var err error
+		if h.OldStart, h.OldLines, err = parseRange(fields[1][1:]); err != nil {
+			return p.errorf("bad hunk header: %v", err)
+		}
+		if h.NewStart, h.NewLines, err = parseRange(fields[2][1:]); err != nil {
+			return p.errorf("bad hunk header: %v", err)
+		}
+		if err := p.next(); err != nil {
+			return err
+		}
+		for oldN, newN := 0, 0; oldN < h.OldLines || newN < h.NewLines; {
+			line := p.line
+			if line == "\n" {
+				// Some tools drop the space of empty context lines.
+				line = " \n"
+			}
+			switch {
+			case strings.HasPrefix(line, " "):
+				oldN++
+				newN++
+			case strings.HasPrefix(line, "-"):
+				oldN++
+			case strings.HasPrefix(line, "+"):
+				newN++
+			default:
+				return p.errorf("hunk ends early")
+			}
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			h.Lines = append(h.Lines, line)
+			if err := p.next(); err != nil {
+				return err
+			}
+			if strings.HasPrefix(p.line, `\ `) {
+				// "\ No newline at end of file" is about the line before.
+				h.Lines[len(h.Lines)-1] = strings.TrimSuffix(line, "\n")
+				if err := p.next(); err != nil {
+					return err
+				}
+			}
+		}
+		fp.Hunks = append(fp.Hunks, h)
+	}
+	return nil
+}
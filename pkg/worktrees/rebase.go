@@ -0,0 +1,287 @@
+package worktrees
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+)
+
+// Conflict is a file a rebase could not merge cleanly.
+type Conflict struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+func readBlob(repo *gogit.Repository, hash plumbing.Hash) ([]byte, error) {
+	blob, err := object.GetBlob(repo.Storer, hash)
+	if err != nil {
+		return nil, err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+func readUpper(layer *upper.Layer, base *TreeBuilder, name string) ([]byte, error) {
+	fi, err := os.Lstat(layer.Abs(name))
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := upperFile(layer, base, name, fi)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// rebaser merges the changes of a worktree onto a new base tree.
+type rebaser struct {
+	repo      *gogit.Repository
+	layer     *upper.Layer
+	deleted   map[string]bool
+	oldBase   *TreeBuilder
+	newBase   *TreeBuilder
+	ours      string
+	theirs    string
+	paths     []string
+	conflicts []Conflict
+}
+
+func (r *rebaser) conflict(name, format string, args ...interface{}) {
+	r.conflicts = append(r.conflicts, Conflict{Path: name, Reason: fmt.Sprintf(format, args...)})
+}
+
+// blocked reports whether the upper dir has something in the way of a
+// file at name other than whiteouts: a dir at name, or a file at one of
+// its parents.
+func (r *rebaser) blocked(name string) bool {
+	if fi, err := os.Lstat(r.layer.Abs(name)); err == nil && fi.IsDir() {
+		return true
+	}
+	for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+		fi, err := os.Lstat(r.layer.Abs(dir))
+		if err == nil && !fi.IsDir() && !r.deleted[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rebaser) write(name string, mode filemode.FileMode, data []byte) error {
+	r.paths = append(r.paths, name)
+	return writeUpperFile(r.layer, name, mode, data)
+}
+
+// fillMetacopies gives the metacopies of files the new base changes the
+// contents they have in the old base, which they would no longer show.
+func (r *rebaser) fillMetacopies() error {
+	var names []string
+	err := r.layer.Walk(func(name string, fi os.FileInfo) error {
+		if !fi.Mode().IsRegular() || !r.layer.Metacopy(name) {
+			return nil
+		}
+		oldMode, oldHash, _, err := r.oldBase.Entry(name)
+		if err != nil {
+			return err
+		}
+		mode, hash, _, err := r.newBase.Entry(name)
+		if err != nil || mode == oldMode && hash == oldHash {
+			return err
+		}
+		names = append(names, name)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		fi, err := os.Lstat(r.layer.Abs(name))
+		if err != nil {
+			return err
+		}
+		data, err := readUpper(r.layer, r.oldBase, name)
+		if err != nil {
+			return err
+		}
+		mode, _ := FileMode(fi)
+		if err := r.write(name, mode, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// merge merges the change c with the file the new base has at its path.
+func (r *rebaser) merge(c Change) error {
+	mode, hash, ok, err := r.newBase.Entry(c.Path)
+	if err != nil {
+		return err
+	}
+	theirs := Entry{Mode: mode, Hash: hash}
+	switch {
+	case c.Kind == Deleted:
+		if !ok || theirs == c.From {
+			return nil
+		}
+		// The worktree shows the new version, which git would leave in
+		// the way of a deletion too.
+		r.conflict(c.Path, "deleted in %s, modified in %s", r.ours, r.theirs)
+		if !mode.IsFile() || r.blocked(c.Path) {
+			return nil
+		}
+		data, err := readBlob(r.repo, hash)
+		if err != nil {
+			return err
+		}
+		return r.write(c.Path, mode, data)
+	case !ok:
+		if c.Kind != Added {
+			r.conflict(c.Path, "modified in %s, deleted in %s", r.ours, r.theirs)
+		}
+		return nil
+	case !mode.IsFile():
+		r.conflict(c.Path, "file in %s, directory in %s", r.ours, r.theirs)
+		return nil
+	case theirs == c.To || theirs == c.From:
+		return nil
+	}
+
+	// Modes merge on their own: a side that did not change it takes the
+	// mode of the other.
+	newMode := c.To.Mode
+	if c.Kind != Added && c.To.Mode == c.From.Mode {
+		newMode = mode
+	}
+	if hash == c.To.Hash || hash == c.From.Hash {
+		if newMode == c.To.Mode {
+			return nil
+		}
+		data, err := readUpper(r.layer, r.oldBase, c.Path)
+		if err != nil {
+			return err
+		}
+		return r.write(c.Path, newMode, data)
+	}
+
+	var base []byte
+	if c.Kind != Added {
+		if base, err = readBlob(r.repo, c.From.Hash); err != nil {
+			return err
+		}
+	}
+	ours, err := readUpper(r.layer, r.oldBase, c.Path)
+	if err != nil {
+		return err
+	}
+	data, err := readBlob(r.repo, hash)
+	if err != nil {
+		return err
+	}
+	if isBinary(base) || isBinary(ours) || isBinary(data) || c.To.Mode == filemode.Symlink || mode == filemode.Symlink {
+		r.conflict(c.Path, "cannot merge, kept the version of %s", r.ours)
+		return nil
+	}
+	merged, n := Merge3(base, ours, data, r.ours, r.theirs)
+	switch {
+	case n > 0 && c.Kind == Added:
+		r.conflict(c.Path, "added in %s and in %s", r.ours, r.theirs)
+	case n > 0:
+		r.conflict(c.Path, "%d conflicting changes", n)
+	}
+	return r.write(c.Path, newMode, merged)
+}
+
+// Rebase three-way merges the changes of the worktree from its base
+// commit onto commit, writing the results into its upper dir. Files that
+// do not merge cleanly get conflict markers where they can hold them,
+// and are returned as conflicts. It returns the paths written as well;
+// the worktree has to be moved onto commit afterwards. label names the
+// side of commit in conflicts.
+func Rebase(repo *gogit.Repository, cfg *Config, commit plumbing.Hash, label string) ([]string, []Conflict, error) {
+	base, err := cfg.BaseCommit(repo)
+	if err != nil {
+		return nil, nil, err
+	}
+	c, err := repo.CommitObject(commit)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes, err := cfg.Changes(repo, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	layer := cfg.Layer()
+	deletions, err := layer.Deletions()
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &rebaser{
+		repo:    repo,
+		layer:   layer,
+		deleted: map[string]bool{},
+		oldBase: NewTreeBuilder(repo.Storer, base.TreeHash),
+		newBase: NewTreeBuilder(repo.Storer, c.TreeHash),
+		ours:    cfg.Name,
+		theirs:  label,
+	}
+	for _, name := range deletions {
+		r.deleted[name] = true
+	}
+	if err := r.fillMetacopies(); err != nil {
+		return r.paths, r.conflicts, err
+	}
+	changed := map[string]bool{}
+	for _, change := range changes {
+		changed[change.Path] = true
+		if err := r.merge(change); err != nil {
+			return r.paths, r.conflicts, fmt.Errorf("merge %s: %v", change.Path, err)
+		}
+	}
+
+	// Files copied up but left as they were in the old base would hide
+	// what the new base changed in them.
+	var stale []string
+	err = layer.Walk(func(name string, fi os.FileInfo) error {
+		if fi.IsDir() || changed[name] {
+			return nil
+		}
+		// Below an opaque dir the file is all there is.
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if r.deleted[dir] {
+				return nil
+			}
+		}
+		oldMode, oldHash, ok, err := r.oldBase.Entry(name)
+		if err != nil || !ok {
+			return err
+		}
+		mode, hash, ok, err := r.newBase.Entry(name)
+		if err != nil || ok && mode == oldMode && hash == oldHash {
+			return err
+		}
+		stale = append(stale, name)
+		return nil
+	})
+	if err != nil {
+		return r.paths, r.conflicts, err
+	}
+	for _, name := range stale {
+		if err := os.Remove(layer.Abs(name)); err != nil {
+			return r.paths, r.conflicts, err
+		}
+		r.paths = append(r.paths, name)
+	}
+	return r.paths, r.conflicts, nil
+}
@@ -0,0 +1,271 @@
+package worktrees
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+)
+
+// SnapshotRef returns the ref the snapshots of the worktree name are
+// chained under.
+func SnapshotRef(name string) plumbing.ReferenceName {
+	return plumbing.ReferenceName(fmt.Sprintf("refs/fuse-worktree/%s/snapshots", name))
+}
+
+// SnapshotInfo describes a snapshot. Base is the commit the worktree was
+// based on when it was taken.
+type SnapshotInfo struct {
+	ID      plumbing.Hash
+	Base    plumbing.Hash
+	Time    time.Time
+	Message string
+}
+
+func snapshotInfo(c *object.Commit) (SnapshotInfo, error) {
+	// The first parent is the previous snapshot, if any, the last one
+	// the base commit.
+	if len(c.ParentHashes) == 0 {
+		return SnapshotInfo{}, fmt.Errorf("%s is not a snapshot", c.Hash)
+	}
+	return SnapshotInfo{
+		ID:      c.Hash,
+		Base:    c.ParentHashes[len(c.ParentHashes)-1],
+		Time:    c.Committer.When,
+		Message: strings.TrimSpace(c.Message),
+	}, nil
+}
+
+// Snapshots returns the snapshots of the worktree, newest first.
+func Snapshots(repo *gogit.Repository, name string) ([]SnapshotInfo, error) {
+	ref, err := repo.Reference(SnapshotRef(name), true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []SnapshotInfo
+	for id := ref.Hash(); ; {
+		c, err := repo.CommitObject(id)
+		if err != nil {
+			return nil, err
+		}
+		info, err := snapshotInfo(c)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, info)
+		if len(c.ParentHashes) < 2 {
+			return snapshots, nil
+		}
+		id = c.ParentHashes[0]
+	}
+}
+
+// FindSnapshot returns the snapshot of the worktree whose ID starts with
+// id.
+func FindSnapshot(repo *gogit.Repository, name, id string) (SnapshotInfo, error) {
+	snapshots, err := Snapshots(repo, name)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	var found []SnapshotInfo
+	for _, s := range snapshots {
+		if strings.HasPrefix(s.ID.String(), id) {
+			found = append(found, s)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return SnapshotInfo{}, fmt.Errorf("no snapshot %s of %s", id, name)
+	case 1:
+		return found[0], nil
+	}
+	return SnapshotInfo{}, fmt.Errorf("snapshot %s is ambiguous", id)
+}
+
+// Snapshot records the merged tree of the worktree as a commit on its
+// snapshot ref. It returns false, and takes no snapshot, if the latest one
+// has the same tree and base, or if there is none and nothing changed.
+func Snapshot(repo *gogit.Repository, cfg *Config, message string) (plumbing.Hash, bool, error) {
+	base, err := cfg.BaseCommit(repo)
+	if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	tree, err := cfg.MergedTree(repo)
+	if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+
+	parents := []plumbing.Hash{base.Hash}
+	name := SnapshotRef(cfg.Name)
+	ref, err := repo.Reference(name, true)
+	switch {
+	case err == plumbing.ErrReferenceNotFound:
+		if tree == base.TreeHash {
+			return plumbing.ZeroHash, false, nil
+		}
+	case err != nil:
+		return plumbing.ZeroHash, false, err
+	default:
+		last, err := repo.CommitObject(ref.Hash())
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		info, err := snapshotInfo(last)
+		if err != nil {
+			return plumbing.ZeroHash, false, err
+		}
+		if last.TreeHash == tree && info.Base == base.Hash {
+			return last.Hash, false, nil
+		}
+		parents = []plumbing.Hash{last.Hash, base.Hash}
+	}
+
+	// Snapshots are taken in the background too, where no identity may
+	// be configured.
+	sig, err := Signature(repo, "COMMITTER")
+	if err != nil {
+		sig = &object.Signature{Name: "git-fuse-worktree", Email: "git-fuse-worktree@localhost", When: time.Now()}
+	}
+	if message == "" {
+		message = fmt.Sprintf("snapshot of %s", cfg.Name)
+	}
+	commit, err := writeCommit(repo, sig, sig, tree, parents, message+"\n")
+	if err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(name, commit)); err != nil {
+		return plumbing.ZeroHash, false, err
+	}
+	return commit, true, nil
+}
+
+// writeUpperBlob writes the blob hash to name in the upper layer, in
+// place of a whiteout or file at name, and of whiteouts above it.
+func writeUpperBlob(repo *gogit.Repository, layer *upper.Layer, name string, mode filemode.FileMode, hash plumbing.Hash) error {
+	if err := layer.Undelete(name); err != nil {
+		return err
+	}
+	if err := layer.MkdirAll(path.Dir(name)); err != nil {
+		return err
+	}
+	p := layer.Abs(name)
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	blob, err := repo.BlobObject(hash)
+	if err != nil {
+		return err
+	}
+	r, err := blob.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if mode == filemode.Symlink {
+		target, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return os.Symlink(string(target), p)
+	}
+	perm := os.FileMode(0644)
+	if mode == filemode.Executable {
+		perm = 0755
+	}
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.ReadFrom(r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// RestoreSnapshot writes the changes of snapshot s from its base into the
+// empty upper layer of the worktree, and returns the paths written. The
+// worktree must be moved to s.Base.
+func RestoreSnapshot(repo *gogit.Repository, cfg *Config, s SnapshotInfo) ([]string, error) {
+	base, err := repo.CommitObject(s.Base)
+	if err != nil {
+		return nil, err
+	}
+	baseTree, err := base.Tree()
+	if err != nil {
+		return nil, err
+	}
+	snap, err := repo.CommitObject(s.ID)
+	if err != nil {
+		return nil, err
+	}
+	snapTree, err := snap.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(baseTree, snapTree)
+	if err != nil {
+		return nil, err
+	}
+
+	layer := cfg.Layer()
+	// isTree reports whether the snapshot has a directory at name.
+	isTree := func(name string) bool {
+		e, err := snapTree.FindEntry(name)
+		return err == nil && e.Mode == filemode.Dir
+	}
+	// isFile reports whether the snapshot has a file or symlink at name.
+	isFile := func(name string) bool {
+		e, err := snapTree.FindEntry(name)
+		return err == nil && e.Mode != filemode.Dir && e.Mode != filemode.Submodule
+	}
+	var paths []string
+	deleted := map[string]bool{}
+	for _, c := range changes {
+		action, err := c.Action()
+		if err != nil {
+			return paths, err
+		}
+		if action == merkletrie.Delete {
+			// Mark the topmost directory that is gone as a whole, unless
+			// a file of the snapshot took its place and hides it already.
+			name := c.From.Name
+			for dir := path.Dir(name); dir != "." && !isTree(dir); dir = path.Dir(dir) {
+				name = dir
+			}
+			if name != c.From.Name && isFile(name) {
+				continue
+			}
+			if !deleted[name] {
+				if err := layer.Delete(name); err != nil {
+					return paths, err
+				}
+				deleted[name] = true
+				paths = append(paths, name)
+			}
+			continue
+		}
+		if c.To.TreeEntry.Mode == filemode.Submodule {
+			continue
+		}
+		if err := writeUpperBlob(repo, layer, c.To.Name, c.To.TreeEntry.Mode, c.To.TreeEntry.Hash); err != nil {
+			return paths, err
+		}
+		paths = append(paths, c.To.Name)
+	}
+	return paths, nil
+}
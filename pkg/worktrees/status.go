@@ -0,0 +1,226 @@
+package worktrees
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	gogit "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+)
+
+// Kinds of change between the base tree and a worktree.
+const (
+	Added       = "added"
+	Modified    = "modified"
+	Deleted     = "deleted"
+	ModeChanged = "mode-changed"
+)
+
+// Change is a file that differs between the base tree and the worktree.
+// From is the zero value for added files, To for deleted ones.
+type Change struct {
+	Path string
+	Kind string
+	From Entry
+	To   Entry
+}
+
+// Entry is a file in a tree.
+type Entry struct {
+	Mode filemode.FileMode
+	Hash plumbing.Hash
+}
+
+// upperFile opens the file at name in the upper layer, returning what git
+// stores for it: the contents of a file, the target of a symlink. The
+// contents of a metacopy are read from the tree of base.
+func upperFile(layer *upper.Layer, base *TreeBuilder, name string, fi os.FileInfo) (io.ReadCloser, int64, error) {
+	p := layer.Abs(name)
+	if fi.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(p)
+		if err != nil {
+			return nil, 0, err
+		}
+		return io.NopCloser(strings.NewReader(target)), int64(len(target)), nil
+	}
+	if layer.Metacopy(name) {
+		mode, hash, ok, err := base.Entry(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		// A metacopy of a file base does not have is as empty as the
+		// mount shows it.
+		if ok && mode.IsFile() {
+			blob, err := object.GetBlob(base.s, hash)
+			if err != nil {
+				return nil, 0, err
+			}
+			r, err := blob.Reader()
+			return r, blob.Size, err
+		}
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// HashBlob returns the hash of the blob holding the contents read from r.
+func HashBlob(r io.Reader, size int64) (plumbing.Hash, error) {
+	h := plumbing.NewHasher(plumbing.BlobObject, size)
+	if _, err := io.Copy(h, r); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return h.Sum(), nil
+}
+
+// Changes compares the worktree with its base commit. Only the upper layer
+// is read: the base tree is looked up at the paths it changes or deletes,
+// and only the files in the upper dir are hashed. Files written back
+// identical to the base are not changes, and untracked files excluded by
+// .gitignore are left out. If s is not nil, the contents of added and
+// modified files are stored in it.
+func (cfg *Config) Changes(repo *gogit.Repository, s storer.EncodedObjectStorer) ([]Change, error) {
+	commit, err := cfg.BaseCommit(repo)
+	if err != nil {
+		return nil, err
+	}
+	b := NewTreeBuilder(repo.Storer, commit.TreeHash)
+	layer := cfg.Layer()
+
+	deletions, err := layer.Deletions()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		base      = map[string]Entry{}
+		deleted   = map[string]bool{}
+		upperDirs = map[string]bool{}
+		upperInfo = map[string]os.FileInfo{}
+	)
+	// addBase records the files of the base tree at or below name. A
+	// whole tree is only read when it was deleted or replaced.
+	addBase := func(name string, tree bool) error {
+		mode, hash, ok, err := b.Entry(name)
+		if err != nil || !ok {
+			return err
+		}
+		if mode != filemode.Dir {
+			if mode.IsFile() {
+				base[name] = Entry{Mode: mode, Hash: hash}
+			}
+			return nil
+		}
+		if !tree {
+			return nil
+		}
+		t, err := object.GetTree(repo.Storer, hash)
+		if err != nil {
+			return err
+		}
+		return t.Files().ForEach(func(f *object.File) error {
+			base[name+"/"+f.Name] = Entry{Mode: f.Mode, Hash: f.Hash}
+			return nil
+		})
+	}
+
+	for _, name := range deletions {
+		deleted[name] = true
+		if err := addBase(name, true); err != nil {
+			return nil, err
+		}
+	}
+	err = layer.Walk(func(name string, fi os.FileInfo) error {
+		if fi.IsDir() {
+			upperDirs[name] = true
+			return addBase(name, false)
+		}
+		if _, ok := FileMode(fi); !ok {
+			return nil
+		}
+		upperInfo[name] = fi
+		return addBase(name, true)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// hidden reports whether the base file name is gone from the worktree
+	// when the upper dir has nothing at name itself.
+	hidden := func(name string) bool {
+		if deleted[name] || upperDirs[name] {
+			return true
+		}
+		for dir := path.Dir(name); dir != "."; dir = path.Dir(dir) {
+			if _, ok := upperInfo[dir]; ok || deleted[dir] {
+				return true
+			}
+		}
+		return false
+	}
+	ignore, err := newIgnorer(repo, b, layer, hidden)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []Change
+	for name, from := range base {
+		if _, ok := upperInfo[name]; !ok && hidden(name) {
+			changes = append(changes, Change{Path: name, Kind: Deleted, From: from})
+		}
+	}
+	for name, fi := range upperInfo {
+		from, tracked := base[name]
+		if !tracked {
+			ignored, err := ignore.Ignored(name)
+			if err != nil {
+				return nil, err
+			}
+			if ignored {
+				continue
+			}
+		}
+
+		mode, _ := FileMode(fi)
+		to := Entry{Mode: mode, Hash: from.Hash}
+		// A metacopy changes no contents, nothing to hash.
+		if !tracked || !layer.Metacopy(name) {
+			r, size, err := upperFile(layer, b, name, fi)
+			if err != nil {
+				return nil, err
+			}
+			if s != nil {
+				to.Hash, err = WriteBlob(s, r, size)
+			} else {
+				to.Hash, err = HashBlob(r, size)
+			}
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		switch {
+		case !tracked:
+			changes = append(changes, Change{Path: name, Kind: Added, To: to})
+		case from.Hash != to.Hash:
+			changes = append(changes, Change{Path: name, Kind: Modified, From: from, To: to})
+		case from.Mode != to.Mode:
+			changes = append(changes, Change{Path: name, Kind: ModeChanged, From: from, To: to})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	return changes, nil
+}
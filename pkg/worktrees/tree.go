@@ -0,0 +1,237 @@
+package worktrees
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// TreeBuilder edits a git tree. Only the trees on the path of an edit are
+// read; Write stores the changed ones.
+type TreeBuilder struct {
+	s    storer.EncodedObjectStorer
+	root *treeNode
+}
+
+type treeNode struct {
+	hash    plumbing.Hash
+	entries map[string]*treeEntry
+	dirty   bool
+}
+
+type treeEntry struct {
+	mode filemode.FileMode
+	hash plumbing.Hash
+	tree *treeNode
+}
+
+// NewTreeBuilder starts editing the tree base, which may be the zero hash
+// for an empty tree.
+func NewTreeBuilder(s storer.EncodedObjectStorer, base plumbing.Hash) *TreeBuilder {
+	return &TreeBuilder{s: s, root: &treeNode{hash: base}}
+}
+
+func (b *TreeBuilder) load(n *treeNode) error {
+	if n.entries != nil {
+		return nil
+	}
+	n.entries = map[string]*treeEntry{}
+	if n.hash.IsZero() {
+		return nil
+	}
+	tree, err := object.GetTree(b.s, n.hash)
+	if err != nil {
+		return fmt.Errorf("read tree %s: %v", n.hash, err)
+	}
+	for _, e := range tree.Entries {
+		n.entries[e.Name] = &treeEntry{mode: e.Mode, hash: e.Hash}
+	}
+	return nil
+}
+
+// dir returns the tree at the slash separated name, creating it (and
+// replacing files in the way) when create is set. Every tree on the way
+// is marked dirty when create is set.
+func (b *TreeBuilder) dir(name string, create bool) (*treeNode, error) {
+	n := b.root
+	if err := b.load(n); err != nil {
+		return nil, err
+	}
+	if name == "" || name == "." {
+		if create {
+			n.dirty = true
+		}
+		return n, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		e, ok := n.entries[part]
+		if !ok || e.mode != filemode.Dir {
+			if !create {
+				return nil, nil
+			}
+			e = &treeEntry{mode: filemode.Dir}
+			n.entries[part] = e
+		}
+		if e.tree == nil {
+			e.tree = &treeNode{hash: e.hash}
+		}
+		if create {
+			n.dirty = true
+		}
+		n = e.tree
+		if err := b.load(n); err != nil {
+			return nil, err
+		}
+	}
+	if create {
+		n.dirty = true
+	}
+	return n, nil
+}
+
+func split(name string) (string, string) {
+	i := strings.LastIndex(name, "/")
+	if i < 0 {
+		return "", name
+	}
+	return name[:i], name[i+1:]
+}
+
+// Entry returns the mode and hash at name, or false if there is nothing.
+func (b *TreeBuilder) Entry(name string) (filemode.FileMode, plumbing.Hash, bool, error) {
+	dir, base := split(name)
+	n, err := b.dir(dir, false)
+	if err != nil || n == nil {
+		return 0, plumbing.ZeroHash, false, err
+	}
+	e, ok := n.entries[base]
+	if !ok {
+		return 0, plumbing.ZeroHash, false, nil
+	}
+	return e.mode, e.hash, true, nil
+}
+
+// Set puts a blob or submodule at name.
+func (b *TreeBuilder) Set(name string, mode filemode.FileMode, hash plumbing.Hash) error {
+	dir, base := split(name)
+	n, err := b.dir(dir, true)
+	if err != nil {
+		return err
+	}
+	n.entries[base] = &treeEntry{mode: mode, hash: hash}
+	return nil
+}
+
+// Remove deletes name, and everything below it if it is a tree.
+func (b *TreeBuilder) Remove(name string) error {
+	dir, base := split(name)
+	n, err := b.dir(dir, false)
+	if err != nil || n == nil {
+		return err
+	}
+	if _, ok := n.entries[base]; !ok {
+		return nil
+	}
+	if _, err := b.dir(dir, true); err != nil {
+		return err
+	}
+	delete(n.entries, base)
+	return nil
+}
+
+// Write stores every changed tree and returns the hash of the root.
+func (b *TreeBuilder) Write() (plumbing.Hash, error) {
+	if err := b.load(b.root); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return b.write(b.root)
+}
+
+func (b *TreeBuilder) write(n *treeNode) (plumbing.Hash, error) {
+	if !n.dirty {
+		return n.hash, nil
+	}
+	tree := &object.Tree{}
+	for name, e := range n.entries {
+		if e.tree != nil {
+			hash, err := b.write(e.tree)
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+			// git does not keep empty trees.
+			if len(e.tree.entries) == 0 && e.tree.entries != nil {
+				continue
+			}
+			e.hash = hash
+		}
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: e.mode, Hash: e.hash})
+	}
+	sort.Sort(treeEntrySorter(tree.Entries))
+
+	obj := b.s.NewEncodedObject()
+	if err := tree.Encode(obj); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	hash, err := b.s.SetEncodedObject(obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	n.hash, n.dirty = hash, false
+	return hash, nil
+}
+
+// treeEntrySorter orders entries the way git does, comparing trees as if
+// their name ended with a slash.
+type treeEntrySorter []object.TreeEntry
+
+func (s treeEntrySorter) Len() int      { return len(s) }
+func (s treeEntrySorter) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s treeEntrySorter) Less(i, j int) bool {
+	return sortName(s[i]) < sortName(s[j])
+}
+
+func sortName(e object.TreeEntry) string {
+	if e.Mode == filemode.Dir {
+		return e.Name + "/"
+	}
+	return e.Name
+}
+
+// WriteBlob stores the contents read from r as a blob.
+func WriteBlob(s storer.EncodedObjectStorer, r io.Reader, size int64) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	obj.SetSize(size)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
+
+// FileMode returns the git mode of a file in the upper dir.
+func FileMode(fi os.FileInfo) (filemode.FileMode, bool) {
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		return filemode.Symlink, true
+	case fi.Mode().IsRegular() && fi.Mode()&0111 != 0:
+		return filemode.Executable, true
+	case fi.Mode().IsRegular():
+		return filemode.Regular, true
+	}
+	return 0, false
+}
@@ -1 +1,68 @@
+// Package worktrees keeps the state of fuse worktrees in their admin dir
+// and turns their upper layer into git objects.
 package worktrees
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/chiyutianyi/git-fuse-worktree/pkg/upper"
+)
+
+// ConfigFile is the name of the worktree config in the admin dir.
+const ConfigFile = "fuse-worktree.json"
+
+// Config is what a worktree records about itself when it is added.
+type Config struct {
+	Name string `json:"name"`
+
+	// Revision is the revision the worktree was added with, Commit the
+	// commit it resolved to and which the upper layer is based on.
+	Revision string `json:"revision"`
+	Commit   string `json:"commit"`
+
+	// Upper is the upper dir. An ephemeral one is private to a mount and
+	// removed when it goes away.
+	Upper     string `json:"upper"`
+	Ephemeral bool   `json:"ephemeral,omitempty"`
+
+	// DeletionDirName is the unionfs deletion dir of an upper dir written
+	// before whiteouts were used, which is migrated when mounting.
+	DeletionDirName string `json:"deletion_dir_name,omitempty"`
+}
+
+// LoadConfig reads the config from the admin dir of a worktree.
+func LoadConfig(adminDir string) (*Config, error) {
+	data, err := ioutil.ReadFile(filepath.Join(adminDir, ConfigFile))
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Save writes cfg to the admin dir of a worktree.
+func (cfg *Config) Save(adminDir string) error {
+	data, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(adminDir, 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(adminDir, ConfigFile+".tmp")
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(adminDir, ConfigFile))
+}
+
+// Layer returns the upper layer of the worktree.
+func (cfg *Config) Layer() *upper.Layer {
+	return upper.New(cfg.Upper)
+}